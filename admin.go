@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		warnf("admin: %v", err)
+	}
+}
+
+// runAdmin serves the admin API on addr, answering queries from the stats
+// goroutine, and managing cache when set.
+func runAdmin(addr string, events chan event, ready *readiness, cache *responseCache) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	expvar.Publish("histograms", expvar.Func(func() interface{} {
+		var histograms map[string]histogramSummary
+		inspect(events, func(s *stats) {
+			histograms = s.histograms()
+		})
+		return histograms
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		err := ready.check(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/destinations", func(w http.ResponseWriter, r *http.Request) {
+		limit := 10
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		var destinations []destinationStats
+		inspect(events, func(s *stats) {
+			destinations = s.topDestinations()
+		})
+		if limit > 0 && len(destinations) > limit {
+			destinations = destinations[:limit]
+		}
+		writeJSON(w, destinations)
+	})
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		var conns []activeConn
+		inspect(events, func(s *stats) {
+			conns = s.activeConns()
+		})
+		writeJSON(w, conns)
+	})
+	mux.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		var tags []tagStats
+		inspect(events, func(s *stats) {
+			tags = s.tagTotals()
+		})
+		writeJSON(w, tags)
+	})
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(upstreamErrors.String()))
+	})
+	mux.HandleFunc("/histograms", func(w http.ResponseWriter, r *http.Request) {
+		var histograms map[string]histogramSummary
+		inspect(events, func(s *stats) {
+			histograms = s.histograms()
+		})
+		writeJSON(w, histograms)
+	})
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if cache == nil {
+			http.Error(w, "cache disabled", http.StatusNotFound)
+			return
+		}
+		var pattern *regexp.Regexp
+		if v := r.URL.Query().Get("pattern"); v != "" {
+			var err error
+			if pattern, err = regexp.Compile(v); err != nil {
+				http.Error(w, "invalid pattern: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, cache.list(pattern))
+		case http.MethodDelete:
+			var target *url.URL
+			if v := r.URL.Query().Get("url"); v != "" {
+				var err error
+				if target, err = url.Parse(v); err != nil || target.Host == "" {
+					http.Error(w, "invalid url", http.StatusBadRequest)
+					return
+				}
+			} else if pattern == nil {
+				http.Error(w, "url or pattern required", http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, map[string]int{"purged": cache.purge(target, pattern)})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		if cache == nil {
+			http.Error(w, "cache disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, cache.stats())
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ch := make(chan notification, 64)
+		inspect(events, func(s *stats) {
+			s.subscribers[ch] = struct{}{}
+		})
+		defer inspect(events, func(s *stats) {
+			delete(s.subscribers, ch)
+		})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case n := <-ch:
+				buf, err := json.Marshal(n)
+				if err != nil {
+					warnf("admin: %v", err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", n.Type, buf)
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		infof("admin API listening on %s", addr)
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// isAdminSocket tells whether the admin API address is the path of a unix
+// socket, like /run/nanoproxy-admin.sock, rather than a TCP address.
+func isAdminSocket(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if isAdminSocket(addr) {
+		os.Remove(addr)
+		return net.Listen("unix", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// activeConn describes a connection in progress, as listed by the admin API.
+type activeConn struct {
+	ID         string  `json:"id"`
+	Client     string  `json:"client"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	Tag        string  `json:"tag,omitempty"`
+	Age        float64 `json:"age_seconds"`
+	Uploaded   uint64  `json:"uploaded_bytes"`
+	Downloaded uint64  `json:"downloaded_bytes"`
+}
+
+// activeConns lists the connections in progress, oldest first.
+func (s *stats) activeConns() []activeConn {
+	conns := make([]activeConn, 0, len(s.conn))
+	for _, conn := range s.conn {
+		counters := conn.snapshot()
+		conns = append(conns, activeConn{
+			ID:         conn.id,
+			Client:     conn.conn.RemoteAddr().String(),
+			Method:     conn.remote.method,
+			Host:       conn.remote.host,
+			Tag:        conn.tag,
+			Age:        time.Since(conn.startedAt).Seconds(),
+			Uploaded:   counters.readBytes,
+			Downloaded: counters.writtenBytes,
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Age > conns[j].Age })
+	return conns
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminClient queries the admin API of a running nanoproxy.
+type adminClient struct {
+	client *http.Client
+	base   string
+}
+
+// newAdminClient returns a client of the admin API at addr, a TCP address
+// or the path of a unix socket.
+func newAdminClient(addr string, timeout time.Duration) *adminClient {
+	if !isAdminSocket(addr) {
+		return &adminClient{
+			client: &http.Client{Timeout: timeout},
+			base:   "http://" + addr,
+		}
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		},
+	}
+	return &adminClient{
+		client: &http.Client{Timeout: timeout, Transport: transport},
+		base:   "http://nanoproxy",
+	}
+}
+
+// get decodes the JSON answered at path into v.
+func (c *adminClient) get(path string, v interface{}) error {
+	resp, err := c.client.Get(c.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// coreCounters are the counters printed first, in this order.
+var coreCounters = []string{
+	"accepted_connections", "active_connections", "rejected_connections", "shed_connections",
+	"resolver_errors", "uploaded_bytes", "downloaded_bytes",
+}
+
+// skippedVars are the variables of /debug/vars not worth printing as
+// counters.
+var skippedVars = map[string]bool{
+	"cmdline":    true,
+	"memstats":   true,
+	"histograms": true,
+}
+
+// flattenCounters returns the numeric values of the expvar variables, the
+// entries of maps being named like variable.key.
+func flattenCounters(vars map[string]interface{}) map[string]float64 {
+	counters := map[string]float64{}
+	for name, value := range vars {
+		if skippedVars[name] {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			counters[name] = v
+		case map[string]interface{}:
+			for key, entry := range v {
+				if n, ok := entry.(float64); ok {
+					counters[name+"."+key] = n
+				}
+			}
+		}
+	}
+	return counters
+}
+
+func formatCounter(name string, value float64) string {
+	if strings.HasSuffix(name, "_bytes") {
+		return humanBytes(uint64(value))
+	}
+	return fmt.Sprintf("%.0f", value)
+}
+
+// printStats prints the counters and the active connections of the
+// nanoproxy whose admin API c queries.
+func printStats(w io.Writer, c *adminClient) error {
+	vars := map[string]interface{}{}
+	if err := c.get("/debug/vars", &vars); err != nil {
+		return err
+	}
+	var conns []activeConn
+	if err := c.get("/connections", &conns); err != nil {
+		return err
+	}
+	counters := flattenCounters(vars)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range coreCounters {
+		if value, ok := counters[name]; ok {
+			fmt.Fprintf(tw, "%s\t%s\n", name, formatCounter(name, value))
+			delete(counters, name)
+		}
+	}
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, formatCounter(name, counters[name]))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d active connections\n", len(conns))
+	if len(conns) == 0 {
+		return nil
+	}
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLIENT\tMETHOD\tHOST\tTAG\tAGE\tUP\tDOWN")
+	for _, conn := range conns {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", conn.ID, conn.Client, conn.Method, conn.Host, conn.Tag,
+			humanDuration(time.Duration(conn.Age*float64(time.Second))), humanBytes(conn.Uploaded), humanBytes(conn.Downloaded))
+	}
+	return tw.Flush()
+}
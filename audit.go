@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// auditGenesis is the hash the first entry of an audit log chains from.
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// auditEntry is a line of an audit log. Its hash covers the hash of the
+// previous entry and its record, as written: altering, inserting or
+// removing an entry breaks the chain from there on.
+type auditEntry struct {
+	Record json.RawMessage `json:"record"`
+	Prev   string          `json:"prev"`
+	Hash   string          `json:"hash"`
+}
+
+func auditHash(prev string, record []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(prev))
+	sum.Write(record)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// auditLog appends connection records to a hash-chained file, as JSON
+// lines.
+type auditLog struct {
+	mtx  sync.Mutex
+	file *os.File
+	last string
+}
+
+// openAuditLog opens the audit log at path, continuing the chain of its
+// entries.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	last := auditGenesis
+	lines := bufio.NewScanner(file)
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		entry := auditEntry{}
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid audit log %s: %v", path, err)
+		}
+		last = entry.Hash
+	}
+	if err := lines.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &auditLog{file: file, last: last}, nil
+}
+
+func (a *auditLog) save(record connRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	entry := auditEntry{Record: raw, Prev: a.last, Hash: auditHash(a.last, raw)}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.last = entry.Hash
+	return nil
+}
+
+// verifyAuditLog checks the chain of the audit log read from r, and returns
+// the number of entries and the hash of the last one.
+func verifyAuditLog(r io.Reader) (int, string, error) {
+	prev := auditGenesis
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, 1<<20)
+	n := 0
+	for line := 1; lines.Scan(); line++ {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		entry := auditEntry{}
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			return n, prev, fmt.Errorf("line %d: %v", line, err)
+		}
+		if entry.Prev != prev {
+			return n, prev, fmt.Errorf("line %d: chained from %s instead of %s, entries were removed or inserted", line, entry.Prev, prev)
+		}
+		if hash := auditHash(prev, entry.Record); hash != entry.Hash {
+			return n, prev, fmt.Errorf("line %d: hash %s does not match its record, which was altered", line, entry.Hash)
+		}
+		prev = entry.Hash
+		n++
+	}
+	return n, prev, lines.Err()
+}
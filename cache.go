@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var responseCacheStats = expvar.NewMap("response_cache")
+
+// cacheableStatuses can be stored without explicit freshness information.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// maxHeuristicLifetime bounds the freshness of the responses without
+// explicit expiration, guessed from their Last-Modified header.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// cacheEntry is a stored response, with what tells whether it is fresh.
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	// the body is held in memory, or in the files named after file when
+	// the cache is on disk
+	body     []byte
+	bodySize int64
+	file     string
+	// the request header fields named by the Vary header of the response
+	vary http.Header
+	// when the response was received, how old it was then, and how long it
+	// is fresh for
+	received   time.Time
+	initialAge time.Duration
+	lifetime   time.Duration
+	// set on the entries loaded from disk, which are revalidated before use
+	revalidate bool
+	// how many requests the response answered, updated atomically
+	hits    uint64
+	element *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key)) + e.bodySize
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value) + 4)
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.received)
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// response returns the stored response as an answer to req, or a 304 when
+// notModified is set.
+func (e *cacheEntry) response(req *http.Request, now time.Time, notModified bool) (*http.Response, error) {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	resp := &http.Response{
+		Status:     "304 Not Modified",
+		StatusCode: http.StatusNotModified,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if notModified {
+		return resp, nil
+	}
+	resp.Status = fmt.Sprintf("%d %s", e.status, http.StatusText(e.status))
+	resp.StatusCode = e.status
+	resp.ContentLength = e.bodySize
+	if e.file == "" {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(e.body))
+		return resp, nil
+	}
+	body, err := os.Open(e.file + ".body")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// cacheControl parses the directives of the Cache-Control header.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			name := strings.ToLower(kv[0])
+			directives[name] = ""
+			if len(kv) == 2 {
+				directives[name] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// seconds parses the delta-seconds value of a directive or header.
+func seconds(v string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheKey returns the key the response to req is stored with.
+func cacheKey(req *http.Request) string {
+	return urlKey(req.URL)
+}
+
+func urlKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.RequestURI()
+}
+
+// freshness returns how long a response is fresh for, from its header.
+func freshness(header http.Header, cc map[string]string) time.Duration {
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if v, ok := cc["s-maxage"]; ok {
+		lifetime, _ := seconds(v)
+		return lifetime
+	}
+	if v, ok := cc["max-age"]; ok {
+		lifetime, _ := seconds(v)
+		return lifetime
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil || at.Before(date) {
+			// invalid dates mean already expired
+			return 0
+		}
+		return at.Sub(date)
+	}
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && modified.Before(date) {
+		lifetime := date.Sub(modified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// responseAge returns how old a response received at received for a request
+// sent at sent is, from its Age and Date headers.
+func responseAge(header http.Header, sent, received time.Time) time.Duration {
+	age, _ := seconds(header.Get("Age"))
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && received.Sub(date) > age {
+		age = received.Sub(date)
+	}
+	return age + received.Sub(sent)
+}
+
+// responseCache is a shared cache of the responses to plain HTTP GET
+// requests, which evicts the least recently used ones once larger than
+// maxSize. The responses are kept in memory, or in dir when set.
+type responseCache struct {
+	maxSize       int64
+	maxObjectSize int64
+	dir           string
+	mtx           sync.Mutex
+	size          int64
+	entries       map[string]*cacheEntry
+	lru           *list.List
+	pages         *errorPages
+}
+
+func newResponseCache(maxSize, maxObjectSize int64, pages *errorPages) *responseCache {
+	return &responseCache{
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		entries:       make(map[string]*cacheEntry),
+		lru:           list.New(),
+		pages:         pages,
+	}
+}
+
+// cacheConfig reads the cache settings, and returns the cache loaded from
+// its directory, or nil when responses are not cached.
+func cacheConfig(config *viper.Viper, pages *errorPages) (*responseCache, error) {
+	size := config.GetString("cache-size")
+	if size == "" {
+		return nil, nil
+	}
+	maxSize, err := parseSize(size)
+	if err != nil {
+		return nil, err
+	}
+	maxObjectSize, err := parseSize(config.GetString("cache-max-object-size"))
+	if err != nil {
+		return nil, err
+	}
+	c := newResponseCache(int64(maxSize), int64(maxObjectSize), pages)
+	if dir := config.GetString("cache-dir"); dir != "" {
+		if err := c.load(dir); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *responseCache) lookup(req *http.Request) *cacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, ok := c.entries[cacheKey(req)]
+	if !ok {
+		return nil
+	}
+	for name, values := range entry.vary {
+		if strings.Join(req.Header[name], ", ") != strings.Join(values, ", ") {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(entry.element)
+	return entry
+}
+
+// prepare returns the stored response to answer req with, if any. Otherwise,
+// when a stale response can be revalidated, the validators of its entry are
+// added to req and the entry is returned to complete the response with.
+func (c *responseCache) prepare(req *http.Request) (*http.Response, *cacheEntry) {
+	if c == nil || (req.Method != "GET" && req.Method != "HEAD") {
+		return nil, nil
+	}
+	cc := cacheControl(req.Header)
+	if _, ok := cc["no-store"]; ok {
+		return nil, nil
+	}
+	entry := c.lookup(req)
+	if entry == nil {
+		responseCacheStats.Add("misses", 1)
+		return nil, nil
+	}
+	now := time.Now()
+	fresh := entry.age(now) < entry.lifetime
+	if _, ok := cc["no-cache"]; ok || (len(cc) == 0 && hasToken(req.Header["Pragma"], "no-cache")) {
+		fresh = false
+	}
+	if v, ok := cc["max-age"]; ok {
+		if maxAge, ok := seconds(v); !ok || entry.age(now) > maxAge {
+			fresh = false
+		}
+	}
+	if entry.revalidate {
+		fresh = false
+	}
+	if fresh {
+		etag := entry.header.Get("ETag")
+		match := req.Header.Get("If-None-Match")
+		resp, err := entry.response(req, now, etag != "" && (match == "*" || hasToken([]string{match}, etag)))
+		if err == nil {
+			responseCacheStats.Add("hits", 1)
+			atomic.AddUint64(&entry.hits, 1)
+			return resp, nil
+		}
+		warnf("dropping cache entry for %s: %v", entry.key, err)
+		c.drop(entry)
+		responseCacheStats.Add("misses", 1)
+		return nil, nil
+	}
+	responseCacheStats.Add("misses", 1)
+	conditional := req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+	if req.Method != "GET" || conditional || !entry.hasValidators() {
+		return nil, nil
+	}
+	if etag := entry.header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return nil, entry
+}
+
+// update handles the response to req, sent at sent, and returns the one to
+// relay: the stored response completed by a 304 answering its revalidation,
+// or resp itself, which is stored as it is read when cacheable.
+func (c *responseCache) update(ctx context.Context, req *http.Request, resp *http.Response, stale *cacheEntry, sent time.Time) *http.Response {
+	if c == nil || resp.StatusCode < 200 {
+		return resp
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		// unsafe methods invalidate what is stored for their URL
+		if resp.StatusCode < 400 {
+			c.remove(cacheKey(req))
+		}
+		return resp
+	}
+	now := time.Now()
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		header := stale.header.Clone()
+		for name, values := range resp.Header {
+			if name != "Content-Length" {
+				header[name] = values
+			}
+		}
+		entry := &cacheEntry{
+			key:        stale.key,
+			status:     stale.status,
+			header:     header,
+			body:       stale.body,
+			bodySize:   stale.bodySize,
+			file:       stale.file,
+			vary:       stale.vary,
+			hits:       atomic.LoadUint64(&stale.hits),
+			received:   now,
+			initialAge: responseAge(resp.Header, sent, now),
+			lifetime:   freshness(header, cacheControl(header)),
+		}
+		revalidated, err := entry.response(req, now, false)
+		if err == nil && entry.file != "" {
+			err = saveCacheMeta(entry)
+		}
+		if err != nil {
+			// the body of the stale response is gone
+			warnf("dropping cache entry for %s: %v", entry.key, err)
+			c.drop(stale)
+			return c.pages.errorResponse(ctx, req, http.StatusBadGateway, err)
+		}
+		c.add(entry)
+		responseCacheStats.Add("revalidated", 1)
+		revalidated.Close = resp.Close
+		return revalidated
+	}
+	entry := c.cacheable(req, resp, sent, now)
+	if entry == nil {
+		return resp
+	}
+	body := &cachingBody{ReadCloser: resp.Body, cache: c, entry: entry}
+	if c.dir != "" {
+		file, err := ioutil.TempFile(c.dir, "*.tmp")
+		if err != nil {
+			warnf("failed to cache %s: %v", entry.key, err)
+			return resp
+		}
+		body.file = file
+	}
+	resp.Body = body
+	return resp
+}
+
+// cacheable returns the entry to store resp in, or nil when it must not be
+// stored.
+func (c *responseCache) cacheable(req *http.Request, resp *http.Response, sent, received time.Time) *cacheEntry {
+	if req.Method != "GET" || !cacheableStatuses[resp.StatusCode] {
+		return nil
+	}
+	if resp.ContentLength > c.maxObjectSize || resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	if _, ok := cacheControl(req.Header)["no-store"]; ok {
+		return nil
+	}
+	cc := cacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, shared := cc["s-maxage"]
+		_, revalidate := cc["must-revalidate"]
+		if !public && !shared && !revalidate {
+			return nil
+		}
+	}
+	entry := &cacheEntry{
+		key:        cacheKey(req),
+		status:     resp.StatusCode,
+		header:     resp.Header.Clone(),
+		vary:       http.Header{},
+		received:   received,
+		initialAge: responseAge(resp.Header, sent, received),
+		lifetime:   freshness(resp.Header, cc),
+	}
+	for _, value := range resp.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				entry.vary[name] = req.Header[name]
+			}
+		}
+	}
+	if entry.lifetime <= 0 && !entry.hasValidators() {
+		return nil
+	}
+	return entry
+}
+
+func (c *responseCache) add(entry *cacheEntry) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if old, ok := c.entries[entry.key]; ok {
+		// a revalidated entry keeps the files of the one it replaces
+		c.dropLocked(old, old.file != entry.file)
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[entry.key] = entry
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		c.dropLocked(c.lru.Back().Value.(*cacheEntry), true)
+		responseCacheStats.Add("evicted", 1)
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		c.dropLocked(entry, true)
+	}
+}
+
+// drop removes entry, unless it was already replaced.
+func (c *responseCache) drop(entry *cacheEntry) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.entries[entry.key] == entry {
+		c.dropLocked(entry, true)
+	}
+}
+
+func (c *responseCache) dropLocked(entry *cacheEntry, removeFiles bool) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+	if removeFiles && entry.file != "" {
+		removeCacheFiles(entry.file)
+	}
+}
+
+// cachingBody stores the response of entry once its body was read to its
+// end, unless it is larger than the objects the cache accepts. The body is
+// buffered in memory, or written to file when the cache is on disk.
+type cachingBody struct {
+	io.ReadCloser
+	cache *responseCache
+	entry *cacheEntry
+	buf   bytes.Buffer
+	file  *os.File
+	// set once the body is stored, or cannot be
+	done bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+	b.entry.bodySize += int64(n)
+	if b.file != nil {
+		if _, werr := b.file.Write(p[:n]); werr != nil {
+			warnf("failed to cache %s: %v", b.entry.key, werr)
+			b.abort()
+			return n, err
+		}
+	} else {
+		b.buf.Write(p[:n])
+	}
+	switch {
+	case b.entry.bodySize > b.cache.maxObjectSize:
+		b.abort()
+	case err == io.EOF:
+		b.done = true
+		if b.file != nil {
+			if serr := b.save(); serr != nil {
+				warnf("failed to cache %s: %v", b.entry.key, serr)
+				return n, err
+			}
+		} else {
+			b.entry.body = b.buf.Bytes()
+		}
+		b.cache.add(b.entry)
+		responseCacheStats.Add("stored", 1)
+	}
+	return n, err
+}
+
+// save moves the body file in place, and writes the metadata of the entry
+// next to it.
+func (b *cachingBody) save() error {
+	tmp := b.file.Name()
+	if err := b.file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	b.entry.file = strings.TrimSuffix(tmp, ".tmp")
+	if err := os.Rename(tmp, b.entry.file+".body"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := saveCacheMeta(b.entry); err != nil {
+		removeCacheFiles(b.entry.file)
+		return err
+	}
+	return nil
+}
+
+func (b *cachingBody) abort() {
+	b.done = true
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+func (b *cachingBody) Close() error {
+	if !b.done {
+		b.abort()
+	}
+	return b.ReadCloser.Close()
+}
+
+// cacheEntryInfo describes a stored response in the admin API.
+type cacheEntryInfo struct {
+	URL      string    `json:"url"`
+	Status   int       `json:"status"`
+	Size     int64     `json:"size_bytes"`
+	Received time.Time `json:"received"`
+	Age      float64   `json:"age_seconds"`
+	Fresh    bool      `json:"fresh"`
+	Hits     uint64    `json:"hits"`
+}
+
+// cacheStats sums the activity of the cache up in the admin API.
+type cacheStats struct {
+	Entries     int     `json:"entries"`
+	Size        int64   `json:"size_bytes"`
+	MaxSize     int64   `json:"max_size_bytes"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	Revalidated int64   `json:"revalidated"`
+	Stored      int64   `json:"stored"`
+	Evicted     int64   `json:"evicted"`
+	HitRate     float64 `json:"hit_rate"`
+}
+
+// matching returns the entries whose URL matches pattern, or
+// all of them when pattern is nil, the most recently used first.
+func (c *responseCache) matching(pattern *regexp.Regexp) []*cacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entries := []*cacheEntry{}
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if pattern == nil || pattern.MatchString(entry.key) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// list describes the entries whose URL matches pattern.
+func (c *responseCache) list(pattern *regexp.Regexp) []cacheEntryInfo {
+	now := time.Now()
+	infos := []cacheEntryInfo{}
+	for _, entry := range c.matching(pattern) {
+		infos = append(infos, cacheEntryInfo{
+			URL:      entry.key,
+			Status:   entry.status,
+			Size:     entry.size(),
+			Received: entry.received,
+			Age:      entry.age(now).Seconds(),
+			Fresh:    !entry.revalidate && entry.age(now) < entry.lifetime,
+			Hits:     atomic.LoadUint64(&entry.hits),
+		})
+	}
+	return infos
+}
+
+// purge removes the entry of u when set, or the ones whose URL matches
+// pattern, and returns how many were removed.
+func (c *responseCache) purge(u *url.URL, pattern *regexp.Regexp) int {
+	if u != nil {
+		pattern = regexp.MustCompile("^" + regexp.QuoteMeta(urlKey(u)) + "$")
+	}
+	entries := c.matching(pattern)
+	for _, entry := range entries {
+		c.drop(entry)
+	}
+	return len(entries)
+}
+
+func (c *responseCache) stats() cacheStats {
+	counter := func(name string) int64 {
+		if v, ok := responseCacheStats.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	c.mtx.Lock()
+	s := cacheStats{Entries: len(c.entries), Size: c.size, MaxSize: c.maxSize}
+	c.mtx.Unlock()
+	s.Hits = counter("hits")
+	s.Misses = counter("misses")
+	s.Revalidated = counter("revalidated")
+	s.Stored = counter("stored")
+	s.Evicted = counter("evicted")
+	if s.Hits+s.Misses > 0 {
+		s.HitRate = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return s
+}
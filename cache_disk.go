@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheMeta is what is stored next to the body of a cached response.
+type cacheMeta struct {
+	Key        string        `json:"key"`
+	Status     int           `json:"status"`
+	Header     http.Header   `json:"header"`
+	Vary       http.Header   `json:"vary"`
+	Received   time.Time     `json:"received"`
+	InitialAge time.Duration `json:"initial_age"`
+	Lifetime   time.Duration `json:"lifetime"`
+	BodySize   int64         `json:"body_size"`
+}
+
+// saveCacheMeta writes the metadata file of entry, replacing the previous
+// one at once.
+func saveCacheMeta(entry *cacheEntry) error {
+	data, err := json.Marshal(cacheMeta{
+		Key:        entry.key,
+		Status:     entry.status,
+		Header:     entry.header,
+		Vary:       entry.vary,
+		Received:   entry.received,
+		InitialAge: entry.initialAge,
+		Lifetime:   entry.lifetime,
+		BodySize:   entry.bodySize,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := entry.file + ".meta.tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, entry.file+".meta")
+}
+
+// loadCacheEntry reads the entry stored in the files named after file.
+func loadCacheEntry(file string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(file + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	meta := cacheMeta{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(file + ".body")
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != meta.BodySize {
+		return nil, fmt.Errorf("body of %d bytes instead of %d", info.Size(), meta.BodySize)
+	}
+	return &cacheEntry{
+		key:        meta.Key,
+		status:     meta.Status,
+		header:     meta.Header,
+		bodySize:   meta.BodySize,
+		file:       file,
+		vary:       meta.Vary,
+		received:   meta.Received,
+		initialAge: meta.InitialAge,
+		lifetime:   meta.Lifetime,
+		revalidate: true,
+	}, nil
+}
+
+func removeCacheFiles(file string) {
+	os.Remove(file + ".meta")
+	os.Remove(file + ".body")
+}
+
+// load stores the cache in dir from now on, and loads the responses stored
+// there by previous runs. They may have changed in the meantime, and are
+// revalidated before being used.
+func (c *responseCache) load(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	entries := []*cacheEntry{}
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			// left by an interrupted write
+			os.Remove(name)
+		case strings.HasSuffix(name, ".meta"):
+			file := strings.TrimSuffix(name, ".meta")
+			entry, err := loadCacheEntry(file)
+			if err != nil {
+				warnf("dropping cache entry %s: %v", file, err)
+				removeCacheFiles(file)
+				continue
+			}
+			entries = append(entries, entry)
+		case strings.HasSuffix(name, ".body"):
+			if _, err := os.Stat(strings.TrimSuffix(name, ".body") + ".meta"); os.IsNotExist(err) {
+				os.Remove(name)
+			}
+		}
+	}
+	// the most recent entries are the last evicted
+	sort.Slice(entries, func(i, j int) bool { return entries[i].received.Before(entries[j].received) })
+	c.dir = dir
+	for _, entry := range entries {
+		c.add(entry)
+	}
+	infof("loaded %d cached responses from %s", len(c.entries), dir)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cachedResponse returns a response to req with status, header and body.
+func cachedResponse(req *http.Request, status int, header http.Header, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	tests := []struct {
+		name string
+		// the header of the request stored, of its response, and of the
+		// request looked up next
+		stored   http.Header
+		response http.Header
+		next     http.Header
+		// whether the next request is answered from the cache, or sent to
+		// be revalidated with If-None-Match
+		hit        bool
+		revalidate string
+	}{
+		{name: "fresh", response: http.Header{"Cache-Control": {"max-age=60"}}, hit: true},
+		{name: "no freshness", response: http.Header{}},
+		{name: "not stored", response: http.Header{"Cache-Control": {"max-age=60, no-store"}}},
+		{name: "private", response: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{name: "cookie", response: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}},
+		{
+			name:     "authorized",
+			stored:   http.Header{"Authorization": {"Basic YTpi"}},
+			response: http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			name:     "authorized public",
+			stored:   http.Header{"Authorization": {"Basic YTpi"}},
+			response: http.Header{"Cache-Control": {"public, max-age=60"}},
+			hit:      true,
+		},
+		{
+			name:     "same variant",
+			stored:   http.Header{"Accept-Language": {"fr"}},
+			response: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}},
+			next:     http.Header{"Accept-Language": {"fr"}},
+			hit:      true,
+		},
+		{
+			name:     "other variant",
+			stored:   http.Header{"Accept-Language": {"fr"}},
+			response: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}},
+			next:     http.Header{"Accept-Language": {"de"}},
+		},
+		{
+			name:     "no-cache from the client",
+			response: http.Header{"Cache-Control": {"max-age=60"}},
+			next:     http.Header{"Cache-Control": {"no-cache"}},
+		},
+		{
+			name:       "stale with a validator",
+			response:   http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}},
+			revalidate: `"v1"`,
+		},
+	}
+	for _, test := range tests {
+		cache := newResponseCache(1<<20, 1<<20, nil)
+		req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+		if test.stored != nil {
+			req.Header = test.stored
+		}
+		resp := cache.update(context.Background(), req, cachedResponse(req, http.StatusOK, test.response, "hello"), nil, time.Now())
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "hello" {
+			t.Errorf("%s: relayed %q", test.name, body)
+		}
+		resp.Body.Close()
+
+		next, _ := http.NewRequest("GET", "http://EXAMPLE.com/page", nil)
+		if test.next != nil {
+			next.Header = test.next
+		}
+		cached, stale := cache.prepare(next)
+		if hit := cached != nil; hit != test.hit {
+			t.Errorf("%s: answered from the cache %v, expected %v", test.name, hit, test.hit)
+		}
+		if cached != nil {
+			if body, _ := ioutil.ReadAll(cached.Body); string(body) != "hello" {
+				t.Errorf("%s: answered %q from the cache", test.name, body)
+			}
+		}
+		if match := next.Header.Get("If-None-Match"); match != test.revalidate || (stale != nil) != (test.revalidate != "") {
+			t.Errorf("%s: revalidating with %q, expected %q", test.name, match, test.revalidate)
+		}
+	}
+}
+
+func TestResponseCacheRevalidation(t *testing.T) {
+	cache := newResponseCache(1<<20, 1<<20, nil)
+	req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+	resp := cache.update(context.Background(), req, cachedResponse(req, http.StatusOK,
+		http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, "hello"), nil, time.Now())
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	next, _ := http.NewRequest("GET", "http://example.com/page", nil)
+	_, stale := cache.prepare(next)
+	if stale == nil {
+		t.Fatal("expected the stale entry to be revalidated")
+	}
+	notModified := cachedResponse(next, http.StatusNotModified, http.Header{"Cache-Control": {"max-age=60"}}, "")
+	revalidated := cache.update(context.Background(), next, notModified, stale, time.Now())
+	if revalidated.StatusCode != http.StatusOK {
+		t.Errorf("answered %d to the revalidated request, expected 200", revalidated.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(revalidated.Body); string(body) != "hello" {
+		t.Errorf("answered %q to the revalidated request", body)
+	}
+
+	// now fresh for a minute
+	last, _ := http.NewRequest("GET", "http://example.com/page", nil)
+	if cached, _ := cache.prepare(last); cached == nil {
+		t.Error("expected the revalidated response to be answered from the cache")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(1<<20, 1<<20, nil)
+	store := func(path string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		resp := cache.update(context.Background(), req, cachedResponse(req, http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 1000)), nil, time.Now())
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return req
+	}
+	a := store("/a")
+	// room for two pages of the same size
+	cache.maxSize = cache.size * 5 / 2
+	b := store("/b")
+	if cached, _ := cache.prepare(a); cached == nil {
+		t.Fatal("expected /a to be cached")
+	}
+	c := store("/c")
+	for _, test := range []struct {
+		req    *http.Request
+		cached bool
+	}{{a, true}, {b, false}, {c, true}} {
+		if _, ok := cache.entries[cacheKey(test.req)]; ok != test.cached {
+			t.Errorf("%s cached %v, expected %v", test.req.URL.Path, ok, test.cached)
+		}
+	}
+}
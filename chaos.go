@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// chaosSettings are for chaos experiments on the resilience of clients:
+// errorRate is the share of the requests failed with a 502, and resetRate
+// the share of the connections reset at some point within resetWithin.
+type chaosSettings struct {
+	errorRate   float64
+	resetRate   float64
+	resetWithin time.Duration
+}
+
+// chaosConfig reads the chaos settings.
+func chaosConfig(config *viper.Viper) chaosSettings {
+	return chaosSettings{
+		errorRate:   config.GetFloat64("chaos-error"),
+		resetRate:   config.GetFloat64("chaos-reset"),
+		resetWithin: config.GetDuration("chaos-reset-within"),
+	}
+}
+
+// chaosStage fails a share of the requests, whatever their destination.
+func (h *handler) chaosStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if h.chaos.errorRate > 0 && rand.Float64() < h.chaos.errorRate {
+		injectedFaults.Add("chaos_error", 1)
+		infof("chaos: failing %s %s with a 502", r.request.Method, r.address)
+		return nil, &statusError{status: http.StatusBadGateway, err: errors.New("fault injected by the proxy")}
+	}
+	return next(ctx, r)
+}
+
+// reset resets c, the client connection of what, at some point within
+// resetWithin for a share of the connections, by calling done: c is then
+// closed by whoever relays it, after it stopped using it. The returned
+// function cancels the reset, once the connection is over.
+func (s chaosSettings) reset(c net.Conn, what string, done func()) func() {
+	if s.resetRate <= 0 || rand.Float64() >= s.resetRate || s.resetWithin <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Duration(rand.Int63n(int64(s.resetWithin))), func() {
+		injectedFaults.Add("chaos_reset", 1)
+		infof("chaos: resetting %s", what)
+		if tcp, ok := tcpConnOf(c); ok {
+			// closing with a RST rather than a FIN
+			tcp.SetLinger(0)
+		}
+		done()
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ruleSettings are the list settings checked entry by entry, with the
+// parser of their entries.
+var ruleSettings = []struct {
+	key   string
+	parse func(string) error
+}{
+	{"auth", func(v string) error { _, err := parseUsers([]string{v}); return err }},
+	{"allowed-ports", func(v string) error { _, err := parsePorts([]string{v}); return err }},
+	{"rewrite", func(v string) error { _, err := parseRewriteRule(v); return err }},
+	{"request-header", func(v string) error { _, err := parseHeaderRule(v); return err }},
+	{"response-header", func(v string) error { _, err := parseHeaderRule(v); return err }},
+	{"follow-redirects", func(v string) error { _, err := parseRedirectRule(v); return err }},
+	{"destination-limit", func(v string) error { _, err := parseDestinationLimit(v); return err }},
+	{"fault", func(v string) error { _, err := parseFaultRule(v); return err }},
+	{"mock", func(v string) error { _, err := parseMockRule(v); return err }},
+	{"inject-banner", func(v string) error { _, err := parseBanner(v); return err }},
+	{"redact", func(v string) error { _, err := regexp.Compile(v); return err }},
+	{"webhook", checkHTTPURL},
+}
+
+// sizeSettings are the settings holding a size, like 10MB.
+var sizeSettings = []string{
+	"client-send-buffer", "client-recv-buffer", "upstream-send-buffer", "upstream-recv-buffer",
+	"cache-size", "cache-max-object-size", "icap-max-body-size", "compress-min-size",
+	"data-saver-min-size", "data-saver-max-size", "clamd-max-size", "rate-limit",
+	"memory-budget", "copy-buffer-size", "exfiltration-threshold",
+}
+
+// choiceSettings are the settings taking one of a few values.
+var choiceSettings = []struct {
+	key     string
+	choices []string
+}{
+	{"youtube-restrict", []string{"strict", "moderate"}},
+	{"forwarded-for", []string{"keep", "append", "set", "strip"}},
+	{"type-policy", []string{"allow", "deny"}},
+	{"log-level", []string{"debug", "info", "warn", "error"}},
+}
+
+func checkHTTPURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q: expected http:// or https://", v)
+	}
+	return nil
+}
+
+// settingSource tells where the value of key, or of its entry at index when
+// positive, was read from, down to the line of the config file.
+func settingSource(config *viper.Viper, key string, index int) string {
+	name := key
+	if index >= 0 {
+		name = fmt.Sprintf("%s[%d]", key, index)
+	}
+	if env := "NANOPROXY_" + strings.ToUpper(strings.Replace(key, "-", "_", -1)); os.Getenv(env) != "" {
+		return fmt.Sprintf("%s (from %s)", name, env)
+	}
+	if config.InConfig(key) {
+		return fmt.Sprintf("%s (in %s)", name, settingLocation(config.ConfigFileUsed(), key, index))
+	}
+	return "--" + name
+}
+
+// settingLocation returns the file:line where key, or its entry at index, is
+// set in the config file at path or in the ones it includes, or path itself
+// when the line can't be found.
+func settingLocation(path, key string, index int) string {
+	if isConfigURL(path) || isKVConfig(path) {
+		return path
+	}
+	parts, err := configParts(path, nil)
+	if err != nil {
+		return path
+	}
+	// the last files read override the settings of the others
+	for i := len(parts) - 1; i >= 0; i-- {
+		if line := settingLine(parts[i], key, index); line > 0 {
+			return fmt.Sprintf("%s:%d", parts[i].path, line)
+		}
+	}
+	return path
+}
+
+// settingLine returns the line of part setting key, or its entry at index
+// when positive, or 0 when not found. The settings are at the top level, and
+// the entries of lists are either on the line of their key, or one per line
+// after it.
+func settingLine(part configPart, key string, index int) int {
+	name := regexp.QuoteMeta(key)
+	var keyPattern string
+	switch part.format {
+	case "yaml", "yml":
+		keyPattern = `^["']?` + name + `["']?\s*:`
+	case "toml":
+		keyPattern = `^\s*["']?` + name + `["']?\s*=`
+	case "json":
+		keyPattern = `^\s*"` + name + `"\s*:`
+	default:
+		return 0
+	}
+	keyLine := regexp.MustCompile(keyPattern)
+	lines := strings.Split(string(part.data), "\n")
+	for n, line := range lines {
+		match := keyLine.FindStringIndex(line)
+		if match == nil {
+			continue
+		}
+		rest := strings.TrimSpace(line[match[1]:])
+		if index < 0 || (rest != "" && rest != "[") {
+			return n + 1
+		}
+		entry := 0
+		for m := n + 1; m < len(lines); m++ {
+			item := strings.TrimSpace(lines[m])
+			switch {
+			case item == "" || strings.HasPrefix(item, "#"):
+				continue
+			case rest == "" && !strings.HasPrefix(item, "-"), strings.HasPrefix(item, "]"):
+				// past the end of the list
+				return n + 1
+			}
+			if entry == index {
+				return m + 1
+			}
+			entry++
+		}
+		return n + 1
+	}
+	return 0
+}
+
+// sameListener tells whether the listen addresses a and b conflict.
+func sameListener(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+	return hostA == hostB || unspecified(hostA) || unspecified(hostB)
+}
+
+// checkSettings validates the settings of config the way the proxy would at
+// startup, and returns all the problems found, each with the setting it is
+// about.
+func checkSettings(config *viper.Viper) []error {
+	errs := []error{}
+	fail := func(key string, index int, err error) {
+		errs = append(errs, fmt.Errorf("%s: %v", settingSource(config, key, index), err))
+	}
+	for _, setting := range ruleSettings {
+		for i, v := range config.GetStringSlice(setting.key) {
+			if err := setting.parse(v); err != nil {
+				fail(setting.key, i, err)
+			}
+		}
+	}
+	for _, key := range sizeSettings {
+		if v := config.GetString(key); v != "" {
+			if _, err := parseSize(v); err != nil {
+				fail(key, -1, err)
+			}
+		}
+	}
+	for _, setting := range choiceSettings {
+		v, valid := config.GetString(setting.key), false
+		for _, choice := range setting.choices {
+			valid = valid || v == choice
+		}
+		if !valid {
+			fail(setting.key, -1, fmt.Errorf("invalid value %q: expected %s", v, strings.Join(setting.choices, ", ")))
+		}
+	}
+	for _, key := range []string{"debug-sample-rate", "chaos-error", "chaos-reset"} {
+		if v := config.GetFloat64(key); v < 0 || v > 1 {
+			fail(key, -1, fmt.Errorf("invalid share %v: expected a value between 0 and 1", v))
+		}
+	}
+	if v := config.GetString("copy-buffer-size"); v != "" {
+		if size, err := parseSize(v); err == nil && size < 1 {
+			fail("copy-buffer-size", -1, errors.New("must be at least one byte"))
+		}
+	}
+	if quality := config.GetInt("data-saver-quality"); config.GetBool("data-saver") && (quality < 1 || quality > 100) {
+		fail("data-saver-quality", -1, fmt.Errorf("invalid quality %d: expected a value between 1 and 100", quality))
+	}
+	if upstream := config.GetString("upstream"); upstream != "" {
+		if err := checkHTTPURL(upstream); err != nil {
+			fail("upstream", -1, err)
+		} else if config.GetBool("upstream-h2") && !strings.HasPrefix(upstream, "https://") {
+			fail("upstream", -1, errors.New("upstream-h2 requires an https:// upstream proxy"))
+		}
+	}
+	for _, key := range []string{"icap-reqmod", "icap-respmod"} {
+		if v := config.GetString(key); v != "" {
+			if _, err := parseICAPService(v); err != nil {
+				fail(key, -1, err)
+			}
+		}
+	}
+	if v := config.GetString("clamd"); v != "" {
+		if _, _, err := parseClamdAddress(v); err != nil {
+			fail("clamd", -1, err)
+		}
+	}
+	if path := config.GetString("error-page"); path != "" {
+		if _, err := loadErrorPage(path); err != nil {
+			fail("error-page", -1, err)
+		}
+	}
+	if path := config.GetString("script"); path != "" {
+		if _, err := loadScript(path); err != nil {
+			fail("script", -1, err)
+		}
+	}
+	if path := config.GetString("syslog-ca"); path != "" {
+		if _, err := syslogTLSConfig(path, config.GetString("syslog-server-name")); err != nil {
+			fail("syslog-ca", -1, err)
+		}
+	}
+	if path := config.GetString("config-public-key"); path != "" {
+		if _, err := loadConfigPublicKey(path); err != nil {
+			fail("config-public-key", -1, err)
+		}
+	}
+	if path := config.GetString("replay-session"); path != "" {
+		if config.GetString("record-session") != "" {
+			fail("replay-session", -1, errors.New("record-session and replay-session are mutually exclusive"))
+		} else if _, err := loadSession(path); err != nil {
+			fail("replay-session", -1, err)
+		}
+	}
+	if config.GetBool("hardened") && len(config.GetStringSlice("auth")) == 0 {
+		fail("hardened", -1, errors.New("hardened mode requires --auth"))
+	}
+	if window := config.GetDuration("exfiltration-window"); config.GetString("exfiltration-threshold") != "" && window < time.Minute {
+		fail("exfiltration-window", -1, errors.New("must be at least a minute"))
+	}
+	listeners := map[string]string{}
+	for _, key := range []string{"bind", "admin"} {
+		address := config.GetString(key)
+		if address == "" || (key == "admin" && isAdminSocket(address)) {
+			continue
+		}
+		_, port, err := net.SplitHostPort(address)
+		if err == nil {
+			if n, convErr := strconv.Atoi(port); convErr != nil || n < 0 || n > 65535 {
+				err = fmt.Errorf("invalid port %q", port)
+			}
+		}
+		if err != nil {
+			fail(key, -1, err)
+			continue
+		}
+		for other, otherAddress := range listeners {
+			if sameListener(address, otherAddress) {
+				fail(key, -1, fmt.Errorf("%s conflicts with %s %s", address, other, otherAddress))
+			}
+		}
+		listeners[key] = address
+	}
+	return errs
+}
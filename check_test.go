@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSettingLine(t *testing.T) {
+	yaml := configPart{format: "yaml", data: []byte(`bind: "0.0.0.0:8888"
+# credentials
+auth:
+  - "alice:secret"
+
+  - "bob:secret"
+allowed-ports: [80, 443]
+upstream-h2: true
+`)}
+	toml := configPart{format: "toml", data: []byte(`bind = "0.0.0.0:8888"
+auth = [
+  "alice:secret",
+  "bob:secret",
+]
+allowed-ports = [80, 443]
+`)}
+	json := configPart{format: "json", data: []byte(`{
+  "bind": "0.0.0.0:8888",
+  "auth": [
+    "alice:secret",
+    "bob:secret"
+  ]
+}
+`)}
+	tests := []struct {
+		part  configPart
+		key   string
+		index int
+		line  int
+	}{
+		{part: yaml, key: "bind", index: -1, line: 1},
+		{part: yaml, key: "auth", index: -1, line: 3},
+		{part: yaml, key: "auth", index: 0, line: 4},
+		{part: yaml, key: "auth", index: 1, line: 6},
+		{part: yaml, key: "auth", index: 2, line: 3},
+		{part: yaml, key: "allowed-ports", index: 1, line: 7},
+		{part: yaml, key: "upstream", index: -1, line: 0},
+		{part: toml, key: "auth", index: 1, line: 4},
+		{part: toml, key: "allowed-ports", index: 0, line: 6},
+		{part: json, key: "bind", index: -1, line: 2},
+		{part: json, key: "auth", index: 1, line: 5},
+		{part: configPart{format: "hcl", data: []byte(`bind = "0.0.0.0:8888"`)}, key: "bind", index: -1, line: 0},
+	}
+	for _, test := range tests {
+		if line := settingLine(test.part, test.key, test.index); line != test.line {
+			t.Errorf("settingLine(%s, %q, %d) = %d, expected %d", test.part.format, test.key, test.index, line, test.line)
+		}
+	}
+}
+
+func TestCheckFileSettings(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	tests := []struct {
+		name string
+		// the files next to the config, by name, and the settings of the
+		// config pointing to them from {dir}
+		files    map[string]string
+		settings string
+		// the problems found with the file settings
+		errors []string
+	}{
+		{
+			name:     "valid public key",
+			files:    map[string]string{"key.pem": validKey},
+			settings: "config-public-key: {dir}/key.pem\n",
+		},
+		{
+			name:     "no certificate",
+			files:    map[string]string{"ca.pem": "not a certificate"},
+			settings: "bind: \"0.0.0.0:8888\"\nsyslog-ca: {dir}/ca.pem\n",
+			errors:   []string{"syslog-ca (in config.yaml:2): ca.pem: no PEM certificate found"},
+		},
+		{
+			name:     "missing public key",
+			settings: "config-public-key: {dir}/missing.pem\n",
+			errors:   []string{"config-public-key (in config.yaml:1): open missing.pem: no such file or directory"},
+		},
+		{
+			name:     "same file for both",
+			files:    map[string]string{"ca.pem": "not a certificate"},
+			settings: "syslog-ca: {dir}/ca.pem\nconfig-public-key: {dir}/ca.pem\n",
+			errors: []string{
+				"syslog-ca (in config.yaml:1): ca.pem: no PEM certificate found",
+				"config-public-key (in config.yaml:2): ca.pem: no PEM public key found",
+			},
+		},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for name, content := range test.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		settings := strings.Replace(test.settings, "{dir}", dir, -1)
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(settings), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := viper.New()
+		config.SetConfigFile(path)
+		if err := config.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for _, err := range checkSettings(config) {
+			if msg := err.Error(); strings.HasPrefix(msg, "syslog-ca") || strings.HasPrefix(msg, "config-public-key") {
+				found = append(found, strings.Replace(msg, dir+"/", "", -1))
+			}
+		}
+		if strings.Join(found, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("%s: found %q, expected %q", test.name, found, test.errors)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var antivirusStats = expvar.NewMap("antivirus")
+
+// clamdScanner has the bodies of plain HTTP responses scanned by clamd, and
+// replaces the infected ones with a block page.
+type clamdScanner struct {
+	network string
+	address string
+	// larger bodies are not scanned
+	maxSize int64
+	timeout time.Duration
+	pages   *errorPages
+}
+
+// clamdConfig reads the clamd settings, and returns nil when the bodies are
+// not scanned.
+func clamdConfig(config *viper.Viper, pages *errorPages) (*clamdScanner, error) {
+	address := config.GetString("clamd")
+	if address == "" {
+		return nil, nil
+	}
+	maxSize, err := parseSize(config.GetString("clamd-max-size"))
+	if err != nil {
+		return nil, err
+	}
+	s := &clamdScanner{maxSize: int64(maxSize), timeout: config.GetDuration("clamd-timeout"), pages: pages}
+	if s.network, s.address, err = parseClamdAddress(address); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseClamdAddress parses the address of clamd, a unix socket path like
+// /run/clamav/clamd.ctl or a TCP address like localhost:3310.
+func parseClamdAddress(v string) (network, address string, err error) {
+	if strings.HasPrefix(v, "/") {
+		return "unix", v, nil
+	}
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		return "", "", fmt.Errorf("invalid clamd address %q: expected a socket path or host:port", v)
+	}
+	return "tcp", v, nil
+}
+
+// scan sends data to clamd, and returns the name of the virus it found, if
+// any.
+func (s *clamdScanner) scan(ctx context.Context, data []byte) (string, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	out := bufio.NewWriter(conn)
+	out.WriteString("zINSTREAM\x00")
+	// the chunks are prefixed with their size, the stream ends with an
+	// empty one
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	out.Write(size)
+	out.Write(data)
+	out.Write([]byte{0, 0, 0, 0})
+	if err := out.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// check scans the body of resp, answering req, and returns the response to
+// relay in its place.
+func (s *clamdScanner) check(ctx context.Context, req *http.Request, resp *http.Response) (*http.Response, error) {
+	if s == nil {
+		return resp, nil
+	}
+	body, readBack, ok, err := readBody(resp.Body, s.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = readBack
+	if !ok {
+		antivirusStats.Add("skipped", 1)
+		return resp, nil
+	}
+	if len(body) == 0 {
+		return resp, nil
+	}
+	antivirusStats.Add("scanned", 1)
+	virus, err := s.scan(ctx, body)
+	if err != nil {
+		antivirusStats.Add("errors", 1)
+		return nil, err
+	}
+	if virus == "" {
+		return resp, nil
+	}
+	antivirusStats.Add("infected", 1)
+	warnf("%s is infected by %s, blocked", req.URL, virus)
+	return s.pages.blockPage(ctx, req, resp.Close, "Download blocked", fmt.Sprintf("%s is infected by %s.", req.URL, virus)), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/spf13/viper"
+)
+
+// compression compresses the responses whose length is unknown or at least
+// minSize.
+type compression struct {
+	minSize int64
+}
+
+// compressionConfig reads the compression settings, and returns nil when
+// the responses are not compressed.
+func compressionConfig(config *viper.Viper) (*compression, error) {
+	if !config.GetBool("compress") {
+		return nil, nil
+	}
+	size, err := parseSize(config.GetString("compress-min-size"))
+	if err != nil {
+		return nil, err
+	}
+	return &compression{minSize: int64(size)}, nil
+}
+
+// acceptedEncoding returns the content coding to compress the responses of
+// the client sending header with, the one preferred by the proxy among those
+// it accepts, or "" for none.
+func acceptedEncoding(header http.Header) string {
+	accepted := map[string]bool{}
+	for _, value := range header["Accept-Encoding"] {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			accepted[coding] = true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+						accepted[coding] = false
+					}
+				}
+			}
+		}
+	}
+	for _, coding := range []string{"br", "gzip"} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compressible tells whether the body of resp gains from being compressed.
+func compressible(resp *http.Response) bool {
+	t := mediaType(resp)
+	switch {
+	case t == "text/event-stream":
+		// the events would be held until enough of them are compressed
+		return false
+	case strings.HasPrefix(t, "text/"), strings.Contains(t, "json"), strings.Contains(t, "xml"),
+		strings.Contains(t, "javascript"), t == "image/svg+xml", t == "application/wasm":
+		return true
+	}
+	return false
+}
+
+// compressBody compresses the body of resp, answering req, when its origin
+// did not and the client accepts it.
+func (c *compression) compressBody(req *http.Request, resp *http.Response) {
+	if c == nil || req.Method == "HEAD" || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" ||
+		!compressible(resp) || (resp.ContentLength >= 0 && resp.ContentLength < c.minSize) {
+		return
+	}
+	for _, value := range resp.Header["Cache-Control"] {
+		if strings.Contains(strings.ToLower(value), "no-transform") {
+			return
+		}
+	}
+	coding := acceptedEncoding(req.Header)
+	if coding == "" {
+		return
+	}
+	body, compressed := io.Pipe()
+	go func(src io.Reader) {
+		var w io.WriteCloser
+		if coding == "br" {
+			w = brotli.NewWriterLevel(compressed, 4)
+		} else {
+			w = gzip.NewWriter(compressed)
+		}
+		_, err := io.Copy(w, src)
+		if err == nil {
+			err = w.Close()
+		}
+		compressed.CloseWithError(err)
+	}(resp.Body)
+	resp.Body = &compressingBody{PipeReader: body, src: resp.Body}
+	resp.Header.Set("Content-Encoding", coding)
+	if !strings.Contains(strings.ToLower(strings.Join(resp.Header["Vary"], ",")), "accept-encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed representation is not byte for byte the one the
+		// origin tagged
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressingBody reads the body compressed by a goroutine.
+type compressingBody struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (b *compressingBody) Close() error {
+	// stops the goroutine, blocked on its next write
+	b.PipeReader.Close()
+	return b.src.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// newConfig returns an empty config, whose settings can be set by
+// environment variables like NANOPROXY_UPSTREAM.
+func newConfig() *viper.Viper {
+	config := viper.New()
+	config.SetEnvPrefix("NANOPROXY")
+	config.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	config.AutomaticEnv()
+	return config
+}
+
+// readConfigFile reads the settings of the file at path, at a URL or in a KV
+// store, into config, under the names of the flags of cmd, which like the environment
+// take precedence over them. Its format, YAML, TOML or JSON, is told by its
+// extension.
+func readConfigFile(config *viper.Viper, cmd *cobra.Command, path string) error {
+	config.SetConfigFile(path)
+	var err error
+	switch {
+	case isConfigURL(path):
+		err = readRemoteConfig(config, path)
+	case isKVConfig(path):
+		err = readKVConfig(config, path)
+	default:
+		var parts []configPart
+		if parts, err = configParts(path, nil); err == nil {
+			err = readConfigParts(config, parts)
+		}
+	}
+	if err == errConfigUnchanged {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	for _, key := range config.AllKeys() {
+		if !config.InConfig(key) || key == "include" {
+			continue
+		}
+		if cmd.Flags().Lookup(key) == nil && cmd.InheritedFlags().Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %q in %s", key, path)
+		}
+	}
+	return nil
+}
+
+// configVariable matches the references to environment variables in config
+// files, like ${PROXY_PASSWORD}.
+var configVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandConfigVariables replaces the references to environment variables of
+// data with their value.
+func expandConfigVariables(data []byte) ([]byte, error) {
+	var err error
+	expanded := configVariable.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(configVariable.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(value)
+	})
+	return expanded, err
+}
+
+// configPart is the content of a config file, in format.
+type configPart struct {
+	// empty when not read from a local file
+	path   string
+	format string
+	data   []byte
+}
+
+// configIncludes returns the files part includes.
+func configIncludes(part configPart) ([]string, error) {
+	v := viper.New()
+	v.SetConfigType(part.format)
+	if err := v.ReadConfig(bytes.NewReader(part.data)); err != nil {
+		return nil, err
+	}
+	return v.GetStringSlice("include"), nil
+}
+
+// configParts returns the content of the config file at path, after the
+// ones of the files it includes, relative to its directory, and so on.
+// including holds the files including it, to detect loops.
+func configParts(path string, including []string) ([]configPart, error) {
+	for _, parent := range including {
+		if parent == path {
+			return nil, fmt.Errorf("include loop: %s", strings.Join(append(including, path), " -> "))
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	part := configPart{path: path, format: strings.TrimPrefix(filepath.Ext(path), ".")}
+	supported := false
+	for _, ext := range viper.SupportedExts {
+		supported = supported || ext == part.format
+	}
+	if !supported {
+		return nil, fmt.Errorf("%s: unsupported config format %q", path, part.format)
+	}
+	if part.data, err = expandConfigVariables(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	includes, err := configIncludes(part)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	parts := []configPart{}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := configParts(include, append(including, path))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, included...)
+	}
+	return append(parts, part), nil
+}
+
+// readConfigParts reads parts into config, each overriding the settings of
+// the ones before.
+func readConfigParts(config *viper.Viper, parts []configPart) error {
+	for i, part := range parts {
+		config.SetConfigType(part.format)
+		read := config.MergeConfig
+		if i == 0 {
+			read = config.ReadConfig
+		}
+		if err := read(bytes.NewReader(part.data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readConfigData reads the config fetched from a URL or a KV store into
+// config. Its references to environment variables are expanded, but it
+// cannot include files.
+func readConfigData(config *viper.Viper, format string, data []byte) error {
+	part := configPart{format: format}
+	var err error
+	if part.data, err = expandConfigVariables(data); err != nil {
+		return err
+	}
+	if includes, err := configIncludes(part); err != nil {
+		return err
+	} else if len(includes) > 0 {
+		return fmt.Errorf("cannot include %s: only local config files can include others", strings.Join(includes, ", "))
+	}
+	return readConfigParts(config, []configPart{part})
+}
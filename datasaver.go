@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var dataSaverStats = expvar.NewMap("data_saver")
+
+// maxImagePixels bounds the images decoded, whose pixels take much more
+// memory than their compressed body.
+const maxImagePixels = 40 << 20
+
+// dataSaver re-encodes the large JPEG and PNG images of plain HTTP
+// responses smaller, shrinking them to fit maxDimension, and lowering the
+// quality of the JPEG ones.
+type dataSaver struct {
+	// images smaller than minSize or larger than maxSize are left alone
+	minSize      int64
+	maxSize      int64
+	quality      int
+	maxDimension int
+}
+
+// dataSaverConfig reads the data saver settings, and returns nil when the
+// images are left alone.
+func dataSaverConfig(config *viper.Viper) (*dataSaver, error) {
+	if !config.GetBool("data-saver") {
+		return nil, nil
+	}
+	minSize, err := parseSize(config.GetString("data-saver-min-size"))
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := parseSize(config.GetString("data-saver-max-size"))
+	if err != nil {
+		return nil, err
+	}
+	return &dataSaver{
+		minSize:      int64(minSize),
+		maxSize:      int64(maxSize),
+		quality:      config.GetInt("data-saver-quality"),
+		maxDimension: config.GetInt("data-saver-max-dimension"),
+	}, nil
+}
+
+// shrink returns resp, answering req, with its image re-encoded when it gets
+// smaller.
+func (s *dataSaver) shrink(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if s == nil || req.Method == "HEAD" || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Encoding") != "" || (resp.ContentLength >= 0 && resp.ContentLength < s.minSize) {
+		return resp, nil
+	}
+	format := mediaType(resp)
+	if format != "image/jpeg" && format != "image/png" {
+		return resp, nil
+	}
+	for _, value := range resp.Header["Cache-Control"] {
+		if strings.Contains(strings.ToLower(value), "no-transform") {
+			return resp, nil
+		}
+	}
+	body, readBack, ok, err := readBody(resp.Body, s.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = readBack
+	if !ok || int64(len(body)) < s.minSize {
+		return resp, nil
+	}
+	smaller := s.encode(format, body)
+	if smaller == nil {
+		return resp, nil
+	}
+	dataSaverStats.Add("images", 1)
+	dataSaverStats.Add("saved_bytes", int64(len(body)-len(smaller)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(smaller))
+	resp.ContentLength = int64(len(smaller))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(smaller)))
+	resp.Header.Add("Warning", `214 nanoproxy "Transformation Applied"`)
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return resp, nil
+}
+
+// encode returns the image of body re-encoded, or nil when it could not be
+// made smaller.
+func (s *dataSaver) encode(format string, body []byte) []byte {
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil || config.Width*config.Height > maxImagePixels {
+		return nil
+	}
+	var img image.Image
+	if format == "image/jpeg" {
+		img, err = jpeg.Decode(bytes.NewReader(body))
+	} else {
+		img, err = png.Decode(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil
+	}
+	img = s.fit(img)
+	out := &bytes.Buffer{}
+	if format == "image/jpeg" {
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: s.quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(out, img)
+	}
+	if err != nil || out.Len() >= len(body) {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// fit shrinks img to fit in a square of maxDimension pixels, averaging the
+// pixels of the source covered by each pixel of the result.
+func (s *dataSaver) fit(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if s.maxDimension <= 0 || (w <= s.maxDimension && h <= s.maxDimension) {
+		return img
+	}
+	dw, dh := s.maxDimension, h*s.maxDimension/w
+	if h > w {
+		dw, dh = w*s.maxDimension/h, s.maxDimension
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r, g, b, a = r+uint64(c.R), g+uint64(c.G), b+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
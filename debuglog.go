@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// debugLog logs the headers of sampleRate of the requests, along with the
+// ones matching routes, and of their responses.
+type debugLog struct {
+	sampleRate float64
+	routes     []route
+	redaction  *logRedaction
+}
+
+// debugConfig reads the requests to debug, and returns nil when there are
+// none.
+func debugConfig(config *viper.Viper, redaction *logRedaction) *debugLog {
+	d := &debugLog{sampleRate: config.GetFloat64("debug-sample-rate"), redaction: redaction}
+	for _, v := range config.GetStringSlice("debug-route") {
+		d.routes = append(d.routes, parseRoute(v))
+	}
+	if d.sampleRate <= 0 && len(d.routes) == 0 {
+		return nil
+	}
+	return d
+}
+
+// debugged tells whether the headers of req, the request of ctx, are to be
+// logged. The requests are sampled by their ID, so that the decision holds
+// for their response.
+func (d *debugLog) debugged(ctx context.Context, req *http.Request) bool {
+	if d == nil {
+		return false
+	}
+	host, path := req.URL.Host, req.URL.RequestURI()
+	if req.Method == "CONNECT" {
+		host, path = req.Host, ""
+	}
+	for _, r := range d.routes {
+		if r.matches(host, path) {
+			return true
+		}
+	}
+	if d.sampleRate <= 0 {
+		return false
+	}
+	id, err := hex.DecodeString(requestID(ctx))
+	if err != nil || len(id) < 4 {
+		return false
+	}
+	sample := uint32(id[0])<<24 | uint32(id[1])<<16 | uint32(id[2])<<8 | uint32(id[3])
+	return float64(sample) < d.sampleRate*(1<<32)
+}
+
+// writeDebugHeader writes header to b, one field per line after prefix, in
+// a stable order and with its sensitive values redacted.
+func (d *debugLog) writeDebugHeader(b *strings.Builder, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(b, "\n%s %s: %s", prefix, name, d.redaction.redactHeaderValue(name, value))
+		}
+	}
+}
+
+// debugStage logs the header of the debugged requests, as received.
+func (h *handler) debugStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if req := r.request; h.debug.debugged(ctx, req) {
+		b := &strings.Builder{}
+		fmt.Fprintf(b, "debug %s: request", requestID(ctx))
+		if client, ok := ctx.Value(clientKey{}).(net.Addr); ok {
+			fmt.Fprintf(b, " from %s", client)
+		}
+		fmt.Fprintf(b, "\n> %s %s %s", req.Method, req.RequestURI, req.Proto)
+		if req.Host != "" {
+			fmt.Fprintf(b, "\n> Host: %s", req.Host)
+		}
+		h.debug.writeDebugHeader(b, ">", req.Header)
+		log.Print(b.String())
+	}
+	return next(ctx, r)
+}
+
+// logDebugResponse logs the header of resp, the response to req, the request
+// of ctx, as received, if it is debugged.
+func (d *debugLog) logDebugResponse(ctx context.Context, req *http.Request, resp *http.Response) {
+	if !d.debugged(ctx, req) {
+		return
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "debug %s: response from %s", requestID(ctx), req.URL.Host)
+	fmt.Fprintf(b, "\n< %s %s", resp.Proto, resp.Status)
+	d.writeDebugHeader(b, "<", resp.Header)
+	log.Print(b.String())
+}
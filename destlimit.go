@@ -0,0 +1,89 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var throttledConns = expvar.NewMap("throttled_connections")
+
+// destinationLimit restricts the connections toward a domain: how many can be
+// opened per second, and the bandwidth they share. When hours are set, the
+// limit only applies to the connections opened between those hours.
+type destinationLimit struct {
+	domain    string
+	conns     *tokenBucket
+	upload    *tokenBucket
+	download  *tokenBucket
+	fromHour  int
+	untilHour int
+}
+
+// parseDestinationLimit parses rules like
+// "backup.example.net:conns=5:rate=1MB:hours=9-18".
+func parseDestinationLimit(v string) (*destinationLimit, error) {
+	tokens := strings.Split(v, ":")
+	if len(tokens) < 2 || tokens[0] == "" {
+		return nil, fmt.Errorf("invalid destination limit %q: expected domain:key=value:...", v)
+	}
+	l := &destinationLimit{domain: strings.ToLower(tokens[0]), fromHour: -1}
+	for _, option := range tokens[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid destination limit option %q", option)
+		}
+		switch kv[0] {
+		case "conns":
+			n, err := strconv.ParseFloat(strings.TrimSuffix(kv[1], "/s"), 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid connection rate %q", kv[1])
+			}
+			l.conns = newTokenBucket(n, n)
+		case "rate":
+			rate, err := parseSize(strings.TrimSuffix(kv[1], "/s"))
+			if err != nil {
+				return nil, err
+			}
+			l.upload = newBandwidthBucket(rate)
+			l.download = newBandwidthBucket(rate)
+		case "hours":
+			_, err := fmt.Sscanf(kv[1], "%d-%d", &l.fromHour, &l.untilHour)
+			if err != nil || l.fromHour < 0 || l.fromHour > 23 || l.untilHour < 0 || l.untilHour > 24 {
+				return nil, fmt.Errorf("invalid hours %q: expected from-until, like 9-18", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown destination limit option %q", kv[0])
+		}
+	}
+	return l, nil
+}
+
+func (l *destinationLimit) matches(host string, now time.Time) bool {
+	host = strings.ToLower(hostname(host))
+	if host != l.domain && !strings.HasSuffix(host, "."+l.domain) {
+		return false
+	}
+	if l.fromHour == -1 {
+		return true
+	}
+	hour := now.Hour()
+	if l.fromHour <= l.untilHour {
+		return hour >= l.fromHour && hour < l.untilHour
+	}
+	// ranges like 22-6 span midnight
+	return hour >= l.fromHour || hour < l.untilHour
+}
+
+// findDestinationLimit returns the first limit applying to host, if any.
+func findDestinationLimit(limits []*destinationLimit, host string) *destinationLimit {
+	now := time.Now()
+	for _, l := range limits {
+		if l.matches(host, now) {
+			return l
+		}
+	}
+	return nil
+}
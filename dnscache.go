@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// entries used this many times during their lifetime are refreshed before
+// they expire
+const dnsPrefetchMinHits = 2
+
+var dnsCacheStats = expvar.NewMap("dns_cache")
+
+type dnsEntry struct {
+	addrs      []string
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+// dnsCache resolves hostnames through a cache, and refreshes the entries of
+// popular hostnames shortly before they expire, so that their destinations
+// don't wait on DNS. The system resolver does not tell record TTLs, so
+// entries live for a fixed duration.
+type dnsCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	mtx      sync.Mutex
+	entries  map[string]*dnsEntry
+}
+
+func runDNSCache(resolver *net.Resolver, ttl time.Duration) *dnsCache {
+	c := &dnsCache{resolver: resolver, ttl: ttl, entries: make(map[string]*dnsEntry)}
+	go c.run()
+	return c
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mtx.Lock()
+	entry, ok := c.entries[host]
+	if ok && time.Now().Before(entry.expires) {
+		entry.hits++
+		addrs := entry.addrs
+		c.mtx.Unlock()
+		dnsCacheStats.Add("hits", 1)
+		return addrs, nil
+	}
+	c.mtx.Unlock()
+	dnsCacheStats.Add("misses", 1)
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl), hits: 1}
+	c.mtx.Unlock()
+	return addrs, nil
+}
+
+// run refreshes the popular entries during the last fifth of their
+// lifetime, and forgets the expired ones.
+func (c *dnsCache) run() {
+	ticker := time.NewTicker(c.ttl / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		c.mtx.Lock()
+		for host, entry := range c.entries {
+			switch {
+			case now.After(entry.expires):
+				delete(c.entries, host)
+			case !entry.refreshing && entry.hits >= dnsPrefetchMinHits && entry.expires.Sub(now) < c.ttl/5:
+				entry.refreshing = true
+				go c.refresh(host)
+			}
+		}
+		c.mtx.Unlock()
+	}
+}
+
+func (c *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ttl/5)
+	defer cancel()
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, ok := c.entries[host]
+	if !ok {
+		return
+	}
+	entry.refreshing = false
+	if err != nil {
+		return
+	}
+	dnsCacheStats.Add("prefetches", 1)
+	// the hits of the next lifetime decide whether it gets refreshed again
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+)
+
+// dumpState logs the active connections, the core counters and the stack of
+// every goroutine.
+func dumpState(events chan event) {
+	log.Printf("state dump: %d goroutines, %d accepted, %d active, %d resolver errors, %s up, %s down",
+		runtime.NumGoroutine(), acceptedConns.Value(), activeConns.Value(), resolverErrors.Value(),
+		humanBytes(uint64(uploadedBytes.Value())), humanBytes(uint64(downloadedBytes.Value())))
+	inspect(events, func(s *stats) {
+		for _, conn := range s.conn {
+			counters := conn.snapshot()
+			log.Printf("state dump: %s %s %s%s, age %s, %s up, %s down",
+				conn.conn.RemoteAddr(), conn.remote.method, conn.remote.host, conn.remote.path,
+				humanDuration(time.Since(conn.startedAt)), humanBytes(counters.readBytes), humanBytes(counters.writtenBytes))
+		}
+	})
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	log.Printf("state dump: goroutines:\n%s", buf)
+}
+
+// dumpOnSignal dumps the proxy state each time the dump signal is received.
+func dumpOnSignal(events chan event) {
+	if dumpSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, dumpSignal)
+	go func() {
+		for range ch {
+			dumpState(events)
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// errorPages renders the pages answering the requests the proxy denied or
+// failed to serve: page, when set, renders them in HTML, and contact is the
+// contact info they give. Without errorPages, they are plain text.
+type errorPages struct {
+	page    *template.Template
+	contact string
+}
+
+// errorPagesConfig reads the error page settings, and returns nil when
+// there are none.
+func errorPagesConfig(config *viper.Viper) (*errorPages, error) {
+	p := &errorPages{contact: config.GetString("error-contact")}
+	if path := config.GetString("error-page"); path != "" {
+		var err error
+		if p.page, err = loadErrorPage(path); err != nil {
+			return nil, err
+		}
+	}
+	if p.page == nil && p.contact == "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// defaultBlockPage renders the block pages without an error page.
+var defaultBlockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Title}}</title></head><body>
+<h1>{{.Title}}</h1>
+<p>{{.Reason}}</p>
+{{if .Contact}}<p>Contact: {{.Contact}}</p>
+{{end}}{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>
+{{end}}</body></html>
+`))
+
+// errorPageData is what the error page templates are rendered with.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Title      string
+	Reason     string
+	Contact    string
+	RequestID  string
+}
+
+// loadErrorPage parses the error page template at path.
+func loadErrorPage(path string) (*template.Template, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(path).Parse(string(source))
+	if err != nil {
+		return nil, fmt.Errorf("invalid error page %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// renderPage renders t for a response with status, titled title, to the
+// request of ctx, and returns nil when it fails.
+func (p *errorPages) renderPage(ctx context.Context, t *template.Template, status int, title, reason string) []byte {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Title:      title,
+		Reason:     reason,
+		RequestID:  requestID(ctx),
+	}
+	if p != nil {
+		data.Contact = p.contact
+	}
+	page := &bytes.Buffer{}
+	err := t.Execute(page, data)
+	if err != nil {
+		warnf("failed to render the error page: %v", err)
+		return nil
+	}
+	return page.Bytes()
+}
+
+// errorBody returns the body answering the request of ctx, that failed with
+// status for reason, and its content type: the error page when there is
+// one, plain text otherwise.
+func (p *errorPages) errorBody(ctx context.Context, status int, reason string) (string, string) {
+	if p != nil && p.page != nil {
+		if page := p.renderPage(ctx, p.page, status, http.StatusText(status), reason); page != nil {
+			return string(page), "text/html; charset=utf-8"
+		}
+	}
+	body := fmt.Sprintf("%d %s: %s\n", status, http.StatusText(status), reason)
+	if id := requestID(ctx); id != "" {
+		body += fmt.Sprintf("Request ID: %s\n", id)
+	}
+	return body, "text/plain; charset=utf-8"
+}
+
+// blockPage returns the 403 page answering req, the request of ctx, in
+// place of a blocked response, explaining why with reason.
+func (p *errorPages) blockPage(ctx context.Context, req *http.Request, close bool, title, reason string) *http.Response {
+	t := defaultBlockPage
+	if p != nil && p.page != nil {
+		t = p.page
+	}
+	page := p.renderPage(ctx, t, http.StatusForbidden, title, reason)
+	if page == nil {
+		page = p.renderPage(ctx, defaultBlockPage, http.StatusForbidden, title, reason)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusForbidden, http.StatusText(http.StatusForbidden)),
+		StatusCode:    http.StatusForbidden,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Cache-Control": {"no-store"}},
+		Body:          ioutil.NopCloser(strings.NewReader(string(page))),
+		ContentLength: int64(len(page)),
+		Close:         close,
+		Request:       req,
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// loopSide is one of the two connections of a tunnel relayed by an event
+// loop.
+type loopSide struct {
+	// a duplicate of the descriptor of conn, owned by the loop until the
+	// tunnel is finished, so that closing conn meanwhile can't hand its
+	// number over to another connection
+	fd      int
+	conn    *net.TCPConn
+	account spliceable
+	// bytes read from the other side, not written to this one yet
+	pending []byte
+	// set once this side sent its last byte, and once it was half-closed
+	eof  bool
+	shut bool
+	mask uint32
+}
+
+type loopTunnel struct {
+	sides    [2]*loopSide
+	halfOnce sync.Once
+	halfDone chan struct{}
+	done     chan error
+	finished bool
+}
+
+// eventLoop relays tunnels between plain TCP connections from a single
+// goroutine waiting on epoll, so that mostly idle tunnels cost neither
+// goroutines nor buffers.
+type eventLoop struct {
+	epfd    int
+	mtx     sync.Mutex
+	tunnels map[int]*loopTunnel
+	buf     []byte
+}
+
+type eventLoops struct {
+	loops []*eventLoop
+	next  uint32
+}
+
+func newEventLoops(count, bufferSize int) (*eventLoops, error) {
+	l := &eventLoops{}
+	for i := 0; i < count; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		loop := &eventLoop{epfd: epfd, tunnels: make(map[int]*loopTunnel), buf: make([]byte, bufferSize)}
+		go loop.run()
+		l.loops = append(l.loops, loop)
+	}
+	return l, nil
+}
+
+// dupFd returns a duplicate of the file descriptor of conn, which the
+// caller closes. The descriptor of conn itself is only valid within
+// raw.Control.
+func dupFd(conn *net.TCPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	var dupErr error
+	err = raw.Control(func(f uintptr) {
+		fd, dupErr = syscall.Dup(int(f))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseOnExec(fd)
+	return fd, nil
+}
+
+// relay relays client and upstream on an event loop, until both directions
+// ended like bidirectionalPipe does, and tells whether it could: both must
+// be plain TCP connections.
+func (l *eventLoops) relay(ctx context.Context, client, upstream io.ReadWriter, linger time.Duration) bool {
+	clientTCP, clientAccount := unwrapTCP(client)
+	upstreamTCP, upstreamAccount := unwrapTCP(upstream)
+	if clientTCP == nil || upstreamTCP == nil {
+		return false
+	}
+	tunnel := &loopTunnel{halfDone: make(chan struct{}), done: make(chan error, 1)}
+	for idx, conn := range []*net.TCPConn{clientTCP, upstreamTCP} {
+		fd, err := dupFd(conn)
+		if err != nil {
+			if idx > 0 {
+				syscall.Close(tunnel.sides[0].fd)
+			}
+			return false
+		}
+		tunnel.sides[idx] = &loopSide{fd: fd, conn: conn}
+	}
+	tunnel.sides[0].account = clientAccount
+	tunnel.sides[1].account = upstreamAccount
+	loop := l.loops[atomic.AddUint32(&l.next, 1)%uint32(len(l.loops))]
+	if err := loop.add(tunnel); err != nil {
+		return false
+	}
+	var lingering <-chan time.Time
+	halfDone := tunnel.halfDone
+wait:
+	for {
+		select {
+		case <-tunnel.done:
+			break wait
+		case <-halfDone:
+			halfDone = nil
+			if linger < 0 {
+				loop.remove(tunnel)
+			} else if linger > 0 {
+				timer := time.NewTimer(linger)
+				defer timer.Stop()
+				lingering = timer.C
+			}
+		case <-lingering:
+			loop.remove(tunnel)
+		case <-ctx.Done():
+			loop.remove(tunnel)
+		}
+	}
+	for _, conn := range []io.ReadWriter{client, upstream} {
+		if closer, ok := conn.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return true
+}
+
+func (l *eventLoop) add(tunnel *loopTunnel) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, side := range tunnel.sides {
+		l.tunnels[side.fd] = tunnel
+	}
+	if err := l.watch(tunnel); err != nil {
+		l.finish(tunnel, err)
+		<-tunnel.done
+		return err
+	}
+	return nil
+}
+
+func (l *eventLoop) remove(tunnel *loopTunnel) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.finish(tunnel, nil)
+}
+
+// finish stops watching the connections of tunnel, and closes the
+// duplicated descriptors: the connections can then be closed.
+func (l *eventLoop) finish(tunnel *loopTunnel, err error) {
+	if tunnel.finished {
+		return
+	}
+	tunnel.finished = true
+	for _, side := range tunnel.sides {
+		if side.mask != 0 {
+			syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, side.fd, nil)
+		}
+		delete(l.tunnels, side.fd)
+		syscall.Close(side.fd)
+	}
+	tunnel.done <- err
+}
+
+// watch updates the events waited for on each side of tunnel: reading while
+// the other side is not lagging behind, and writing while bytes are
+// pending. Sides with nothing left to wait for are unregistered, so that
+// their hang-ups don't wake the loop up forever.
+func (l *eventLoop) watch(tunnel *loopTunnel) error {
+	for idx, side := range tunnel.sides {
+		peer := tunnel.sides[1-idx]
+		var mask uint32
+		if !side.eof && len(peer.pending) == 0 {
+			mask |= syscall.EPOLLIN
+		}
+		if len(side.pending) > 0 {
+			mask |= syscall.EPOLLOUT
+		}
+		if mask == side.mask {
+			continue
+		}
+		op := syscall.EPOLL_CTL_MOD
+		switch {
+		case side.mask == 0:
+			op = syscall.EPOLL_CTL_ADD
+		case mask == 0:
+			op = syscall.EPOLL_CTL_DEL
+		}
+		err := syscall.EpollCtl(l.epfd, op, side.fd, &syscall.EpollEvent{Events: mask, Fd: int32(side.fd)})
+		if err != nil {
+			return err
+		}
+		side.mask = mask
+	}
+	return nil
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			warnf("event loop: failed to wait for events: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		l.mtx.Lock()
+		for _, event := range events[:n] {
+			tunnel, ok := l.tunnels[int(event.Fd)]
+			if !ok || tunnel.finished {
+				continue
+			}
+			idx := 0
+			if tunnel.sides[1].fd == int(event.Fd) {
+				idx = 1
+			}
+			if err := l.handle(tunnel, idx, event.Events); err != nil {
+				l.finish(tunnel, err)
+			}
+		}
+		l.mtx.Unlock()
+	}
+}
+
+// flush writes the pending bytes of side, as much as it accepts.
+func flush(side *loopSide) error {
+	for len(side.pending) > 0 {
+		n, err := syscall.Write(side.fd, side.pending)
+		if n > 0 {
+			if side.account != nil {
+				side.account.accountWrite(int64(n))
+			}
+			side.pending = side.pending[n:]
+		}
+		if err == syscall.EAGAIN {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *eventLoop) handle(tunnel *loopTunnel, idx int, events uint32) error {
+	side, peer := tunnel.sides[idx], tunnel.sides[1-idx]
+	if events&syscall.EPOLLOUT != 0 {
+		if err := flush(side); err != nil {
+			return err
+		}
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && !side.eof && len(peer.pending) == 0 {
+		n, err := syscall.Read(side.fd, l.buf)
+		switch {
+		case err == syscall.EAGAIN:
+		case err != nil:
+			return err
+		case n == 0:
+			side.eof = true
+		default:
+			if side.account != nil {
+				side.account.accountRead(int64(n))
+			}
+			peer.pending = l.buf[:n]
+			if err := flush(peer); err != nil {
+				return err
+			}
+			// the loop buffer is reused by the next read
+			peer.pending = append([]byte(nil), peer.pending...)
+		}
+	} else if events&syscall.EPOLLERR != 0 {
+		return errors.New("socket error")
+	}
+	// propagate the end of each direction once its bytes are written
+	for i, src := range tunnel.sides {
+		dst := tunnel.sides[1-i]
+		if src.eof && len(dst.pending) == 0 && !dst.shut {
+			if err := syscall.Shutdown(dst.fd, syscall.SHUT_WR); err != nil {
+				return err
+			}
+			dst.shut = true
+			tunnel.halfOnce.Do(func() {
+				close(tunnel.halfDone)
+			})
+		}
+	}
+	if tunnel.sides[0].shut && tunnel.sides[1].shut {
+		l.finish(tunnel, nil)
+		return nil
+	}
+	return l.watch(tunnel)
+}
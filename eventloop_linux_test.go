@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestEventLoopRelay(t *testing.T) {
+	tests := []struct {
+		name string
+		// what the client and the upstream server do once the tunnel is
+		// relayed, and how the tunnel is then stopped
+		client   func(*net.TCPConn)
+		upstream func(*net.TCPConn)
+		stop     func(relayed *net.TCPConn, cancel context.CancelFunc)
+		// what each end then reads, and whether the client is reset
+		clientReads   string
+		upstreamReads string
+		reset         bool
+	}{
+		{
+			name: "both ends close",
+			client: func(c *net.TCPConn) {
+				c.Write([]byte("ping"))
+				c.CloseWrite()
+			},
+			upstream: func(c *net.TCPConn) {
+				c.Write([]byte("pong"))
+				c.CloseWrite()
+			},
+			stop:          func(*net.TCPConn, context.CancelFunc) {},
+			clientReads:   "pong",
+			upstreamReads: "ping",
+		},
+		{
+			name: "canceled",
+			client: func(c *net.TCPConn) {
+				c.Write([]byte("ping"))
+			},
+			upstream:      func(*net.TCPConn) {},
+			stop:          func(_ *net.TCPConn, cancel context.CancelFunc) { cancel() },
+			upstreamReads: "ping",
+		},
+		{
+			name:   "chaos reset",
+			client: func(*net.TCPConn) {},
+			upstream: func(c *net.TCPConn) {
+				c.Write([]byte("pong"))
+			},
+			stop: func(relayed *net.TCPConn, cancel context.CancelFunc) {
+				// like chaosSettings.reset does
+				relayed.SetLinger(0)
+				cancel()
+			},
+			clientReads: "pong",
+			reset:       true,
+		},
+	}
+	loops, err := newEventLoops(1, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		client, relayedClient := tcpPair(t)
+		relayedUpstream, upstream := tcpPair(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool, 1)
+		go func() {
+			done <- loops.relay(ctx, relayedClient, relayedUpstream, 0)
+		}()
+		test.client(client)
+		test.upstream(upstream)
+		// let the loop relay what was written before stopping the tunnel
+		time.Sleep(50 * time.Millisecond)
+		test.stop(relayedClient, cancel)
+		select {
+		case relayed := <-done:
+			if !relayed {
+				t.Errorf("%s: tunnel not relayed by the event loop", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: tunnel still relayed", test.name)
+			cancel()
+			<-done
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		clientRead, clientErr := ioutil.ReadAll(client)
+		upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		upstreamRead, _ := ioutil.ReadAll(upstream)
+		if string(clientRead) != test.clientReads {
+			t.Errorf("%s: client read %q, expected %q", test.name, clientRead, test.clientReads)
+		}
+		if string(upstreamRead) != test.upstreamReads {
+			t.Errorf("%s: upstream read %q, expected %q", test.name, upstreamRead, test.upstreamReads)
+		}
+		if reset := clientErr != nil; reset != test.reset {
+			t.Errorf("%s: client reset %v, expected %v (%v)", test.name, reset, test.reset, clientErr)
+		}
+		cancel()
+		client.Close()
+		upstream.Close()
+	}
+	if count := len(loops.loops[0].tunnels); count != 0 {
+		t.Errorf("%d descriptors still watched", count)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+type eventLoops struct{}
+
+func newEventLoops(count, bufferSize int) (*eventLoops, error) {
+	return nil, errors.New("event loops are only supported on Linux")
+}
+
+func (l *eventLoops) relay(ctx context.Context, client, upstream io.ReadWriter, linger time.Duration) bool {
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var exfiltrationAlerts = expvar.NewInt("exfiltration_alerts")
+
+// exfiltrationSlices is the number of slices the window of the exfiltration
+// detector is split into, the uploads sliding out of it a slice at a time.
+const exfiltrationSlices = 12
+
+// exfiltrationDetector alerts when a client uploads more than threshold
+// bytes to a single external destination within window.
+type exfiltrationDetector struct {
+	threshold uint64
+	window    time.Duration
+	alert     func(notification)
+
+	mtx sync.Mutex
+	// upload bytes of the active connections accounted for so far
+	seen  map[*metricConn]uint64
+	flows map[flowKey]*uploadFlow
+}
+
+// flowKey identifies the uploads of a client IP to a destination host.
+type flowKey struct {
+	client string
+	host   string
+}
+
+// uploadFlow holds the bytes uploaded in each slice of the window, the
+// newest one last.
+type uploadFlow struct {
+	slices  [exfiltrationSlices]uint64
+	current time.Time
+	alerted bool
+}
+
+// exfiltrationConfig reads the exfiltration threshold, and returns the
+// detector notifying its alerts to alert, or nil when there is none.
+func exfiltrationConfig(config *viper.Viper, alert func(notification)) (*exfiltrationDetector, error) {
+	threshold := config.GetString("exfiltration-threshold")
+	if threshold == "" {
+		return nil, nil
+	}
+	bytes, err := parseSize(threshold)
+	if err != nil {
+		return nil, err
+	}
+	return newExfiltrationDetector(uint64(bytes), config.GetDuration("exfiltration-window"), alert), nil
+}
+
+func newExfiltrationDetector(threshold uint64, window time.Duration, alert func(notification)) *exfiltrationDetector {
+	return &exfiltrationDetector{
+		threshold: threshold,
+		window:    window,
+		alert:     alert,
+		seen:      map[*metricConn]uint64{},
+		flows:     map[flowKey]*uploadFlow{},
+	}
+}
+
+// run samples the uploads of the active connections once per slice of the
+// window.
+func (d *exfiltrationDetector) run(ch chan event) {
+	ticker := time.NewTicker(d.window / exfiltrationSlices)
+	defer ticker.Stop()
+	for range ticker.C {
+		var conns []*metricConn
+		inspect(ch, func(s *stats) {
+			conns = append(conns, s.conn...)
+		})
+		now := time.Now()
+		d.mtx.Lock()
+		var alerts []notification
+		for _, conn := range conns {
+			// closed connections were accounted for by closed
+			if atomic.LoadInt32(&conn.closed) == 0 {
+				alerts = d.account(conn, now, alerts)
+			}
+		}
+		for key, flow := range d.flows {
+			if total := flow.advance(now, d.window); total == 0 {
+				delete(d.flows, key)
+			} else if total <= d.threshold {
+				flow.alerted = false
+			}
+		}
+		d.mtx.Unlock()
+		d.send(alerts)
+	}
+}
+
+// closed accounts for the last uploads of conn, once it is done.
+func (d *exfiltrationDetector) closed(conn *metricConn) {
+	if d == nil {
+		return
+	}
+	d.mtx.Lock()
+	alerts := d.account(conn, time.Now(), nil)
+	delete(d.seen, conn)
+	d.mtx.Unlock()
+	d.send(alerts)
+}
+
+// account adds the bytes uploaded by conn since it was last seen to its
+// flow, appending to alerts the notification of a flow crossing the
+// threshold.
+func (d *exfiltrationDetector) account(conn *metricConn, now time.Time, alerts []notification) []notification {
+	if conn.remote == nil {
+		return alerts
+	}
+	host := hostname(conn.remote.host)
+	if ip := net.ParseIP(host); ip != nil && isLocalIP(ip) {
+		return alerts
+	}
+	uploaded := conn.snapshot().readBytes
+	delta := uploaded - d.seen[conn]
+	d.seen[conn] = uploaded
+	if delta == 0 {
+		return alerts
+	}
+	key := flowKey{client: hostname(conn.conn.RemoteAddr().String()), host: host}
+	flow, ok := d.flows[key]
+	if !ok {
+		flow = &uploadFlow{current: now}
+		d.flows[key] = flow
+	}
+	if flow.advance(now, d.window) <= d.threshold {
+		// alerted again once the flow went back under the threshold
+		flow.alerted = false
+	}
+	flow.slices[exfiltrationSlices-1] += delta
+	total := flow.total()
+	if total <= d.threshold || flow.alerted {
+		return alerts
+	}
+	flow.alerted = true
+	return append(alerts, notification{
+		Type:     notifyExfiltration,
+		Time:     now,
+		Client:   key.client,
+		Host:     key.host,
+		Uploaded: total,
+	})
+}
+
+func (d *exfiltrationDetector) send(alerts []notification) {
+	for _, n := range alerts {
+		exfiltrationAlerts.Add(1)
+		warnf("%s uploaded %s to %s in less than %s", n.Client, humanBytes(n.Uploaded), n.Host, humanDuration(d.window))
+		d.alert(n)
+	}
+}
+
+// advance slides the window of f up to now, and returns the bytes left in
+// it.
+func (f *uploadFlow) advance(now time.Time, window time.Duration) uint64 {
+	slice := window / exfiltrationSlices
+	shift := int(now.Sub(f.current) / slice)
+	if shift > 0 {
+		if shift > exfiltrationSlices {
+			shift = exfiltrationSlices
+		}
+		copy(f.slices[:], f.slices[shift:])
+		for i := exfiltrationSlices - shift; i < exfiltrationSlices; i++ {
+			f.slices[i] = 0
+		}
+		f.current = f.current.Add(time.Duration(shift) * slice)
+		if now.Sub(f.current) >= slice {
+			f.current = now
+		}
+	}
+	return f.total()
+}
+
+func (f *uploadFlow) total() uint64 {
+	var total uint64
+	for _, n := range f.slices {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var injectedFaults = expvar.NewMap("injected_faults")
+
+// faultRule degrades the connections toward a domain, or toward any
+// destination for "*", for clients to test how they cope with a bad network:
+// their requests are delayed by latency, a share of them given by errorRate
+// fails, and the others are capped to rate bytes per second each way.
+type faultRule struct {
+	domain    string
+	latency   time.Duration
+	errorRate float64
+	rate      float64
+}
+
+// faultRules are applied to the requests of the destinations they match,
+// the first matching one only.
+type faultRules []*faultRule
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// parseFaultRule parses rules like "api.example.net:latency=2s:rate=10KB:error=0.1".
+func parseFaultRule(v string) (*faultRule, error) {
+	tokens := strings.Split(v, ":")
+	if len(tokens) < 2 || tokens[0] == "" {
+		return nil, fmt.Errorf("invalid fault %q: expected domain:key=value:...", v)
+	}
+	f := &faultRule{domain: strings.ToLower(tokens[0])}
+	for _, option := range tokens[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid fault option %q", option)
+		}
+		switch kv[0] {
+		case "latency":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid latency %q", kv[1])
+			}
+			f.latency = d
+		case "error":
+			p, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || p < 0 || p > 1 {
+				return nil, fmt.Errorf("invalid error rate %q: expected a share between 0 and 1", kv[1])
+			}
+			f.errorRate = p
+		case "rate":
+			rate, err := parseSize(strings.TrimSuffix(kv[1], "/s"))
+			if err != nil {
+				return nil, err
+			}
+			f.rate = rate
+		default:
+			return nil, fmt.Errorf("unknown fault option %q", kv[0])
+		}
+	}
+	return f, nil
+}
+
+func (f *faultRule) matches(host string) bool {
+	host = strings.ToLower(hostname(host))
+	return f.domain == "*" || host == f.domain || strings.HasSuffix(host, "."+f.domain)
+}
+
+// faultConfig reads the fault rules.
+func faultConfig(config *viper.Viper) (faultRules, error) {
+	var rules faultRules
+	for _, v := range config.GetStringSlice("fault") {
+		rule, err := parseFaultRule(v)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// find returns the rule applying to host, if any.
+func (rules faultRules) find(host string) *faultRule {
+	for _, f := range rules {
+		if f.matches(host) {
+			return f
+		}
+	}
+	return nil
+}
+
+// faultStage delays the requests, and fails some of them, as told by the
+// fault rules of their destination.
+func (h *handler) faultStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	host, _, err := net.SplitHostPort(r.address)
+	if err != nil {
+		return next(ctx, r)
+	}
+	f := h.faults.find(host)
+	if f == nil {
+		return next(ctx, r)
+	}
+	if f.latency > 0 {
+		injectedFaults.Add("latency", 1)
+		timer := time.NewTimer(f.latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if f.errorRate > 0 && rand.Float64() < f.errorRate {
+		injectedFaults.Add("error", 1)
+		infof("injecting an error into %s %s", r.request.Method, r.address)
+		return nil, &statusError{status: http.StatusBadGateway, err: errors.New("fault injected by the proxy")}
+	}
+	return next(ctx, r)
+}
@@ -11,7 +11,8 @@ func humanDuration(d time.Duration) string {
 
 var bytesUnit []string = []string{
 	"o",
-	"o",
+	"ko",
+	"mo",
 	"go",
 	"to",
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bufferedConn reads a client connection through the reader its request was
+// parsed with, so that no buffered byte is lost.
+type bufferedConn struct {
+	io.ReadWriter
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *bufferedConn) Close() error {
+	if closer, ok := c.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.ReadWriter)
+}
+
+// requestStream is the client side of a persistent connection. It is read
+// through a single reader, while the bytes of each request go through the
+// ReadWriter of the request being served.
+type requestStream struct {
+	io.ReadWriter
+	// the bytes read while a request header is parsed
+	head      []byte
+	recording bool
+}
+
+func (s *requestStream) Read(buf []byte) (int, error) {
+	n, err := s.ReadWriter.Read(buf)
+	if s.recording {
+		s.head = append(s.head, buf[:n]...)
+	}
+	return n, err
+}
+
+func (s *requestStream) CloseWrite() error {
+	return closeWrite(s.ReadWriter)
+}
+
+// requestConn returns conn as a connection to parse requests from, keeping
+// the reader of one that already carried requests.
+func requestConn(conn io.ReadWriter) *bufferedConn {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		if _, ok := buffered.ReadWriter.(*requestStream); ok {
+			return buffered
+		}
+	}
+	stream := &requestStream{ReadWriter: conn}
+	return &bufferedConn{ReadWriter: stream, reader: bufio.NewReader(stream)}
+}
+
+// readRequest parses the next request of conn, once its raw header is
+// checked for ways to smuggle another request past the proxy. With
+// keepOrder, it also returns the order of the header fields.
+func readRequest(conn *bufferedConn, keepOrder bool) (*http.Request, []string, error) {
+	stream := conn.ReadWriter.(*requestStream)
+	reader := conn.reader
+	pending, _ := reader.Peek(reader.Buffered())
+	stream.head = append(stream.head[:0], pending...)
+	stream.recording = true
+	req, err := http.ReadRequest(reader)
+	stream.recording = false
+	head := stream.head[:len(stream.head)-reader.Buffered()]
+	stream.head = nil
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkRequestHead(head); err != nil {
+		return nil, nil, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	var order []string
+	if keepOrder {
+		order = headerOrder(head)
+	}
+	return req, order, nil
+}
+
+// writeRequestHead writes the request line and header of req, with target
+// as request target, as they are to be forwarded. The header fields named in
+// order come first.
+func writeRequestHead(w io.Writer, req *http.Request, target string, order []string) error {
+	if _, err := fmt.Fprintf(w, "%s %s %s\r\nHost: %s\r\n", req.Method, target, req.Proto, req.Host); err != nil {
+		return err
+	}
+	// parsed out of the header
+	if len(req.TransferEncoding) > 0 {
+		if _, err := fmt.Fprintf(w, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", ")); err != nil {
+			return err
+		}
+	}
+	if len(req.Trailer) > 0 {
+		names := make([]string, 0, len(req.Trailer))
+		for name := range req.Trailer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if _, err := fmt.Fprintf(w, "Trailer: %s\r\n", strings.Join(names, ", ")); err != nil {
+			return err
+		}
+	}
+	if req.Close && !hasToken(req.Header["Connection"], "close") {
+		if _, err := io.WriteString(w, "Connection: close\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := writeOrderedHeader(w, req.Header, order); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// writeStrictRequest writes req to an upstream proxy with writeRequestHead,
+// so that its header keeps the order it was received in, followed by its
+// body.
+func writeStrictRequest(w io.Writer, req *http.Request, order []string) error {
+	// absolute-form, without user info
+	target := req.URL.Scheme + "://" + req.URL.Host + req.URL.RequestURI()
+	if err := writeRequestHead(w, req, target, order); err != nil {
+		return err
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if len(req.TransferEncoding) == 0 || req.TransferEncoding[0] != "chunked" {
+		_, err := io.Copy(w, req.Body)
+		return err
+	}
+	chunks := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(chunks, req.Body); err != nil {
+		return err
+	}
+	// writes the last chunk, the trailers follow
+	if err := chunks.Close(); err != nil {
+		return err
+	}
+	if err := req.Trailer.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// requestBody reads the body of a forwarded request, to know where the
+// request ends.
+type requestBody struct {
+	io.ReadCloser
+	read int64
+	done bool
+}
+
+func (b *requestBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+// checkBody makes sure the whole body of req was sent: otherwise, what is
+// left of it would be parsed as the next request of the client.
+func checkBody(req *http.Request, body *requestBody) error {
+	if body == nil {
+		return nil
+	}
+	if req.ContentLength >= 0 && body.read != req.ContentLength {
+		return fmt.Errorf("sent %d bytes of a %d bytes request body", body.read, req.ContentLength)
+	}
+	if !body.done {
+		return errors.New("request body not read to its end")
+	}
+	return nil
+}
+
+// forward sends the plain HTTP request of remote to its destination, unless
+// it can be answered from the cache, and relays the response to client. The
+// upstream connection is only dialed once the cache can't answer. The
+// exchange is marked as reusable when neither end asked to close its
+// connection: the client can then send another request, and the upstream
+// connection can serve another one.
+func (h *handler) forward(ctx context.Context, client io.ReadWriter, remote *remote) error {
+	done := make(chan struct{})
+	defer close(done)
+	closeOnCancel := func(closer io.Closer) {
+		go func() {
+			select {
+			case <-ctx.Done():
+				closer.Close()
+			case <-done:
+			}
+		}()
+	}
+	if closer, ok := client.(io.Closer); ok {
+		closeOnCancel(closer)
+	}
+	// the upgrade headers outlive prepareRequest
+	upgrade := upgrading(remote.request.Header)
+	blocked, err := h.icap.modifyRequest(ctx, remote.request)
+	if err != nil {
+		remote.status = http.StatusBadGateway
+		h.pages.writeError(ctx, client, remote.status, err)
+		return err
+	}
+	// the requests blocked by the ICAP service are answered like cache hits
+	cached := blocked
+	var stale *cacheEntry
+	if cached == nil {
+		cached, stale = h.cache.prepare(remote.request)
+	}
+	if cached != nil {
+		// the upstream connection is left untouched
+		if _, err := io.Copy(ioutil.Discard, remote.request.Body); err != nil {
+			return err
+		}
+		resp, err := h.respond(ctx, client, remote, cached, false)
+		if err != nil {
+			return err
+		}
+		remote.reusable = !remote.request.Close && !resp.Close && ctx.Err() == nil
+		return nil
+	}
+	dialed := remote.conn == nil
+	upstream, err := remote.connect(ctx)
+	if err != nil {
+		remote.status = errorStatus(err)
+		if remote.status == 0 {
+			remote.status = http.StatusBadGateway
+		}
+		h.pages.writeError(ctx, client, remote.status, err)
+		return err
+	}
+	closeOnCancel(upstream)
+	if dialed {
+		var stopCapture func()
+		client, stopCapture = h.tap(ctx, client, remote)
+		defer stopCapture()
+	}
+	expectTrailers(remote.request.TransferEncoding, &remote.request.Trailer)
+	var body *requestBody
+	if remote.request.Body != nil && remote.request.Body != http.NoBody {
+		body = &requestBody{ReadCloser: remote.request.Body}
+		remote.request.Body = body
+	}
+	sent := time.Now()
+	if remote.proxied && h.headers.strictUpstream {
+		err = writeStrictRequest(upstream, remote.request, remote.headerOrder)
+	} else {
+		if _, ok := remote.request.Header["User-Agent"]; !ok {
+			// keep req.Write from adding its own
+			remote.request.Header["User-Agent"] = []string{""}
+		}
+		// origins get the request target in origin-form, with its query
+		// string, and the Host header of the absolute URI, whatever the
+		// client sent
+		write := remote.request.Write
+		if remote.proxied {
+			write = remote.request.WriteProxy
+		}
+		err = write(upstream)
+	}
+	if err == nil {
+		err = checkBody(remote.request, body)
+	}
+	if err != nil {
+		remote.status = http.StatusBadGateway
+		h.pages.writeError(ctx, client, remote.status, err)
+		return err
+	}
+	for answered := false; ; answered = true {
+		resp, err := http.ReadResponse(upstream.reader, remote.request)
+		if err != nil {
+			if !answered {
+				remote.status = http.StatusBadGateway
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					remote.status = http.StatusGatewayTimeout
+				}
+				h.pages.writeError(ctx, client, remote.status, err)
+			}
+			return err
+		}
+		h.debug.logDebugResponse(ctx, remote.request, resp)
+		h.session.recordResponse(remote, resp)
+		if resp.StatusCode >= 200 && resp.StatusCode != http.StatusNotModified {
+			resp, err = h.icap.modifyResponse(ctx, remote.request, resp)
+			if err == nil {
+				resp = h.types.filter(ctx, remote.request, resp)
+				resp, err = h.antivirus.check(ctx, remote.request, resp)
+			}
+			if err == nil {
+				resp, err = h.dataSaver.shrink(remote.request, resp)
+			}
+			if err != nil {
+				remote.status = http.StatusBadGateway
+				h.pages.writeError(ctx, client, remote.status, err)
+				return err
+			}
+		}
+		resp = h.cache.update(ctx, remote.request, resp, stale, sent)
+		resp, err = h.respond(ctx, client, remote, resp, upgrade && resp.StatusCode == http.StatusSwitchingProtocols)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusSwitchingProtocols:
+			bidirectionalPipe(ctx, &bufferedConn{ReadWriter: client, reader: remote.reader}, upstream, h.buffers, h.linger)
+			return nil
+		case resp.StatusCode >= 100 && resp.StatusCode < 200:
+			// interim response, the final one follows
+			continue
+		}
+		remote.reusable = !remote.request.Close && !resp.Close && ctx.Err() == nil
+		return nil
+	}
+}
+
+// respond relays resp to the client of remote, or the response its
+// redirects lead to when they are followed, and returns the relayed
+// response. When upgrade is set, the headers switching the connection to
+// another protocol are kept.
+func (h *handler) respond(ctx context.Context, client io.Writer, remote *remote, resp *http.Response, upgrade bool) (*http.Response, error) {
+	remote.status = resp.StatusCode
+	followed, err := h.redirects.follow(ctx, remote, resp)
+	if err != nil {
+		resp.Body.Close()
+		remote.status = http.StatusBadGateway
+		h.pages.writeError(ctx, client, remote.status, err)
+		return nil, err
+	}
+	if followed != nil {
+		resp.Body.Close()
+		// the final response goes through the connection of the client,
+		// whose fate is still tied to the one of the upstream connection
+		followed.Close = resp.Close
+		resp = followed
+		remote.status = resp.StatusCode
+	}
+	h.headers.prepareResponse(resp, remote.host, remote.path, upgrade)
+	if err := h.scripts.responseReceived(ctx, remote.request, resp); err != nil {
+		resp.Body.Close()
+		remote.status = http.StatusInternalServerError
+		h.pages.writeError(ctx, client, remote.status, err)
+		return nil, err
+	}
+	if !upgrade {
+		h.transforms.transformBody(remote.request, resp)
+		h.compression.compressBody(remote.request, resp)
+	}
+	expectTrailers(resp.TransferEncoding, &resp.Trailer)
+	if !remote.request.ProtoAtLeast(1, 1) {
+		frameForHTTP10(resp, !remote.request.Close)
+	}
+	err = resp.Write(client)
+	resp.Body.Close()
+	return resp, err
+}
+
+// frameForHTTP10 adapts resp to an HTTP/1.0 client, which knows nothing of
+// chunked bodies, and only keeps its connection open when told to.
+func frameForHTTP10(resp *http.Response, keepAlive bool) {
+	if len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked" {
+		// the end of the connection marks the end of the body instead
+		resp.TransferEncoding = nil
+		resp.Trailer = nil
+		resp.ContentLength = -1
+		resp.Close = true
+	}
+	if keepAlive && !resp.Close {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+}
+
+// maxResponseHeadSize bounds the response header of upstream proxies.
+const maxResponseHeadSize = 64 << 10
+
+// relayResponseHead relays to client the response header upstream answered
+// a tunneled request with, along with the bytes that followed it, and
+// returns its status code. A malformed header is logged with redaction.
+func relayResponseHead(ctx context.Context, client io.Writer, upstream net.Conn, redaction *logRedaction) (int, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		upstream.SetReadDeadline(deadline)
+		defer upstream.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(upstream)
+	head := []byte{}
+	for {
+		line, err := reader.ReadSlice('\n')
+		head = append(head, line...)
+		if err != nil {
+			return 0, &statusError{status: http.StatusBadGateway, err: err}
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if len(head) > maxResponseHeadSize {
+			return 0, &statusError{status: http.StatusBadGateway, err: errors.New("response header from upstream too large")}
+		}
+	}
+	fields := strings.Fields(string(head[:bytes.IndexByte(head, '\n')]))
+	status := 0
+	if len(fields) >= 2 && strings.HasPrefix(fields[0], "HTTP/") {
+		status, _ = strconv.Atoi(fields[1])
+	}
+	if status == 0 {
+		return 0, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("malformed response from upstream: %q", redaction.redactHead(head))}
+	}
+	// servers may talk first
+	buffered, _ := reader.Peek(reader.Buffered())
+	_, err := client.Write(append(head, buffered...))
+	return status, err
+}
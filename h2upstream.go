@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// h2Addr is the address of the upstream proxy carrying a stream.
+type h2Addr string
+
+func (a h2Addr) Network() string { return "tcp" }
+func (a h2Addr) String() string  { return string(a) }
+
+// h2Stream is a tunnel carried by an HTTP/2 stream to the upstream proxy.
+type h2Stream struct {
+	body     io.ReadCloser
+	requests *io.PipeWriter
+	upstream h2Addr
+	// cancels the CONNECT request carrying the stream
+	cancel context.CancelFunc
+}
+
+func (s *h2Stream) Read(buf []byte) (int, error)  { return s.body.Read(buf) }
+func (s *h2Stream) Write(buf []byte) (int, error) { return s.requests.Write(buf) }
+func (s *h2Stream) CloseWrite() error             { return s.requests.Close() }
+func (s *h2Stream) Close() error {
+	defer s.cancel()
+	s.requests.Close()
+	return s.body.Close()
+}
+func (s *h2Stream) LocalAddr() net.Addr                { return s.upstream }
+func (s *h2Stream) RemoteAddr() net.Addr               { return s.upstream }
+func (s *h2Stream) SetDeadline(t time.Time) error      { return nil }
+func (s *h2Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *h2Stream) SetWriteDeadline(t time.Time) error { return nil }
+
+// h2UpstreamDial carries CONNECT tunnels as streams of a few HTTP/2
+// connections to the upstream proxy, instead of a connection each. Other
+// requests are handed to fallback.
+func (h *handler) h2UpstreamDial(dialer *proxyDialer, upstreamURL string, fallback resolveFunc) (resolveFunc, error) {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "https" {
+		return nil, fmt.Errorf("HTTP/2 needs an https:// upstream proxy, got %s", upstreamURL)
+	}
+	auth := ""
+	if user := upstream.User.String(); user != "" {
+		auth = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(user)))
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.dial(ctx, address)
+		},
+		TLSClientConfig:   &tls.Config{NextProtos: []string{"h2"}},
+		ForceAttemptHTTP2: true,
+	}
+	return func(ctx context.Context, r *resolution) (*remote, error) {
+		conn, reader, req := r.conn, r.reader, r.request
+		if req.Method != "CONNECT" {
+			return fallback(ctx, r)
+		}
+		body, requests := io.Pipe()
+		out := &http.Request{
+			Method:        "CONNECT",
+			URL:           &url.URL{Scheme: "https", Host: upstream.Host},
+			Host:          req.Host,
+			Header:        make(http.Header),
+			Body:          body,
+			ContentLength: -1,
+		}
+		h.headers.addVia(out.Header, req.ProtoMajor, req.ProtoMinor)
+		if auth != "" {
+			out.Header.Set("Proxy-Authorization", auth)
+		}
+		// the stream outlives the resolution, whose context only bounds
+		// the wait for the upstream proxy to answer
+		streamCtx, cancel := context.WithCancel(context.Background())
+		answered := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-answered:
+			}
+		}()
+		out = out.WithContext(streamCtx)
+		resp, err := transport.RoundTrip(out)
+		close(answered)
+		if err != nil {
+			cancel()
+			requests.Close()
+			countUpstreamError(upstream.Host, "dial")
+			return nil, err
+		}
+		stream := &h2Stream{body: resp.Body, requests: requests, upstream: h2Addr(upstream.Host), cancel: cancel}
+		if resp.ProtoMajor != 2 {
+			stream.Close()
+			return nil, fmt.Errorf("upstream proxy %s does not speak HTTP/2", upstream.Host)
+		}
+		if resp.StatusCode != http.StatusOK {
+			stream.Close()
+			if resp.StatusCode == http.StatusProxyAuthRequired {
+				countUpstreamError(upstream.Host, "auth")
+			}
+			return nil, &statusError{
+				status: resp.StatusCode,
+				err:    fmt.Errorf("upstream proxy refused CONNECT %s: %s", req.Host, resp.Status),
+			}
+		}
+		if buffered, _ := reader.Peek(reader.Buffered()); len(buffered) > 0 {
+			if _, err := stream.Write(buffered); err != nil {
+				stream.Close()
+				return nil, err
+			}
+		}
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return &remote{
+			conn:   stream,
+			host:   req.Host,
+			method: req.Method,
+			status: resp.StatusCode,
+		}, nil
+	}, nil
+}
@@ -0,0 +1,105 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// takeOver asks the nanoproxy process serving the handoff socket at path for
+// its listener. It returns a nil listener when no process answers.
+func takeOver(path string) (net.Listener, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, errors.New("handoff: expected a single file descriptor")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, errors.New("handoff: expected a single file descriptor")
+	}
+	file := os.NewFile(uintptr(fds[0]), "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	// the previous process stops accepting connections once acknowledged
+	if _, err := conn.Write([]byte{1}); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveHandoff hands listener over to the first process connecting to the
+// handoff socket at path, then calls stop.
+func serveHandoff(path string, listener net.Listener, stop func()) error {
+	os.Remove(path)
+	control, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// once handed over, the path belongs to the next process
+	control.SetUnlinkOnClose(false)
+	go func() {
+		defer control.Close()
+		for {
+			conn, err := control.AcceptUnix()
+			if err != nil {
+				return
+			}
+			err = handOver(conn, listener)
+			if err == nil {
+				stop()
+				return
+			}
+			warnf("failed to hand the listener over: %v", err)
+		}
+	}()
+	return nil
+}
+
+func handOver(conn *net.UnixConn, listener net.Listener) error {
+	defer conn.Close()
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("handoff: not a TCP listener")
+	}
+	file, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, _, err = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(file.Fd())), nil)
+	if err != nil {
+		return err
+	}
+	// wait for the next process to be accepting connections
+	ack := make([]byte, 1)
+	_, err = conn.Read(ack)
+	return err
+}
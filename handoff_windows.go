@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Listener handoff relies on passing file descriptors over Unix sockets.
+func takeOver(path string) (net.Listener, error) {
+	return nil, nil
+}
+
+func serveHandoff(path string, listener net.Listener, stop func()) error {
+	return errors.New("listener handoff is not supported on Windows")
+}
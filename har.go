@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harCaptureLimit is the maximum number of bytes recorded in each direction
+// of a connection.
+const harCaptureLimit = 1 << 20
+
+type captureMark struct {
+	offset int
+	at     time.Time
+}
+
+// capture holds the first bytes flowing in one direction of a connection,
+// and when they were transferred.
+type capture struct {
+	data  []byte
+	marks []captureMark
+}
+
+func (c *capture) record(buf []byte) {
+	if len(c.data) >= harCaptureLimit || len(buf) == 0 {
+		return
+	}
+	c.marks = append(c.marks, captureMark{offset: len(c.data), at: time.Now()})
+	if n := harCaptureLimit - len(c.data); len(buf) > n {
+		buf = buf[:n]
+	}
+	c.data = append(c.data, buf...)
+}
+
+// timeAt returns when the byte at offset was transferred.
+func (c *capture) timeAt(offset int) time.Time {
+	idx := sort.Search(len(c.marks), func(i int) bool {
+		return c.marks[i].offset > offset
+	})
+	if idx == 0 {
+		return time.Time{}
+	}
+	return c.marks[idx-1].at
+}
+
+// serverMark is the address of the server a request was sent to, noted once
+// the request was received up to offset.
+type serverMark struct {
+	offset int
+	addr   string
+}
+
+// recordingConn records the traffic of a client connection, so it can be
+// exported as HAR once the connection is closed.
+type recordingConn struct {
+	net.Conn
+	mtx      sync.Mutex
+	received capture
+	sent     capture
+	servers  []serverMark
+	stopped  bool
+}
+
+func (r *recordingConn) Read(buf []byte) (int, error) {
+	n, err := r.Conn.Read(buf)
+	r.mtx.Lock()
+	if !r.stopped {
+		r.received.record(buf[:n])
+	}
+	r.mtx.Unlock()
+	return n, err
+}
+
+func (r *recordingConn) Write(buf []byte) (int, error) {
+	n, err := r.Conn.Write(buf)
+	r.mtx.Lock()
+	if !r.stopped {
+		r.sent.record(buf[:n])
+	}
+	r.mtx.Unlock()
+	return n, err
+}
+
+// stop stops recording the connection, and drops what was recorded: tunnels
+// are not exported as HAR.
+func (r *recordingConn) stop() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.stopped = true
+	r.received, r.sent, r.servers = capture{}, capture{}, nil
+}
+
+// served notes the address of the server the request just received was sent
+// to, or "" when none was dialed for it.
+func (r *recordingConn) served(addr string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.stopped {
+		r.servers = append(r.servers, serverMark{offset: len(r.received.data), addr: addr})
+	}
+}
+
+func (r *recordingConn) CloseWrite() error {
+	return closeWrite(r.Conn)
+}
+
+func (r *recordingConn) snapshot() (capture, capture, []serverMark) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.received, r.sent, r.servers
+}
+
+// serverAddress returns the address of the server remote was sent to, or ""
+// when it was answered without one: from the cache, or with an error.
+func serverAddress(remote *remote) string {
+	if remote == nil || remote.conn == nil {
+		return ""
+	}
+	if addr := remote.conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if isCredential(name) {
+				value = "redacted"
+			}
+			out = append(out, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	out := []harNameValue{}
+	for _, cookie := range cookies {
+		out = append(out, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return out
+}
+
+func milliseconds(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harRecorder exports the plain HTTP exchanges of recorded connections as
+// HAR files, one per connection.
+type harRecorder struct {
+	dir     string
+	maxBody int
+}
+
+func (h *harRecorder) body(data []byte) (string, string) {
+	if len(data) > h.maxBody {
+		data = data[:h.maxBody]
+	}
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// entries parses the recorded traffic as a sequence of HTTP requests and
+// responses, sent to the servers noted along.
+func (h *harRecorder) entries(received, sent capture, servers []serverMark) []harEntry {
+	requestData := bytes.NewReader(received.data)
+	requests := bufio.NewReader(requestData)
+	responseData := bytes.NewReader(sent.data)
+	responses := bufio.NewReader(responseData)
+	requestOffset := func() int { return len(received.data) - requestData.Len() - requests.Buffered() }
+	responseOffset := func() int { return len(sent.data) - responseData.Len() - responses.Buffered() }
+
+	entries := []harEntry{}
+	for {
+		requestStart := requestOffset()
+		req, err := http.ReadRequest(requests)
+		if err != nil {
+			return entries
+		}
+		requestHeadersEnd := requestOffset()
+		requestBody, _ := ioutil.ReadAll(req.Body)
+		requestEnd := requestOffset()
+		// each request is noted once received, with its body
+		for len(servers) > 0 && servers[0].offset < requestEnd {
+			servers = servers[1:]
+		}
+		var serverAddr string
+		if len(servers) > 0 {
+			serverAddr = servers[0].addr
+			servers = servers[1:]
+		}
+		if req.URL.Host == "" {
+			req.URL.Host = req.Host
+			req.URL.Scheme = "http"
+		}
+		headers := harHeaders(req.Header)
+		headers = append([]harNameValue{{Name: "Host", Value: req.Host}}, headers...)
+		entry := harEntry{
+			StartedDateTime: received.timeAt(requestStart),
+			ServerIPAddress: serverAddr,
+			Request: harRequest{
+				Method:      req.Method,
+				URL:         req.URL.String(),
+				HTTPVersion: req.Proto,
+				Cookies:     harCookies(req.Cookies()),
+				Headers:     headers,
+				QueryString: []harNameValue{},
+				HeadersSize: requestHeadersEnd - requestStart,
+				BodySize:    len(requestBody),
+			},
+		}
+		for name, values := range req.URL.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+		if len(requestBody) > 0 && h.maxBody > 0 {
+			text, _ := h.body(requestBody)
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text}
+		}
+
+		responseStart := responseOffset()
+		resp, err := http.ReadResponse(responses, req)
+		if err != nil {
+			entries = append(entries, entry)
+			return entries
+		}
+		responseHeadersEnd := responseOffset()
+		responseBody, bodyErr := ioutil.ReadAll(resp.Body)
+		responseEnd := responseOffset()
+		entry.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimPrefix(resp.Status, fmt.Sprintf("%d ", resp.StatusCode)),
+			HTTPVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content: harContent{
+				Size:     len(responseBody),
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: responseHeadersEnd - responseStart,
+			BodySize:    len(responseBody),
+		}
+		if h.maxBody > 0 {
+			entry.Response.Content.Text, entry.Response.Content.Encoding = h.body(responseBody)
+			if len(responseBody) > h.maxBody {
+				entry.Response.Content.Comment = "truncated"
+			}
+		}
+		firstByte := sent.timeAt(responseStart)
+		lastByte := sent.timeAt(responseEnd - 1)
+		entry.Timings = harTimings{
+			Send:    milliseconds(received.timeAt(requestEnd - 1).Sub(entry.StartedDateTime)),
+			Wait:    milliseconds(firstByte.Sub(received.timeAt(requestEnd - 1))),
+			Receive: milliseconds(lastByte.Sub(firstByte)),
+		}
+		entry.Time = entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+		entries = append(entries, entry)
+		if bodyErr != nil {
+			// the capture ended in the middle of this response
+			return entries
+		}
+	}
+}
+
+// save writes the HAR file of a recorded connection.
+func (h *harRecorder) save(conn *recordingConn, start time.Time) error {
+	received, sent, servers := conn.snapshot()
+	entries := h.entries(received, sent, servers)
+	if len(entries) == 0 {
+		return nil
+	}
+	out := harLog{}
+	out.Log.Version = "1.2"
+	out.Log.Creator.Name = "nanoproxy"
+	out.Log.Creator.Version = "1.0"
+	out.Log.Entries = entries
+	buf, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	client := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+	name := fmt.Sprintf("%s-%s.har", start.Format("20060102T150405.000000000"), client)
+	return ioutil.WriteFile(filepath.Join(h.dir, name), buf, 0644)
+}
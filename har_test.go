@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestHARDialFailure(t *testing.T) {
+	// nothing listens on addr once closed, so the dial fails
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dir := t.TempDir()
+	config := viper.New()
+	config.Set("har-dir", dir)
+	h, err := newHandler(config, &proxyDialer{Dialer: net.Dialer{Timeout: time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.run(server)
+	}()
+	go client.Write([]byte("GET http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	answer, _ := ioutil.ReadAll(client)
+	client.Close()
+	<-done
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 1 {
+		t.Fatalf("expected one HAR file, got %d; answer %q", len(files), answer)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harLog
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(har.Log.Entries))
+	}
+	entry := har.Log.Entries[0]
+	if entry.Response.Status != 502 {
+		t.Errorf("expected a 502, got %d", entry.Response.Status)
+	}
+	if entry.ServerIPAddress != "" {
+		t.Errorf("expected no server address, got %q", entry.ServerIPAddress)
+	}
+}
+
+func TestHARServerAddresses(t *testing.T) {
+	exchange := func(path string) (string, string) {
+		return "GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	}
+	tests := []struct {
+		name    string
+		servers []string
+		// the requests received by the time each server is noted, the
+		// last one being pipelined by the client
+		noted   []int
+		answers []string
+	}{
+		{
+			name:    "dialed each time",
+			servers: []string{"192.0.2.1:80", "192.0.2.2:80"},
+			noted:   []int{1, 2},
+			answers: []string{"192.0.2.1:80", "192.0.2.2:80"},
+		},
+		{
+			name:    "cache hit then dial",
+			servers: []string{"", "192.0.2.2:80"},
+			noted:   []int{1, 2},
+			answers: []string{"", "192.0.2.2:80"},
+		},
+		{
+			name:    "pipelined",
+			servers: []string{"192.0.2.1:80", "192.0.2.2:80"},
+			noted:   []int{2, 2},
+			answers: []string{"192.0.2.1:80", "192.0.2.2:80"},
+		},
+	}
+	for _, test := range tests {
+		conn := &recordingConn{}
+		var requests []string
+		for i := range test.servers {
+			req, resp := exchange("/" + string(rune('a'+i)))
+			requests = append(requests, req)
+			conn.sent.record([]byte(resp))
+		}
+		received := 0
+		for i, addr := range test.servers {
+			for ; received < test.noted[i]; received++ {
+				conn.received.record([]byte(requests[received]))
+			}
+			conn.served(addr)
+		}
+		recorded, sent, servers := conn.snapshot()
+		entries := (&harRecorder{}).entries(recorded, sent, servers)
+		if len(entries) != len(test.answers) {
+			t.Errorf("%s: expected %d entries, got %d", test.name, len(test.answers), len(entries))
+			continue
+		}
+		for i, entry := range entries {
+			if entry.ServerIPAddress != test.answers[i] {
+				t.Errorf("%s: entry %d sent to %q, expected %q", test.name, i, entry.ServerIPAddress, test.answers[i])
+			}
+		}
+	}
+}
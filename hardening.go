@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// hardenedDefaults are the settings of the --hardened profile, so that a
+// proxy exposed to the internet is not an open relay.
+var hardenedDefaults = []struct {
+	flag  string
+	value string
+}{
+	{"block-local-destinations", "true"},
+	{"allowed-ports", "80,443"},
+	{"max-header-size", "65536"},
+	{"header-timeout", "5s"},
+	{"resolver-timeout", "15s"},
+	{"idle-timeout", "5m"},
+	{"max-lifetime", "12h"},
+}
+
+// harden applies the hardened profile to the flags of cmd that were neither
+// given on the command line, in the environment nor in the config file.
+func harden(cmd *cobra.Command, config *viper.Viper) error {
+	for _, setting := range hardenedDefaults {
+		env := "NANOPROXY_" + strings.ToUpper(strings.Replace(setting.flag, "-", "_", -1))
+		if cmd.Flags().Changed(setting.flag) || os.Getenv(env) != "" || config.InConfig(setting.flag) {
+			continue
+		}
+		if err := cmd.Flags().Set(setting.flag, setting.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUsers parses user:password credentials.
+func parseUsers(credentials []string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, credential := range credentials {
+		colon := strings.IndexByte(credential, ':')
+		if colon <= 0 {
+			return nil, fmt.Errorf("invalid credentials for %q, expected user:password", credential)
+		}
+		users[credential[:colon]] = credential[colon+1:]
+	}
+	return users, nil
+}
+
+// proxyCredentials returns the user and password of the Basic credentials
+// of a Proxy-Authorization header.
+func proxyCredentials(header http.Header) (string, string, bool) {
+	value := header.Get("Proxy-Authorization")
+	const prefix = "basic "
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	colon := strings.IndexByte(string(decoded), ':')
+	if colon < 0 {
+		return "", "", false
+	}
+	return string(decoded[:colon]), string(decoded[colon+1:]), true
+}
+
+// authenticate answers the requests without valid proxy credentials, when
+// clients have to authenticate.
+func (h *handler) authenticate(ctx context.Context, w io.Writer, req *http.Request) error {
+	users := h.settings().users
+	if users == nil {
+		return nil
+	}
+	user, password, ok := proxyCredentials(req.Header)
+	if ok {
+		expected, found := users[user]
+		if found && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+			return nil
+		}
+		warnf("invalid proxy credentials for user %q", user)
+	}
+	err := h.pages.answerError(ctx, w, req, http.StatusProxyAuthRequired, http.Header{
+		"Proxy-Authenticate": {`Basic realm="nanoproxy"`},
+	}, "proxy authentication required")
+	if ok {
+		return &deniedError{kind: notifyAuthFailure, method: req.Method, host: req.Host, status: http.StatusProxyAuthRequired, reason: fmt.Sprintf("invalid proxy credentials for user %q", user), err: err}
+	}
+	return err
+}
+
+// deniedError is returned for the requests refused by the authentication or
+// the destination checks, which are notified as events of kind.
+type deniedError struct {
+	kind   string
+	method string
+	host   string
+	status int
+	// why the request was refused, err being the error answered
+	reason string
+	err    error
+}
+
+func (e *deniedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deniedError) Unwrap() error {
+	return e.err
+}
+
+// parsePorts parses a list of ports.
+func parsePorts(values []string) (map[int]bool, error) {
+	ports := map[int]bool{}
+	for _, value := range values {
+		port, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// localNetworks are the networks blocked along with the loopback,
+// link-local and unspecified addresses.
+var localNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	for _, network := range localNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDestination refuses the host:port addresses clients are not allowed
+// to reach. Host names are checked once resolved, by refuseLocal.
+func (h *handler) checkDestination(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	access := h.settings()
+	if n, _ := strconv.Atoi(port); access.ports != nil && !access.ports[n] {
+		return &statusError{status: http.StatusForbidden, err: fmt.Errorf("destination port %s is not allowed", port)}
+	}
+	if ip := net.ParseIP(host); access.blockLocal && ip != nil && isLocalIP(ip) {
+		return &statusError{status: http.StatusForbidden, err: fmt.Errorf("destination %s is a local address", address)}
+	}
+	return nil
+}
+
+// refuseLocal is a dialer Control function refusing to connect to local
+// addresses, including the ones a destination name resolves to, when
+// the local destinations are blocked.
+func (h *handler) refuseLocal(network, address string, _ syscall.RawConn) error {
+	if !h.settings().blockLocal {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isLocalIP(ip) {
+		err := fmt.Errorf("destination %s is a local address", address)
+		return &deniedError{kind: notifyBlocked, host: address, status: http.StatusForbidden, reason: err.Error(), err: &statusError{status: http.StatusForbidden, err: err}}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAuthenticate(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		// whether the request goes through, and whether it is notified as
+		// a failed authentication
+		allowed  bool
+		notified bool
+	}{
+		{name: "valid", authorization: basic("alice:secret"), allowed: true},
+		{name: "lowercase scheme", authorization: "basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), allowed: true},
+		{name: "password with a colon", authorization: basic("bob:se:cret"), allowed: true},
+		{name: "missing", authorization: ""},
+		{name: "wrong password", authorization: basic("alice:guess"), notified: true},
+		{name: "unknown user", authorization: basic("mallory:secret"), notified: true},
+		{name: "not base64", authorization: "Basic !!!"},
+		{name: "other scheme", authorization: "Bearer " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))},
+	}
+	config := viper.New()
+	config.Set("auth", []string{"alice:secret", "bob:se:cret"})
+	h, err := newHandler(config, &proxyDialer{Dialer: net.Dialer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", http.NoBody)
+		if test.authorization != "" {
+			req.Header.Set("Proxy-Authorization", test.authorization)
+		}
+		out := &bytes.Buffer{}
+		err := h.authenticate(context.Background(), out, req)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: allowed %v, expected %v (%v)", test.name, allowed, test.allowed, err)
+		}
+		if test.allowed {
+			continue
+		}
+		if !strings.HasPrefix(out.String(), "HTTP/1.1 407 ") || !strings.Contains(out.String(), `Proxy-Authenticate: Basic realm="nanoproxy"`) {
+			t.Errorf("%s: answered %q", test.name, out.String())
+		}
+		var denied *deniedError
+		if notified := errors.As(err, &denied) && denied.kind == notifyAuthFailure; notified != test.notified {
+			t.Errorf("%s: notified %v, expected %v", test.name, notified, test.notified)
+		}
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	tests := []struct {
+		address    string
+		ports      []string
+		blockLocal bool
+		allowed    bool
+	}{
+		{address: "example.com:443", allowed: true},
+		{address: "example.com:25", ports: []string{"80", "443"}},
+		{address: "example.com:443", ports: []string{"80", "443"}, allowed: true},
+		{address: "127.0.0.1:80", allowed: true},
+		{address: "127.0.0.1:80", blockLocal: true},
+		{address: "10.1.2.3:80", blockLocal: true},
+		{address: "[::1]:80", blockLocal: true},
+		{address: "192.0.2.1:80", blockLocal: true, allowed: true},
+		// names are checked once resolved
+		{address: "localhost:80", blockLocal: true, allowed: true},
+		{address: "example.com", allowed: false},
+	}
+	for _, test := range tests {
+		config := viper.New()
+		config.Set("allowed-ports", test.ports)
+		config.Set("block-local-destinations", test.blockLocal)
+		h, err := newHandler(config, &proxyDialer{Dialer: net.Dialer{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.checkDestination(test.address)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("checkDestination(%q) with ports %v and local destinations blocked %v: allowed %v, expected %v (%v)",
+				test.address, test.ports, test.blockLocal, allowed, test.allowed, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// route selects the requests toward the destinations of a domain, or all
+// of them when domain is empty. When path is set, only the requests under it
+// match.
+type route struct {
+	domain string
+	path   string
+}
+
+// parseRoute parses routes like "example.net" or "example.net/api".
+func parseRoute(v string) route {
+	r := route{domain: strings.ToLower(v)}
+	if slash := strings.IndexByte(v, '/'); slash >= 0 {
+		r.domain, r.path = r.domain[:slash], v[slash:]
+	}
+	return r
+}
+
+func (r route) matches(host, path string) bool {
+	if !strings.HasPrefix(path, r.path) {
+		return false
+	}
+	if r.domain == "" {
+		return true
+	}
+	host = strings.ToLower(hostname(host))
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+// headerRule edits a header field of the messages exchanged on a route.
+type headerRule struct {
+	route
+	action string
+	name   string
+	value  string
+}
+
+// parseHeaderRule parses rules like "add:Cache-Control:no-store",
+// "replace:Server:nanoproxy" or "remove:Server", optionally restricted to
+// the destinations of a domain with a prefix like "example.net=", or to a
+// route with a prefix like "example.net/api=".
+func parseHeaderRule(v string) (*headerRule, error) {
+	r := &headerRule{}
+	rule := v
+	if eq := strings.IndexByte(rule, '='); eq >= 0 && eq < strings.IndexByte(rule, ':') {
+		r.route = parseRoute(rule[:eq])
+		rule = rule[eq+1:]
+		if r.domain == "" && r.path == "" {
+			return nil, fmt.Errorf("invalid header rule %q: empty route", v)
+		}
+	}
+	tokens := strings.SplitN(rule, ":", 3)
+	if len(tokens) < 2 || tokens[1] == "" {
+		return nil, fmt.Errorf("invalid header rule %q: expected action:name[:value]", v)
+	}
+	r.action = tokens[0]
+	r.name = http.CanonicalHeaderKey(tokens[1])
+	switch r.action {
+	case "add", "replace":
+		if len(tokens) != 3 {
+			return nil, fmt.Errorf("invalid header rule %q: %s needs a value", v, r.action)
+		}
+		r.value = tokens[2]
+	case "remove":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("invalid header rule %q: remove takes no value", v)
+		}
+	default:
+		return nil, fmt.Errorf("unknown header rule action %q: expected add, replace or remove", r.action)
+	}
+	return r, nil
+}
+
+// applyHeaderRules edits header with the rules matching the request for
+// path on host.
+func applyHeaderRules(rules []*headerRule, header http.Header, host, path string) {
+	for _, r := range rules {
+		if !r.matches(host, path) {
+			continue
+		}
+		switch r.action {
+		case "add":
+			header.Add(r.name, r.value)
+		case "replace":
+			header.Set(r.name, r.value)
+		case "remove":
+			header.Del(r.name)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// hopByHopHeaders only concern a single connection, and are not forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// credentialHeaders carry the credentials of clients for the proxy itself:
+// they are never forwarded, nor recorded.
+var credentialHeaders = []string{
+	"Proxy-Authorization",
+}
+
+// clientKey holds the address of the client in the context of resolvers.
+type clientKey struct{}
+
+// headerPolicy is how the headers of the messages the proxy forwards are
+// edited.
+type headerPolicy struct {
+	// forwards the hop-by-hop headers as they were received
+	keepHopByHop bool
+	// what to do with the X-Forwarded-For and Forwarded headers of plain
+	// HTTP requests: keep, append, set or strip
+	forwardedFor string
+	// writes the requests sent to the upstream proxy by hand, keeping their
+	// header in the order it was received in
+	strictUpstream bool
+	// names the proxy in the Via header, which is left alone when empty
+	via string
+	// when set, carries the ID of the plain HTTP requests to their
+	// destination
+	requestIDHeader string
+	// edit the header of plain HTTP requests and of their responses, in
+	// order
+	requestRules  []*headerRule
+	responseRules []*headerRule
+}
+
+// headerConfig reads the header policy.
+func headerConfig(config *viper.Viper) (*headerPolicy, error) {
+	p := &headerPolicy{
+		keepHopByHop:    config.GetBool("keep-hop-by-hop-headers"),
+		forwardedFor:    config.GetString("forwarded-for"),
+		strictUpstream:  config.GetBool("strict-upstream"),
+		via:             config.GetString("via"),
+		requestIDHeader: config.GetString("request-id-header"),
+	}
+	for _, rule := range config.GetStringSlice("request-header") {
+		r, err := parseHeaderRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.requestRules = append(p.requestRules, r)
+	}
+	for _, rule := range config.GetStringSlice("response-header") {
+		r, err := parseHeaderRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.responseRules = append(p.responseRules, r)
+	}
+	return p, nil
+}
+
+// hasToken tells whether one of the comma separated values of a header
+// is token.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrading tells whether header asks to switch to another protocol.
+func upgrading(header http.Header) bool {
+	return header.Get("Upgrade") != "" && hasToken(header["Connection"], "upgrade")
+}
+
+// removeHopByHop removes the hop-by-hop headers from header, along with the
+// ones listed by its Connection header. When upgrade is set, the headers
+// switching the connection to another protocol are kept.
+func (p *headerPolicy) removeHopByHop(header http.Header, upgrade bool) {
+	if p.keepHopByHop {
+		return
+	}
+	upgradeTo := header.Get("Upgrade")
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if upgrade && upgradeTo != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgradeTo)
+	}
+}
+
+// scrubCredentials removes the proxy credentials of the client from header,
+// even when the hop-by-hop headers are kept.
+func scrubCredentials(header http.Header) {
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+}
+
+// isCredential tells whether the header name holds proxy credentials.
+func isCredential(name string) bool {
+	for _, credential := range credentialHeaders {
+		if strings.EqualFold(name, credential) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVia appends the proxy to the Via header of a message received with the
+// protocol version major.minor.
+func (p *headerPolicy) addVia(header http.Header, major, minor int) {
+	if p.via == "" {
+		return
+	}
+	header.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, p.via))
+}
+
+// appendHeader appends value to the comma separated list of a header.
+func appendHeader(header http.Header, name, value string) {
+	if prior := header[name]; len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
+
+// applyForwardedFor updates the X-Forwarded-For and Forwarded headers of a
+// request with the client of ctx, as configured by forwardedFor.
+func (p *headerPolicy) applyForwardedFor(ctx context.Context, header http.Header) {
+	switch p.forwardedFor {
+	case "strip":
+		header.Del("X-Forwarded-For")
+		header.Del("Forwarded")
+	case "append", "set":
+		addr, ok := ctx.Value(clientKey{}).(net.Addr)
+		if !ok {
+			return
+		}
+		ip := addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = fmt.Sprintf(`"[%s]"`, ip)
+		}
+		if p.forwardedFor == "set" {
+			header.Del("X-Forwarded-For")
+			header.Del("Forwarded")
+		}
+		appendHeader(header, "X-Forwarded-For", ip)
+		appendHeader(header, "Forwarded", "for="+node)
+	}
+}
+
+// prepareRequest edits the header of a request about to be forwarded.
+func (p *headerPolicy) prepareRequest(ctx context.Context, req *http.Request) {
+	p.removeHopByHop(req.Header, upgrading(req.Header))
+	scrubCredentials(req.Header)
+	p.addVia(req.Header, req.ProtoMajor, req.ProtoMinor)
+	if req.Method != "CONNECT" {
+		if id := requestID(ctx); p.requestIDHeader != "" && id != "" {
+			req.Header.Set(p.requestIDHeader, id)
+		}
+		p.applyForwardedFor(ctx, req.Header)
+		applyHeaderRules(p.requestRules, req.Header, req.URL.Host, req.URL.RequestURI())
+	}
+}
+
+// prepareResponse edits the header of resp, the response to a request for
+// path on host, about to be relayed. When upgrade is set, the headers
+// switching the connection to another protocol are kept.
+func (p *headerPolicy) prepareResponse(resp *http.Response, host, path string, upgrade bool) {
+	p.removeHopByHop(resp.Header, upgrade)
+	p.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	applyHeaderRules(p.responseRules, resp.Header, host, path)
+}
+
+// expectTrailers makes sure the trailers of a chunked message are forwarded,
+// even when its header did not announce them: they are only known once the
+// body is read, and net/http only writes a Trailer map that exists before.
+func expectTrailers(transferEncoding []string, trailer *http.Header) {
+	if len(transferEncoding) > 0 && transferEncoding[0] == "chunked" && *trailer == nil {
+		*trailer = make(http.Header)
+	}
+}
+
+// headerOrder returns the canonical header names of a raw request head, in
+// the order they first appear in.
+func headerOrder(head []byte) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for i, line := range strings.Split(string(head), "\n") {
+		colon := strings.IndexByte(line, ':')
+		if i == 0 || colon <= 0 {
+			continue
+		}
+		name := http.CanonicalHeaderKey(line[:colon])
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeOrderedHeader writes the fields of header named in order first, in
+// that order, then the other ones as http.Header.Write does.
+func writeOrderedHeader(w io.Writer, header http.Header, order []string) error {
+	rest := header.Clone()
+	for _, name := range order {
+		for _, value := range header[name] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", name, value); err != nil {
+				return err
+			}
+		}
+		delete(rest, name)
+	}
+	return rest.Write(w)
+}
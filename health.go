@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const upstreamCheckInterval = 5 * time.Second
+
+// readiness tells whether the proxy is able to serve new connections: it
+// must not be draining, and its upstream proxy, if any, must be reachable.
+type readiness struct {
+	draining int32
+	upstream string
+	dialer   net.Dialer
+	mtx      sync.Mutex
+	checked  time.Time
+	lastErr  error
+}
+
+func (r *readiness) drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+func (r *readiness) check(ctx context.Context) error {
+	if atomic.LoadInt32(&r.draining) == 1 {
+		return errors.New("draining")
+	}
+	if r.upstream == "" {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// avoid dialing the upstream on each probe
+	if time.Since(r.checked) < upstreamCheckInterval {
+		return r.lastErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	conn, err := r.dialer.DialContext(ctx, "tcp", r.upstream)
+	if err == nil {
+		conn.Close()
+	}
+	r.checked = time.Now()
+	r.lastErr = err
+	return err
+}
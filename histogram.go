@@ -0,0 +1,80 @@
+package main
+
+// histogram counts observations in buckets of increasing upper bounds, and
+// estimates quantiles by interpolating inside those buckets.
+type histogram struct {
+	bounds []float64
+	// counts has an extra bucket for observations above the last bound
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramSummary struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// exponentialBounds returns n bucket bounds, starting at start and growing by
+// factor.
+func exponentialBounds(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for idx := range bounds {
+		bounds[idx] = start
+		start *= factor
+	}
+	return bounds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	idx := 0
+	for idx < len(h.bounds) && v > h.bounds[idx] {
+		idx++
+	}
+	h.counts[idx]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var seen float64
+	for idx, count := range h.counts {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		if idx == len(h.bounds) {
+			return h.bounds[len(h.bounds)-1]
+		}
+		lower := 0.0
+		if idx > 0 {
+			lower = h.bounds[idx-1]
+		}
+		return lower + (h.bounds[idx]-lower)*(rank-seen)/float64(count)
+	}
+	return h.bounds[len(h.bounds)-1]
+}
+
+func (h *histogram) summary() histogramSummary {
+	s := histogramSummary{
+		Count: h.count,
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+	}
+	if h.count > 0 {
+		s.Mean = h.sum / float64(h.count)
+	}
+	return s
+}
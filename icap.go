@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// icapClient has the plain HTTP messages inspected, and possibly modified or
+// blocked, by ICAP services (RFC 3507): requests with REQMOD before they are
+// sent, responses with RESPMOD before they are relayed.
+type icapClient struct {
+	reqmod  *url.URL
+	respmod *url.URL
+	// larger bodies are not sent to the services, and go through as they are
+	maxBody int64
+	timeout time.Duration
+}
+
+// icapConfig reads the ICAP services, and returns nil when there are none.
+func icapConfig(config *viper.Viper) (*icapClient, error) {
+	reqmod, respmod := config.GetString("icap-reqmod"), config.GetString("icap-respmod")
+	if reqmod == "" && respmod == "" {
+		return nil, nil
+	}
+	maxBody, err := parseSize(config.GetString("icap-max-body-size"))
+	if err != nil {
+		return nil, err
+	}
+	c := &icapClient{maxBody: int64(maxBody), timeout: config.GetDuration("icap-timeout")}
+	if reqmod != "" {
+		if c.reqmod, err = parseICAPService(reqmod); err != nil {
+			return nil, err
+		}
+	}
+	if respmod != "" {
+		if c.respmod, err = parseICAPService(respmod); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// parseICAPService parses an icap:// service URL, whose port defaults to
+// 1344.
+func parseICAPService(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ICAP service %q: expected icap://host[:port]/service", v)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	return u, nil
+}
+
+// readBody reads body up to limit bytes. When it is larger, the body to use
+// instead is returned along with ok unset.
+func readBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool, error) {
+	if body == nil || body == http.NoBody {
+		return nil, body, true, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		rest := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+		return nil, rest, false, nil
+	}
+	body.Close()
+	return buf, ioutil.NopCloser(bytes.NewReader(buf)), true, nil
+}
+
+// setBody replaces the body of a message, which is then sent with a
+// Content-Length.
+func setBody(header http.Header, body *io.ReadCloser, contentLength *int64, transferEncoding *[]string, data []byte) {
+	*body = http.NoBody
+	if len(data) > 0 {
+		*body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	*contentLength = int64(len(data))
+	*transferEncoding = nil
+	header.Del("Transfer-Encoding")
+	header.Del("Content-Length")
+	if len(data) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+}
+
+func icapRequestHead(req *http.Request) []byte {
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.String(), req.Proto, req.Host)
+	req.Header.Write(head)
+	head.WriteString("\r\n")
+	return head.Bytes()
+}
+
+func icapResponseHead(resp *http.Response) []byte {
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "HTTP/%d.%d %03d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(head)
+	head.WriteString("\r\n")
+	return head.Bytes()
+}
+
+// icapResult is what an ICAP service answered with, nil when the message is
+// to be left as it is.
+type icapResult struct {
+	request  *http.Request
+	response *http.Response
+	body     []byte
+}
+
+// exchange sends the encapsulated sections to service, and parses its
+// answer.
+func (c *icapClient) exchange(ctx context.Context, method string, service *url.URL, heads [][]byte, headNames []string, body []byte, hasBody bool, req *http.Request) (*icapResult, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", service.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	encapsulated := []string{}
+	offset := 0
+	for i, head := range heads {
+		encapsulated = append(encapsulated, fmt.Sprintf("%s=%d", headNames[i], offset))
+		offset += len(head)
+	}
+	bodyName := "null-body"
+	if hasBody {
+		bodyName = "req-body"
+		if method == "RESPMOD" {
+			bodyName = "res-body"
+		}
+	}
+	encapsulated = append(encapsulated, fmt.Sprintf("%s=%d", bodyName, offset))
+	out := bufio.NewWriter(conn)
+	fmt.Fprintf(out, "%s %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: %s\r\n\r\n",
+		method, service.String(), service.Host, strings.Join(encapsulated, ", "))
+	for _, head := range heads {
+		out.Write(head)
+	}
+	if hasBody {
+		chunks := httputil.NewChunkedWriter(out)
+		chunks.Write(body)
+		chunks.Close()
+		out.WriteString("\r\n")
+	}
+	if err := out.Flush(); err != nil {
+		return nil, err
+	}
+
+	in := bufio.NewReader(conn)
+	reader := textproto.NewReader(in)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return nil, fmt.Errorf("malformed ICAP response %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	switch fields[1] {
+	case "204":
+		return nil, nil
+	case "200":
+	default:
+		return nil, fmt.Errorf("ICAP service %s answered %s", service, strings.Join(fields[1:], " "))
+	}
+	result := &icapResult{}
+	for _, section := range strings.Split(header.Get("Encapsulated"), ",") {
+		name := strings.TrimSpace(strings.SplitN(section, "=", 2)[0])
+		switch name {
+		case "req-hdr":
+			result.request, err = http.ReadRequest(in)
+		case "res-hdr":
+			result.response, err = http.ReadResponse(in, req)
+		case "req-body", "res-body":
+			result.body, err = ioutil.ReadAll(io.LimitReader(httputil.NewChunkedReader(in), c.maxBody))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed ICAP response: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// modifyRequest has req inspected by the REQMOD service. It returns the
+// response to answer the client with instead of forwarding req, if any.
+func (c *icapClient) modifyRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c == nil || c.reqmod == nil {
+		return nil, nil
+	}
+	body, readBack, ok, err := readBody(req.Body, c.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = readBack
+	if !ok {
+		return nil, nil
+	}
+	result, err := c.exchange(ctx, "REQMOD", c.reqmod, [][]byte{icapRequestHead(req)}, []string{"req-hdr"}, body, len(body) > 0, req)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	if result.response != nil {
+		// blocked, the service answered in place of the destination
+		resp := result.response
+		setBody(resp.Header, &resp.Body, &resp.ContentLength, &resp.TransferEncoding, result.body)
+		resp.Close = false
+		return resp, nil
+	}
+	if result.request != nil {
+		// the destination stays the one the request was resolved to
+		req.Method = result.request.Method
+		req.Header = result.request.Header
+		setBody(req.Header, &req.Body, &req.ContentLength, &req.TransferEncoding, result.body)
+		req.Trailer = nil
+	}
+	return nil, nil
+}
+
+// modifyResponse has resp, answering req, inspected by the RESPMOD service,
+// and returns the response to relay in its place.
+func (c *icapClient) modifyResponse(ctx context.Context, req *http.Request, resp *http.Response) (*http.Response, error) {
+	if c == nil || c.respmod == nil {
+		return resp, nil
+	}
+	body, readBack, ok, err := readBody(resp.Body, c.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = readBack
+	if !ok {
+		return resp, nil
+	}
+	heads := [][]byte{icapRequestHead(req), icapResponseHead(resp)}
+	result, err := c.exchange(ctx, "RESPMOD", c.respmod, heads, []string{"req-hdr", "res-hdr"}, body, len(body) > 0, req)
+	if err != nil || result == nil || result.response == nil {
+		return resp, err
+	}
+	modified := result.response
+	setBody(modified.Header, &modified.Body, &modified.ContentLength, &modified.TransferEncoding, result.body)
+	modified.Trailer = nil
+	modified.Close = resp.Close
+	return modified, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// kvConfigVersion is the Consul index, or the etcd revision, of the last
+// config read from a KV store.
+var kvConfigVersion string
+
+// isKVConfig tells whether path is the key of a config stored in Consul, like
+// consul://127.0.0.1:8500/nanoproxy/config.yaml, or in etcd, like
+// etcd://127.0.0.1:2379/nanoproxy/config.yaml.
+func isKVConfig(path string) bool {
+	return strings.HasPrefix(path, "consul://") || strings.HasPrefix(path, "etcd://")
+}
+
+// consulGet reads the value of the key of u from Consul, along with its
+// index. When index is set, the request blocks until the value changes
+// past it, or for wait at most.
+func consulGet(u *url.URL, index string, wait time.Duration) ([]byte, string, error) {
+	query := url.Values{"raw": {""}}
+	if index != "" {
+		query.Set("index", index)
+		query.Set("wait", fmt.Sprintf("%ds", int(wait/time.Second)))
+	}
+	endpoint := url.URL{Scheme: "http", Host: u.Host, Path: "/v1/kv" + u.Path, RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	client := &http.Client{Timeout: wait + 30*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s for %s", resp.Status, u.Path)
+	}
+	return value, resp.Header.Get("X-Consul-Index"), nil
+}
+
+// etcdPost posts the JSON of request to the gRPC gateway of etcd.
+func etcdPost(client *http.Client, u *url.URL, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := url.URL{Scheme: "http", Host: u.Host, Path: path}
+	resp, err := client.Post(endpoint.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from etcd", resp.Status)
+	}
+	return resp, nil
+}
+
+// etcdGet reads the value of the key of u from etcd, along with its
+// revision.
+func etcdGet(u *url.URL) ([]byte, string, error) {
+	key := base64.StdEncoding.EncodeToString([]byte(u.Path))
+	resp, err := etcdPost(&http.Client{Timeout: 30 * time.Second}, u, "/v3/kv/range", map[string]string{"key": key})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		KVs []struct {
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	if len(result.KVs) == 0 {
+		return nil, "", fmt.Errorf("key %s not found", u.Path)
+	}
+	return result.KVs[0].Value, result.KVs[0].ModRevision, nil
+}
+
+// readKVConfig reads the config stored at rawURL into config, unless it did
+// not change since it was last read. Its format is told by the extension of
+// its key, and is YAML otherwise.
+func readKVConfig(config *viper.Viper, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	var value []byte
+	var version string
+	if u.Scheme == "consul" {
+		value, version, err = consulGet(u, "", 0)
+	} else {
+		value, version, err = etcdGet(u)
+	}
+	if err != nil {
+		return err
+	}
+	if version != "" && version == kvConfigVersion {
+		return errConfigUnchanged
+	}
+	if err := readConfigData(config, remoteConfigFormat(u, ""), value); err != nil {
+		return err
+	}
+	kvConfigVersion = version
+	return nil
+}
+
+// watchKVConfig calls changed each time the config stored at rawURL
+// changes: Consul is asked through blocking queries, and etcd through its
+// watch API.
+func watchKVConfig(rawURL string, changed func()) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	watch := watchEtcdKey
+	if u.Scheme == "consul" {
+		watch = watchConsulKey
+	}
+	go func() {
+		for {
+			if err := watch(u, changed); err != nil {
+				warnf("failed to watch %s: %v", rawURL, err)
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func watchConsulKey(u *url.URL, changed func()) error {
+	_, index, err := consulGet(u, "", 0)
+	if err != nil {
+		return err
+	}
+	for {
+		_, next, err := consulGet(u, index, 5*time.Minute)
+		if err != nil {
+			return err
+		}
+		if n, _ := strconv.ParseUint(next, 10, 64); n == 0 {
+			return fmt.Errorf("invalid Consul index %q", next)
+		}
+		if next != index {
+			index = next
+			changed()
+		}
+	}
+}
+
+func watchEtcdKey(u *url.URL, changed func()) error {
+	key := base64.StdEncoding.EncodeToString([]byte(u.Path))
+	resp, err := etcdPost(&http.Client{}, u, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{"key": key},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	events := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := events.Decode(&msg); err != nil {
+			return err
+		}
+		if len(msg.Result.Events) > 0 {
+			changed()
+		}
+	}
+}
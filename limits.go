@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"time"
+)
+
+var rejectedConns = expvar.NewInt("rejected_connections")
+
+// connLimiter bounds the number of connections handled at once. New
+// connections wait for a free slot for up to wait, and are rejected after.
+type connLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func newConnLimiter(max int, wait time.Duration) *connLimiter {
+	return &connLimiter{slots: make(chan struct{}, max), wait: wait}
+}
+
+func (l *connLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.slots
+}
+
+var errHeaderTooLarge = errors.New("request header too large")
+
+// headerLimiter caps the bytes read from a client until its request header
+// is parsed.
+type headerLimiter struct {
+	io.ReadWriter
+	remaining int
+	parsed    bool
+}
+
+func (l *headerLimiter) Read(buf []byte) (int, error) {
+	if l.parsed {
+		return l.ReadWriter.Read(buf)
+	}
+	if l.remaining <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(buf) > l.remaining {
+		buf = buf[:l.remaining]
+	}
+	n, err := l.ReadWriter.Read(buf)
+	l.remaining -= n
+	return n, err
+}
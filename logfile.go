@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is an io.Writer appending to a file, which is rotated once it
+// grows past maxSize bytes or gets older than maxAge. Only the last
+// maxBackups rotated files are kept. A zero limit disables the matching
+// rotation or retention rule.
+type rotatingFile struct {
+	mtx        sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(buf []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.shouldRotate(len(buf)) {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) shouldRotate(next int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+int64(next) > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.openedAt) > r.maxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(r.path, fmt.Sprintf("%s.%s", r.path, time.Now().Format(backupTimeFormat)))
+	if err != nil {
+		return err
+	}
+	err = r.open()
+	if err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+func (r *rotatingFile) prune() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := r.backups()
+	if err != nil {
+		return err
+	}
+	if len(backups) <= r.maxBackups {
+		return nil
+	}
+	// the timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-r.maxBackups] {
+		err = os.Remove(backup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backups returns the paths of the files rotate renamed the file to: those
+// named after it, followed by the time of their rotation.
+func (r *rotatingFile) backups() ([]string, error) {
+	dir, name := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []string{}
+	for _, file := range files {
+		suffix := strings.TrimPrefix(file.Name(), name+".")
+		if suffix == file.Name() || file.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, file.Name()))
+	}
+	return backups, nil
+}
+
+// Reopen closes and reopens the file, so it can be moved away by an external
+// tool like logrotate.
+func (r *rotatingFile) Reopen() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// setupLogs redirects the error log to the configured file and syslog
+// endpoint, and returns the writer the access log must be written to.
+func setupLogs(config *viper.Viper) (io.Writer, error) {
+	var accessLog io.Writer = os.Stdout
+	files := []*rotatingFile{}
+	maxSize := int64(config.GetInt("log-max-size")) * 1000 * 1000
+	maxAge := config.GetDuration("log-max-age")
+	maxBackups := config.GetInt("log-max-backups")
+	if path := config.GetString("error-log"); path != "" {
+		file, err := openRotatingFile(path, maxSize, maxAge, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		log.SetOutput(file)
+		files = append(files, file)
+	}
+	if path := config.GetString("access-log"); path != "" {
+		file, err := openRotatingFile(path, maxSize, maxAge, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		accessLog = file
+		files = append(files, file)
+	}
+	if endpoint := config.GetString("syslog"); endpoint != "" {
+		tlsConfig, err := syslogTLSConfig(config.GetString("syslog-ca"), config.GetString("syslog-server-name"))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialSyslog(endpoint, config.GetString("syslog-facility"), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		log.SetOutput(io.MultiWriter(log.Writer(), &syslogWriter{conn: conn, leveled: true, msgID: "error"}))
+		accessLog = io.MultiWriter(accessLog, &syslogWriter{conn: conn, severity: severityInfo, msgID: "access"})
+	}
+	if len(files) > 0 && reopenSignal != nil {
+		go func() {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, reopenSignal)
+			for range ch {
+				for _, file := range files {
+					err := file.Reopen()
+					if err != nil {
+						errorf("failed to reopen %s: %v", file.path, err)
+					}
+				}
+			}
+		}()
+	}
+	return accessLog, nil
+}
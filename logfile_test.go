@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFilePrune(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		files      []string
+		// the files left once pruned
+		kept []string
+	}{
+		{
+			name:       "oldest backups removed",
+			maxBackups: 2,
+			files: []string{
+				"access.log.2026-01-01T00-00-00.000",
+				"access.log.2026-01-02T00-00-00.000",
+				"access.log.2026-01-03T00-00-00.000",
+			},
+			kept: []string{
+				"access.log.2026-01-02T00-00-00.000",
+				"access.log.2026-01-03T00-00-00.000",
+			},
+		},
+		{
+			name:       "other files left alone",
+			maxBackups: 1,
+			files: []string{
+				"access.log.bak",
+				"access.log.2026-01-01T00-00-00.000.gz",
+				"access.log.old.2026-01-01T00-00-00.000",
+				"error.log.2026-01-01T00-00-00.000",
+				"access.log.2026-01-02T00-00-00.000",
+				"access.log.2026-01-03T00-00-00.000",
+			},
+			kept: []string{
+				"access.log.2026-01-01T00-00-00.000.gz",
+				"access.log.2026-01-03T00-00-00.000",
+				"access.log.bak",
+				"access.log.old.2026-01-01T00-00-00.000",
+				"error.log.2026-01-01T00-00-00.000",
+			},
+		},
+		{
+			name:       "no limit",
+			maxBackups: 0,
+			files: []string{
+				"access.log.2026-01-01T00-00-00.000",
+				"access.log.2026-01-02T00-00-00.000",
+			},
+			kept: []string{
+				"access.log.2026-01-01T00-00-00.000",
+				"access.log.2026-01-02T00-00-00.000",
+			},
+		},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, name := range test.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := &rotatingFile{path: filepath.Join(dir, "access.log"), maxBackups: test.maxBackups}
+		if err := r.prune(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := []string{}
+		for _, file := range files {
+			kept = append(kept, file.Name())
+		}
+		sort.Strings(test.kept)
+		if strings.Join(kept, " ") != strings.Join(test.kept, " ") {
+			t.Errorf("%s: kept %v, expected %v", test.name, kept, test.kept)
+		}
+	}
+}
+
+func TestRotatingFileRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	r, err := openRotatingFile(path, 10, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.file.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "third\n" {
+		t.Errorf("file holds %q, expected %q", data, "third\n")
+	}
+	backups, err := r.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("%d backups kept, expected 1", len(backups))
+	}
+	if data, _ := ioutil.ReadFile(backups[0]); string(data) != "second\n" {
+		t.Errorf("backup holds %q, expected %q", data, "second\n")
+	}
+}
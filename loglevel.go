@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// logLevelPrefixes start the messages of each level.
+var logLevelPrefixes = map[logLevel]string{
+	levelDebug: "DEBUG: ",
+	levelWarn:  "WARN: ",
+	levelError: "ERROR: ",
+}
+
+// minLogLevel is the level of the least severe messages logged, set once at
+// startup.
+var minLogLevel = levelInfo
+
+func parseLogLevel(v string) (logLevel, error) {
+	level, ok := logLevelNames[v]
+	if !ok {
+		return 0, fmt.Errorf("invalid log level %q: expected debug, info, warn or error", v)
+	}
+	return level, nil
+}
+
+// logEnabled tells whether the messages of level are logged.
+func logEnabled(level logLevel) bool {
+	return level >= minLogLevel
+}
+
+func logf(level logLevel, format string, args ...interface{}) {
+	if logEnabled(level) {
+		log.Print(logLevelPrefixes[level] + fmt.Sprintf(format, args...))
+	}
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// sensitiveHeaders have their values redacted wherever headers are logged,
+// along with the ones of --redact-header.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// logRedaction redacts the values of the sensitive headers wherever headers
+// are logged, unless disabled.
+type logRedaction struct {
+	sensitive map[string]bool
+	disabled  bool
+}
+
+// redactionConfig reads the headers to redact.
+func redactionConfig(config *viper.Viper) *logRedaction {
+	r := &logRedaction{sensitive: map[string]bool{}, disabled: config.GetBool("log-sensitive-headers")}
+	for _, name := range append(sensitiveHeaders, config.GetStringSlice("redact-header")...) {
+		r.sensitive[http.CanonicalHeaderKey(name)] = true
+	}
+	return r
+}
+
+// redactHeaderValue returns the value of the header field name to log.
+func (r *logRedaction) redactHeaderValue(name, value string) string {
+	name = http.CanonicalHeaderKey(name)
+	if r.disabled || !r.sensitive[name] {
+		return value
+	}
+	// the authentication scheme helps, the credentials don't
+	if scheme := strings.IndexByte(value, ' '); scheme > 0 && strings.HasSuffix(name, "Authorization") {
+		return value[:scheme+1] + string(redacted)
+	}
+	return string(redacted)
+}
+
+// redactHead returns the raw message head to log, its sensitive values
+// redacted.
+func (r *logRedaction) redactHead(head []byte) []byte {
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	for i, line := range lines {
+		colon := bytes.IndexByte(line, ':')
+		if i == 0 || colon <= 0 {
+			continue
+		}
+		name := string(bytes.TrimSpace(line[:colon]))
+		value := string(bytes.TrimSpace(line[colon+1:]))
+		if redactedValue := r.redactHeaderValue(name, value); redactedValue != value {
+			end := line[len(bytes.TrimRight(line, "\r\n")):]
+			lines[i] = []byte(name + ": " + redactedValue + string(end))
+		}
+	}
+	return bytes.Join(lines, nil)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const memorySampleInterval = 250 * time.Millisecond
+
+var (
+	memoryInUse = expvar.NewInt("memory_in_use_bytes")
+	shedConns   = expvar.NewInt("shed_connections")
+)
+
+// memoryBudget tells when the memory used by buffers, request parsing and
+// connections goes over budget, so new connections can be shed instead of
+// getting the proxy killed.
+type memoryBudget struct {
+	limit uint64
+	inUse uint64
+}
+
+// memoryConfig reads the memory budget, and returns nil when there is none.
+func memoryConfig(config *viper.Viper) (*memoryBudget, error) {
+	budget := config.GetString("memory-budget")
+	if budget == "" {
+		return nil, nil
+	}
+	limit, err := parseSize(budget)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryBudget(uint64(limit)), nil
+}
+
+func newMemoryBudget(limit uint64) *memoryBudget {
+	b := &memoryBudget{limit: limit}
+	b.sample()
+	go func() {
+		over := false
+		for range time.Tick(memorySampleInterval) {
+			b.sample()
+			if b.exceeded() != over {
+				over = !over
+				if over {
+					warnf("memory budget exceeded (%s in use), shedding new connections", humanBytes(atomic.LoadUint64(&b.inUse)))
+				} else {
+					infof("memory back under budget (%s in use)", humanBytes(atomic.LoadUint64(&b.inUse)))
+				}
+			}
+		}
+	}()
+	return b
+}
+
+func (b *memoryBudget) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	inUse := stats.HeapInuse + stats.StackInuse
+	atomic.StoreUint64(&b.inUse, inUse)
+	memoryInUse.Set(int64(inUse))
+}
+
+func (b *memoryBudget) exceeded() bool {
+	return atomic.LoadUint64(&b.inUse) > b.limit
+}
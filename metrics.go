@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+var (
+	acceptedConns   = expvar.NewInt("accepted_connections")
+	activeConns     = expvar.NewInt("active_connections")
+	resolverErrors  = expvar.NewInt("resolver_errors")
+	uploadedBytes   = expvar.NewInt("uploaded_bytes")
+	downloadedBytes = expvar.NewInt("downloaded_bytes")
+)
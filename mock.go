@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var mockedResponses = expvar.NewMap("mocked_responses")
+
+// mockRule answers the plain HTTP requests of a route with a canned
+// response, without dialing their destination.
+type mockRule struct {
+	route
+	spec   string
+	status int
+	header http.Header
+	body   string
+}
+
+// parseMockRule parses rules like
+// "api.example.net/v1/users:status=200:header=Cache-Control=no-cache:body=users.json".
+// The body is read from its file once, and its media type guessed from the
+// extension of the file unless a Content-Type is given.
+func parseMockRule(v string) (*mockRule, error) {
+	tokens := strings.Split(v, ":")
+	if len(tokens) < 2 || tokens[0] == "" {
+		return nil, fmt.Errorf("invalid mock %q: expected route:key=value:...", v)
+	}
+	m := &mockRule{route: parseRoute(tokens[0]), spec: tokens[0], status: http.StatusOK, header: http.Header{}}
+	for _, option := range tokens[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid mock option %q", option)
+		}
+		switch kv[0] {
+		case "status":
+			status, err := strconv.Atoi(kv[1])
+			if err != nil || status < 200 || status > 999 {
+				return nil, fmt.Errorf("invalid mock status %q", kv[1])
+			}
+			m.status = status
+		case "header":
+			field := strings.SplitN(kv[1], "=", 2)
+			if len(field) != 2 || field[0] == "" {
+				return nil, fmt.Errorf("invalid mock header %q: expected Name=value", kv[1])
+			}
+			m.header.Add(field[0], field[1])
+		case "body":
+			body, err := ioutil.ReadFile(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			m.body = string(body)
+			if m.header.Get("Content-Type") == "" {
+				if contentType := mime.TypeByExtension(filepath.Ext(kv[1])); contentType != "" {
+					m.header.Set("Content-Type", contentType)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown mock option %q", kv[0])
+		}
+	}
+	return m, nil
+}
+
+// mockStage answers the plain HTTP requests matching a mock rule with its
+// response. Tunnels are encrypted end to end, and left alone.
+func (h *handler) mockStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	req := r.request
+	rules := h.settings().mocks
+	if req.Method == "CONNECT" || len(rules) == 0 {
+		return next(ctx, r)
+	}
+	host, _, err := net.SplitHostPort(r.address)
+	if err != nil {
+		return next(ctx, r)
+	}
+	for _, m := range rules {
+		if !m.matches(host, req.URL.RequestURI()) {
+			continue
+		}
+		mockedResponses.Add(m.spec, 1)
+		if req.Method == "HEAD" {
+			return nil, answer(r.conn, req, m.status, m.header.Clone())
+		}
+		return nil, answerBody(r.conn, req, m.status, m.header.Clone(), m.body)
+	}
+	return next(ctx, r)
+}
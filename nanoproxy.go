@@ -2,128 +2,296 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/textproto"
+	"net/http"
 	"net/url"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
-
-	"github.com/spf13/viper"
 )
 
-func bidirectionalPipe(ctx context.Context, clientConn io.ReadWriter, upstreamConn io.ReadWriter) {
-	readCh := make(chan struct{})
-	writeCh := make(chan struct{})
+// bidirectionalPipe relays bytes both ways, through buffers, until each
+// direction ends, or one fails. The end of a direction is propagated as a
+// half-close, and the other one is given up to linger to end too: zero waits
+// as long as it takes, and a negative linger closes both right away.
+func bidirectionalPipe(ctx context.Context, clientConn io.ReadWriter, upstreamConn io.ReadWriter, buffers *copyBuffers, linger time.Duration) {
+	readCh := make(chan error, 1)
+	writeCh := make(chan error, 1)
 	go func() {
-		defer close(readCh)
-		io.Copy(upstreamConn, clientConn)
+		readCh <- halfPipe(upstreamConn, clientConn, buffers)
 	}()
 	go func() {
-		defer close(writeCh)
-		io.Copy(clientConn, upstreamConn)
+		writeCh <- halfPipe(clientConn, upstreamConn, buffers)
 	}()
-	select {
-	case <-readCh:
-	case <-writeCh:
-	case <-ctx.Done():
+	var lingering <-chan time.Time
+	pending := 2
+wait:
+	for pending > 0 {
+		select {
+		case err := <-readCh:
+			readCh = nil
+			pending--
+			if err != nil || linger < 0 {
+				break wait
+			}
+		case err := <-writeCh:
+			writeCh = nil
+			pending--
+			if err != nil || linger < 0 {
+				break wait
+			}
+		case <-lingering:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+		if linger > 0 && lingering == nil {
+			timer := time.NewTimer(linger)
+			defer timer.Stop()
+			lingering = timer.C
+		}
+	}
+	// unblock the other direction, and wait for its byte counters to settle
+	for _, conn := range []io.ReadWriter{clientConn, upstreamConn} {
+		if closer, ok := conn.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	if readCh != nil {
+		<-readCh
 	}
+	if writeCh != nil {
+		<-writeCh
+	}
+}
+
+// halfPipe relays src to dst, then half-closes dst.
+func halfPipe(dst io.Writer, src io.Reader, buffers *copyBuffers) error {
+	if err := relay(dst, src, buffers); err != nil {
+		return err
+	}
+	return closeWrite(dst)
 }
 
 type remote struct {
+	// nil for plain requests until dial is called
 	conn   net.Conn
+	dial   func(ctx context.Context) (net.Conn, error)
 	host   string
 	path   string
 	method string
+	// plain HTTP requests are forwarded rather than piped, so that their
+	// upstream connection can go back to the pool once answered
+	request  *http.Request
+	reader   *bufio.Reader
+	pool     *connPool
+	reusable bool
+	// address dialed for request, which the connection is pooled under: it
+	// differs from host when the destination was rerouted
+	address string
+	// set when request is sent in absolute form to an upstream proxy
+	proxied bool
+	// status code of the response, once known
+	status int
+	// with --strict-upstream, the order of the header fields of request
+	headerOrder []string
+	// when recording a session, the entry of request, saved along with
+	// its response
+	session *sessionEntry
 }
 
-type upstreamResolver func(ctx context.Context, conn io.ReadWriter) (upstream *remote, err error)
+// release returns the upstream connection to the pool when it can serve
+// another request, and closes it otherwise.
+func (r *remote) release() {
+	if r.conn == nil {
+		return
+	}
+	if conn, ok := r.conn.(*pooledConn); ok && r.reusable && r.pool != nil {
+		r.pool.put(r.address, conn)
+		return
+	}
+	r.conn.Close()
+}
+
+// connect returns the upstream connection of the plain request of r,
+// dialing it when the request was not answered from the cache.
+func (r *remote) connect(ctx context.Context) (*pooledConn, error) {
+	if r.conn == nil {
+		conn, err := r.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r.conn = newPooledConn(conn)
+	}
+	return r.conn.(*pooledConn), nil
+}
 
-func upstreamProxyResolver(dialer net.Dialer, upstreamURL string) upstreamResolver {
+// upstreamProxyDial sends the requests through the upstream proxy at
+// upstreamURL.
+func (h *handler) upstreamProxyDial(dialer *proxyDialer, warm *warmer, upstreamURL string) resolveFunc {
 	upstream, err := url.Parse(upstreamURL)
 	if err != nil {
 		panic(err)
 	}
-	authString := []byte{}
+	auth := ""
 	if user := upstream.User.String(); user != "" {
-		auth := fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(upstream.User.String())))
-		authString = []byte(fmt.Sprintf("Proxy-Authorization: %s\n", auth))
+		auth = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(upstream.User.String())))
 	}
-	return func(ctx context.Context, conn io.ReadWriter) (*remote, error) {
-		upstreamConn, err := dialer.DialContext(ctx, "tcp", upstream.Host)
-		if err != nil {
-			return nil, err
-		}
-		reader := bufio.NewReader(conn)
-		txtproto := textproto.NewReader(reader)
-		first := true
-		remoteHost := ""
-		method := ""
-		for {
-			buf, err := txtproto.ReadLineBytes()
-			if first {
-				tokens := strings.Split(string(buf), " ")
-				if len(tokens) != 3 {
-					return nil, errors.New("malformed request")
+	return func(ctx context.Context, r *resolution) (*remote, error) {
+		conn, reader, req := r.conn, r.reader, r.request
+		dial := func(ctx context.Context) (net.Conn, error) {
+			dialed := warm.take(upstream.Host)
+			if dialed == nil {
+				var err error
+				dialed, err = dialer.dial(ctx, upstream.Host)
+				if err != nil {
+					countUpstreamError(upstream.Host, "dial")
+					return nil, err
 				}
-				method = tokens[0]
-				remoteHost = tokens[1]
-				first = false
 			}
-			if err != nil {
-				upstreamConn.Close()
-				return nil, err
-			}
-			if len(buf) == 0 {
-				break
-			}
-			_, err = upstreamConn.Write(append(buf, '\n'))
-			if err != nil {
-				upstreamConn.Close()
-				return nil, err
+			if upstream.Scheme == "https" {
+				dialed = tls.Client(dialed, &tls.Config{ServerName: upstream.Hostname()})
 			}
+			return &monitoredConn{Conn: dialed, upstream: upstream.Host}, nil
+		}
+		h.headers.prepareRequest(ctx, req)
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		if req.Method != "CONNECT" {
+			// parsed exchanges keep to the boundaries of the requests and of
+			// their bodies, so that the client can send more
+			return &remote{
+				dial:        dial,
+				host:        req.URL.Host,
+				method:      req.Method,
+				path:        req.URL.RequestURI(),
+				request:     req,
+				reader:      reader,
+				proxied:     true,
+				headerOrder: r.headerOrder,
+			}, nil
+		}
+		upstreamConn, err := dial(ctx)
+		if err != nil {
+			return nil, err
 		}
-		if len(authString) > 0 {
-			upstreamConn.Write(authString)
+		head := &bytes.Buffer{}
+		writeRequestHead(head, req, req.RequestURI, r.headerOrder)
+		// clients may not wait for the response to start talking
+		buffered, _ := reader.Peek(reader.Buffered())
+		head.Write(buffered)
+		if _, err := upstreamConn.Write(head.Bytes()); err != nil {
+			upstreamConn.Close()
+			return nil, &statusError{status: http.StatusBadGateway, err: err}
+		}
+		status, err := relayResponseHead(ctx, conn, upstreamConn, h.redaction)
+		if err != nil {
+			upstreamConn.Close()
+			return nil, err
 		}
-		upstreamConn.Write([]byte{'\n'})
-		txtproto.R.Discard(txtproto.R.Buffered())
 		return &remote{
 			conn:   upstreamConn,
-			host:   remoteHost,
-			method: method,
-			path:   "",
+			host:   req.Host,
+			method: req.Method,
+			status: status,
 		}, nil
 	}
 }
 
-func staticUpstreamResolver(dialer net.Dialer) upstreamResolver {
-	return func(ctx context.Context, conn io.ReadWriter) (*remote, error) {
-		reader := bufio.NewReader(conn)
-		firstLine, err := textproto.NewReader(reader).ReadLine()
-		if err != nil {
-			return nil, err
-		}
-		tokens := strings.Split(firstLine, " ")
-		if len(tokens) != 3 {
-			return nil, errors.New("malformed http request")
+// version is set at build time, with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// defaultPorts are the ports of the schemes plain requests can use.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// destinationAddress returns the host:port address the request for u is to
+// be sent to.
+func destinationAddress(u *url.URL) (string, error) {
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in request URL %q", u.String())
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[strings.ToLower(u.Scheme)]
+		if port == "" {
+			return "", fmt.Errorf("no port for scheme %q of %q", u.Scheme, u.String())
 		}
-		switch tokens[0] {
+	}
+	if err := checkHostPort(u.Hostname(), port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// connectAddress returns the host:port address of the target of a CONNECT
+// request, whose IPv6 literals are bracketed.
+func connectAddress(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid CONNECT target %q: %v", target, err)
+	}
+	if err := checkHostPort(host, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func checkHostPort(host, port string) error {
+	if host == "" {
+		return errors.New("empty destination host")
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid destination port %q", port)
+	}
+	return nil
+}
+
+// directDial sends the requests straight to their destination, reusing the
+// connections of pool when set.
+func (h *handler) directDial(dialer *proxyDialer, warm *warmer, pool *connPool) resolveFunc {
+	return func(ctx context.Context, r *resolution) (*remote, error) {
+		conn, reader, req, host := r.conn, r.reader, r.request, r.address
+		switch req.Method {
 		case "CONNECT":
-			host := tokens[1]
-			upstream, err := dialer.DialContext(ctx, "tcp", host)
-			if err != nil {
-				return nil, err
+			upstream := warm.take(host)
+			if upstream == nil {
+				var err error
+				upstream, err = dialer.dial(ctx, host)
+				if err != nil {
+					return nil, err
+				}
 			}
-			reader.Discard(reader.Buffered())
-			_, err = conn.Write([]byte("HTTP/1.0 200 Connection established\n\n"))
+			// clients may not wait for the response to start talking
+			if buffered, _ := reader.Peek(reader.Buffered()); len(buffered) > 0 {
+				if _, err := upstream.Write(buffered); err != nil {
+					upstream.Close()
+					return nil, err
+				}
+			}
+			_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 			if err != nil {
 				upstream.Close()
 				return nil, err
@@ -131,141 +299,901 @@ func staticUpstreamResolver(dialer net.Dialer) upstreamResolver {
 			return &remote{
 				conn:   upstream,
 				host:   host,
-				method: tokens[1],
+				method: req.Method,
 				path:   "",
+				status: http.StatusOK,
 			}, nil
 		default:
-			remoteURL, err := url.Parse(tokens[1])
-			if err != nil {
-				return nil, err
+			remoteURL := req.URL
+			if req.Method == "OPTIONS" && remoteURL.Path == "" && remoteURL.RawQuery == "" {
+				// asks about the destination server itself
+				remoteURL.Opaque = "*"
 			}
-			port := remoteURL.Port()
-			portNum := 0
-			if port == "" {
-				portNum = 80
+			h.headers.prepareRequest(ctx, req)
+			upstream := &remote{
+				host:    remoteURL.Host,
+				method:  req.Method,
+				path:    remoteURL.RequestURI(),
+				request: req,
+				reader:  reader,
+				pool:    pool,
+				address: host,
+				dial: func(ctx context.Context) (net.Conn, error) {
+					return dialer.dial(ctx, host)
+				},
 			}
-			host := remoteURL.Host
-			if portNum != 0 {
-				host = fmt.Sprintf("%s:%d", remoteURL.Host, portNum)
-			}
-			upstream, err := dialer.DialContext(ctx, "tcp", host)
-			if err != nil {
-				return nil, err
-			}
-			_, err = fmt.Fprintf(upstream, "%s %s %s\r\n", tokens[0], remoteURL.Path, tokens[2])
-			if err != nil {
-				upstream.Close()
-				return nil, err
-			}
-			buf, err := reader.Peek(reader.Buffered())
-			if err != nil {
-				upstream.Close()
-				return nil, err
+			if pool != nil {
+				if pooled := pool.get(host); pooled != nil {
+					upstream.conn = pooled
+				}
 			}
-			upstream.Write(buf)
-			return &remote{
-				conn:   upstream,
-				host:   remoteURL.Host,
-				method: tokens[1],
-				path:   remoteURL.Path,
-			}, nil
+			return upstream, nil
 		}
 	}
 }
 
+// tap tunes the upstream connection of remote, and returns client wrapped to
+// capture the exchange when the capture filter matches it, along with the
+// function ending the capture.
+func (h *handler) tap(ctx context.Context, client io.ReadWriter, remote *remote) (io.ReadWriter, func()) {
+	if tcp, ok := tcpConnOf(remote.conn); ok {
+		if err := h.upstreamSockets.apply(tcp); err != nil {
+			warnf("failed to tune upstream socket: %v", err)
+		}
+	}
+	addr, _ := ctx.Value(clientKey{}).(net.Addr)
+	if h.capture == nil || addr == nil || !h.capture.match(addr, remote.host) {
+		return client, func() {}
+	}
+	pcap, err := h.capture.open(addr, remote.conn.RemoteAddr(), remote.host)
+	if err != nil {
+		warnf("failed to start capture: %v", err)
+		return client, func() {}
+	}
+	return &capturingConn{ReadWriter: client, pcap: pcap}, func() { pcap.Close() }
+}
+
+// notifyFailure notifies the webhooks about the request of c refused or
+// failing to reach its destination with err.
+func (h *handler) notifyFailure(id string, c net.Conn, tag string, err error) {
+	var denied *deniedError
+	var opErr *net.OpError
+	var refused *statusError
+	switch {
+	case errors.As(err, &denied):
+		h.webhooks.notify(notification{
+			Type: denied.kind, Time: time.Now(), ID: id, Client: c.RemoteAddr().String(), Tag: tag,
+			Method: denied.method, Host: denied.host, Status: denied.status, Error: denied.reason,
+		})
+	case errors.As(err, &opErr) && opErr.Op == "dial" && !errors.As(err, &refused):
+		h.webhooks.notify(notification{
+			Type: notifyUpstreamDown, Time: time.Now(), ID: id, Client: c.RemoteAddr().String(), Error: err.Error(),
+		})
+	}
+}
+
+// metricConn counts the bytes of a client connection. Its counters are
+// updated by the relay goroutines, and must be read through snapshot.
 type metricConn struct {
-	conn         net.Conn
-	remote       *remote
-	startedAt    time.Time
+	// first, to be 64-bit aligned for atomic operations
 	writtenBytes uint64
 	readBytes    uint64
+	// in nanoseconds since the epoch, zero until the first byte is sent
+	firstByte int64
+	conn      net.Conn
+	remote    *remote
+	startedAt time.Time
+	// when trackActivity is set, lastActivity holds the time of the last
+	// read or write, in nanoseconds since the epoch
+	trackActivity bool
+	lastActivity  int64
+	// set once the connection is done, in case its removal event is dropped
+	closed int32
+	// ID of the request, or of the tunnel, and the tag its client labeled
+	// it with
+	id  string
+	tag string
+}
+
+func (m *metricConn) touch() {
+	if m.trackActivity {
+		atomic.StoreInt64(&m.lastActivity, time.Now().UnixNano())
+	}
+}
+
+func (m *metricConn) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.lastActivity))
+}
+
+// connSnapshot holds the counters of a metricConn at some point in time.
+type connSnapshot struct {
+	readBytes    uint64
+	writtenBytes uint64
+	firstByteAt  time.Time
+}
+
+func (s connSnapshot) transferred() uint64 {
+	return s.readBytes + s.writtenBytes
+}
+
+func (m *metricConn) snapshot() connSnapshot {
+	s := connSnapshot{
+		readBytes:    atomic.LoadUint64(&m.readBytes),
+		writtenBytes: atomic.LoadUint64(&m.writtenBytes),
+	}
+	if firstByte := atomic.LoadInt64(&m.firstByte); firstByte != 0 {
+		s.firstByteAt = time.Unix(0, firstByte)
+	}
+	return s
+}
+
+// addRead counts n bytes read from the client.
+func (m *metricConn) addRead(n int64) {
+	atomic.AddUint64(&m.readBytes, uint64(n))
+}
+
+func (m *metricConn) addWritten(n int64) {
+	if n > 0 && atomic.LoadInt64(&m.firstByte) == 0 {
+		atomic.CompareAndSwapInt64(&m.firstByte, 0, time.Now().UnixNano())
+	}
+	atomic.AddUint64(&m.writtenBytes, uint64(n))
 }
 
 func (m *metricConn) Write(buf []byte) (int, error) {
 	n, err := m.conn.Write(buf)
-	m.writtenBytes += uint64(n)
+	m.touch()
+	m.addWritten(int64(n))
 	return n, err
 }
+func (m *metricConn) Close() error {
+	return m.conn.Close()
+}
+func (m *metricConn) CloseWrite() error {
+	return closeWrite(m.conn)
+}
 func (m *metricConn) Read(buf []byte) (int, error) {
 	n, err := m.conn.Read(buf)
-	m.readBytes += uint64(n)
+	m.touch()
+	m.addRead(int64(n))
 	return n, err
 }
 
-func runHandler(stats chan event, resolver upstreamResolver, c net.Conn) {
-	start := time.Now()
-	ctx, cancel := context.WithCancel(context.Background())
+type handler struct {
+	stats    chan event
+	resolver upstreamResolver
+	har      *harRecorder
+	capture  *captureFilter
+	webhooks *webhooks
+	records  recordStore
+	audit    *auditLog
+	session  *sessionRecorder
+	// alerts on clients uploading a lot to a destination
+	exfiltration *exfiltrationDetector
+	// connections slower than these thresholds are logged
+	slowSetup time.Duration
+	slowTotal time.Duration
+	limiter   *connLimiter
+	memory    *memoryBudget
+	// tunnels without traffic for this long, or open for longer than
+	// maxLifetime, are closed
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	// how long a tunnel is kept once one of its directions ended
+	linger time.Duration
+	loops  *eventLoops
+	// maximum duration of the request parsing and dial phase
+	resolverTimeout time.Duration
+	// maximum duration and size of the request header
+	headerTimeout time.Duration
+	maxHeaderSize int
+	// follows the redirects of plain HTTP responses on some routes
+	redirects *redirectFollower
+	// stores the cacheable responses of plain HTTP requests
+	cache *responseCache
+	// has plain HTTP messages inspected by ICAP services
+	icap *icapClient
+	// blocks or strips plain HTTP responses by media type
+	types *typeFilter
+	// scans the bodies of plain HTTP responses
+	antivirus *clamdScanner
+	// re-encodes the large images of plain HTTP responses smaller
+	dataSaver       *dataSaver
+	clientSockets   socketOptions
+	upstreamSockets socketOptions
+	// answer the requests the proxy denied or failed to serve
+	pages *errorPages
+	// edits the headers of the forwarded messages
+	headers     *headerPolicy
+	redaction   *logRedaction
+	debug       *debugLog
+	transforms  bodyTransforms
+	compression *compression
+	scripts     *scriptHooks
+	safeSearch  *safeSearch
+	faults      faultRules
+	chaos       chaosSettings
+	// header clients label their requests and tunnels with, for the traffic
+	// to be accounted per label, or "" to ignore it
+	tagHeader string
+	buffers   *copyBuffers
+	// the settings a reload replaces, guarded by settingsMtx
+	settingsMtx sync.RWMutex
+	access      *accessSettings
+	// connections being handled, and how to close them all on shutdown
+	conns    sync.WaitGroup
+	ctx      context.Context
+	closeAll context.CancelFunc
+	// closed once shutting down, for persistent connections to stop
+	stopping <-chan struct{}
+}
+
+func (h *handler) closeWhenIdle(ctx context.Context, cancel context.CancelFunc, local *metricConn) {
+	interval := h.idleTimeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if idle := time.Since(local.idleSince()); idle > h.idleTimeout {
+				infof("closing %s %s: idle for %s", local.remote.method, local.remote.host, humanDuration(idle))
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// serve handles c once a connection slot is available, or rejects it.
+func (h *handler) serve(c net.Conn) {
+	defer h.conns.Done()
+	if h.memory != nil && h.memory.exceeded() {
+		shedConns.Add(1)
+		warnf("rejecting connection from %s: over memory budget", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if h.limiter != nil {
+		if !h.limiter.acquire() {
+			rejectedConns.Add(1)
+			warnf("rejecting connection from %s: too many connections", c.RemoteAddr())
+			c.Close()
+			return
+		}
+		defer h.limiter.release()
+	}
+	h.run(c)
+}
+
+func (h *handler) record(start time.Time, c net.Conn, remote *remote, local *metricConn, err error) {
+	if h.records == nil && h.audit == nil {
+		return
+	}
+	record := newConnRecord(start, c.RemoteAddr(), remote, local, err)
+	if h.records != nil {
+		if err := h.records.save(record); err != nil {
+			errorf("failed to save connection record: %v", err)
+		}
+	}
+	if h.audit != nil {
+		if err := h.audit.save(record); err != nil {
+			errorf("failed to write to the audit log: %v", err)
+		}
+	}
+}
+
+func (h *handler) run(c net.Conn) {
+	ctx, cancel := context.WithCancel(h.ctx)
 	defer cancel()
 	defer c.Close()
-	local := &metricConn{conn: c, startedAt: start}
-	remote, err := resolver(ctx, local)
+	if tcp, ok := c.(*net.TCPConn); ok {
+		if err := h.clientSockets.apply(tcp); err != nil {
+			warnf("failed to tune client socket: %v", err)
+		}
+	}
+	start := time.Now()
+	var recorder *recordingConn
+	if h.har != nil {
+		recorder = &recordingConn{Conn: c}
+		c = recorder
+	}
+	stream := &requestStream{}
+	conn := &bufferedConn{ReadWriter: stream, reader: bufio.NewReader(stream)}
+	for idle := false; ; idle = true {
+		remote, keepAlive := h.serveRequest(ctx, c, stream, conn, idle)
+		if recorder != nil {
+			recorder.served(serverAddress(remote))
+		}
+		if !keepAlive {
+			break
+		}
+	}
+	if recorder != nil {
+		// tunnels stopped the recording, and leave nothing to save
+		if err := h.har.save(recorder, start); err != nil {
+			warnf("failed to save HAR: %v", err)
+		}
+	}
+}
+
+// serveRequest reads the next request of conn, whose bytes go through stream,
+// and serves it. It returns the served remote, if any, and whether the client
+// connection can carry another request. idle is set once the connection
+// already served a request, and has nothing to say when the client closed it
+// instead of sending another one.
+func (h *handler) serveRequest(ctx context.Context, c net.Conn, stream *requestStream, conn *bufferedConn, idle bool) (*remote, bool) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := newRequestID()
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	ctx = context.WithValue(ctx, clientKey{}, c.RemoteAddr())
+	// bytes of this request read ahead while serving the previous one
+	pending := conn.reader.Buffered() > 0
+	resolving := make(chan struct{})
+	go func() {
+		stopping := h.stopping
+		if !idle {
+			stopping = nil
+		}
+		// interrupts the request parsing, the relays watch ctx themselves
+		select {
+		case <-ctx.Done():
+			select {
+			case <-resolving:
+				// the request was served before ctx was canceled
+			default:
+				c.Close()
+			}
+		case <-stopping:
+			// persistent connections are not kept across a shutdown
+			c.Close()
+		case <-resolving:
+		}
+	}()
+	local := &metricConn{id: id, conn: c, startedAt: start, trackActivity: h.idleTimeout > 0}
+	local.touch()
+	phases := &connPhases{}
+	resolverCtx := context.WithValue(ctx, phasesKey{}, phases)
+	var tag string
+	resolverCtx = context.WithValue(resolverCtx, tagKey{}, &tag)
+	if h.resolverTimeout > 0 {
+		var cancelResolver context.CancelFunc
+		resolverCtx, cancelResolver = context.WithTimeout(resolverCtx, h.resolverTimeout)
+		defer cancelResolver()
+		// header reads do not watch the context
+		c.SetDeadline(start.Add(h.resolverTimeout))
+	}
+	if h.headerTimeout > 0 && (h.resolverTimeout <= 0 || h.headerTimeout < h.resolverTimeout) {
+		// clients trickling their request header must not hold the connection
+		c.SetReadDeadline(start.Add(h.headerTimeout))
+	}
+	header := &headerLimiter{ReadWriter: local, remaining: h.maxHeaderSize, parsed: h.maxHeaderSize <= 0}
+	stream.ReadWriter = header
+	remote, err := h.resolver(resolverCtx, conn)
+	header.parsed = true
+	close(resolving)
+	phases.resolved = time.Now()
+	c.SetDeadline(time.Time{})
 	local.remote = remote
+	local.tag = tag
 	if err != nil {
-		log.Printf("WARN: %v", err)
-		return
+		if idle && !pending && local.snapshot().readBytes == 0 {
+			// the client is done with the connection
+			return nil, false
+		}
+		h.notifyFailure(id, c, tag, err)
+		var answered *answeredError
+		if errors.As(err, &answered) {
+			return nil, answered.keepAlive
+		}
+		resolverErrors.Add(1)
+		if status := errorStatus(err); status != 0 {
+			h.pages.writeError(ctx, local, status, err)
+		}
+		emit(h.stats, event{kind: connFailed})
+		h.record(start, c, remote, local, err)
+		warnf("%s: %v", id, err)
+		return nil, false
+	}
+	defer remote.release()
+	if recorder, ok := c.(*recordingConn); ok && remote.method == "CONNECT" {
+		// relay the tunnel straight from the client connection, which can
+		// then be spliced
+		recorder.stop()
+		local.conn = recorder.Conn
+	}
+	var client io.ReadWriter = local
+	if remote.conn != nil {
+		var stopCapture func()
+		client, stopCapture = h.tap(ctx, local, remote)
+		defer stopCapture()
 	}
-	defer remote.conn.Close()
-	stats <- event{kind: connAdded, conn: local}
-	bidirectionalPipe(ctx, local, remote.conn)
-	stats <- event{kind: connRemoved, conn: local}
+	throttled := &throttledConn{ReadWriter: client}
+	access := h.settings()
+	if access.rateLimit > 0 {
+		throttled.upload = append(throttled.upload, newBandwidthBucket(access.rateLimit))
+		throttled.download = append(throttled.download, newBandwidthBucket(access.rateLimit))
+	}
+	if limit := findDestinationLimit(access.destinationLimits, remote.host); limit != nil {
+		if limit.conns != nil && !limit.conns.take(1) {
+			throttledConns.Add(limit.domain, 1)
+			warnf("rejecting %s %s from %s: connection rate exceeded for %s",
+				remote.method, remote.host, c.RemoteAddr(), limit.domain)
+			if remote.request != nil {
+				// tunnels are already established by now
+				h.pages.writeError(ctx, local, http.StatusTooManyRequests, fmt.Errorf("connection rate exceeded for %s", limit.domain))
+			}
+			return nil, false
+		}
+		if limit.upload != nil {
+			throttled.upload = append(throttled.upload, limit.upload)
+			throttled.download = append(throttled.download, limit.download)
+		}
+	}
+	if fault := h.faults.find(remote.host); fault != nil && fault.rate > 0 {
+		injectedFaults.Add("rate", 1)
+		throttled.upload = append(throttled.upload, newBandwidthBucket(fault.rate))
+		throttled.download = append(throttled.download, newBandwidthBucket(fault.rate))
+	}
+	if len(throttled.upload) > 0 {
+		client = throttled
+	}
+	emit(h.stats, event{kind: connAdded, conn: local})
+	activeConns.Add(1)
+	debugf("%s: %s %s%s from %s", id, remote.method, remote.host, remote.path, c.RemoteAddr())
+	h.webhooks.notify(connNotification(notifyConnOpened, local))
+	if h.idleTimeout > 0 {
+		go h.closeWhenIdle(ctx, cancel, local)
+	}
+	if h.maxLifetime > 0 {
+		timer := time.AfterFunc(h.maxLifetime, func() {
+			infof("closing %s %s: open for more than %s", remote.method, remote.host, humanDuration(h.maxLifetime))
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	defer h.chaos.reset(c, fmt.Sprintf("%s: %s %s", id, remote.method, remote.host), cancel)()
+	if remote.request != nil {
+		if err := h.forward(ctx, client, remote); err != nil && ctx.Err() == nil {
+			h.notifyFailure(id, c, tag, err)
+			warnf("%s: failed to forward %s %s: %v", id, remote.method, remote.host, err)
+		}
+		// the bytes of the next request read past the end of this one stay
+		// counted here: counters only go up
+	} else if h.loops == nil || !h.loops.relay(ctx, client, remote.conn, h.linger) {
+		bidirectionalPipe(ctx, client, remote.conn, h.buffers, h.linger)
+	}
+	atomic.StoreInt32(&local.closed, 1)
+	emit(h.stats, event{kind: connRemoved, conn: local})
+	activeConns.Add(-1)
+	h.record(start, c, remote, local, nil)
+	h.checkSlow(local, phases)
+	counters := local.snapshot()
+	uploadedBytes.Add(int64(counters.readBytes))
+	downloadedBytes.Add(int64(counters.writtenBytes))
+	h.exfiltration.closed(local)
+	h.webhooks.notify(connNotification(notifyConnClosed, local))
+	return remote, remote.request != nil && remote.reusable
 }
 
 func main() {
-	config := viper.New()
-	config.SetEnvPrefix("NANOPROXY")
-	config.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	config.AutomaticEnv()
+	config := newConfig()
 
 	root := cobra.Command{
-		Use: "nanoproxy",
+		Use:   "nanoproxy",
+		Short: "minimalist HTTP proxy, supporting upstream proxies and basic auth",
+	}
+	serve := &cobra.Command{
+		Use:   "serve",
+		Short: "run the proxy",
 		PreRun: func(cmd *cobra.Command, args []string) {
 			config.BindEnv()
 		},
 		Run: func(cmd *cobra.Command, _ []string) {
-			listener, err := net.Listen("tcp4", config.GetString("bind"))
+			runServe(cmd, config)
+		},
+	}
+	root.AddCommand(serve)
+	report := &cobra.Command{
+		Use:   "report",
+		Short: "print the top clients and destinations from the connection records",
+		Run: func(cmd *cobra.Command, _ []string) {
+			store, err := openRecordStore(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if store == nil {
+				log.Fatal("--records-file or --records-db is required")
+			}
+			to := time.Now().Add(-config.GetDuration("until"))
+			from := time.Now().Add(-config.GetDuration("since"))
+			records, err := store.query(from, to)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printReport(os.Stdout, records, config.GetInt("limit"))
+		},
+	}
+	report.Flags().Duration("since", 24*time.Hour, "report on connections started since this long ago")
+	report.Flags().Duration("until", 0, "report on connections started until this long ago")
+	report.Flags().Int("limit", 10, "number of clients and destinations to print")
+	config.BindPFlag("since", report.Flags().Lookup("since"))
+	config.BindPFlag("until", report.Flags().Lookup("until"))
+	config.BindPFlag("limit", report.Flags().Lookup("limit"))
+	root.AddCommand(report)
+	replay := &cobra.Command{
+		Use:   "replay FILE.har...",
+		Short: "send the requests recorded in HAR files again through a proxy, and print those answered differently",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runReplay(args, config.GetString("target"), config.GetDuration("replay-timeout")); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	replay.Flags().String("target", "http://127.0.0.1:8888", "proxy to send the recorded requests through")
+	replay.Flags().Duration("replay-timeout", 30*time.Second, "maximum duration of each replayed request")
+	config.BindPFlag("target", replay.Flags().Lookup("target"))
+	config.BindPFlag("replay-timeout", replay.Flags().Lookup("replay-timeout"))
+	root.AddCommand(replay)
+	root.AddCommand(&cobra.Command{
+		Use:   "verify-audit-log FILE",
+		Short: "check that the entries of an audit log were not altered, removed or inserted",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			file, err := os.Open(args[0])
 			if err != nil {
 				log.Fatal(err)
 			}
-			dialer := net.Dialer{KeepAlive: 15 * time.Second}
-			upstreamURL := config.GetString("upstream")
-			var h upstreamResolver
-			if upstreamURL != "" {
-				h = upstreamProxyResolver(dialer, config.GetString("upstream"))
+			defer file.Close()
+			n, last, err := verifyAuditLog(file)
+			if err != nil {
+				log.Fatalf("%s: %v", args[0], err)
+			}
+			fmt.Printf("%s: %d entries, chain intact, last hash %s\n", args[0], n, last)
+		},
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   "check",
+		Short: "validate the settings read from the config file and the environment, and exit with an error status if some are invalid",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			errs := checkSettings(config)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+			if path := config.ConfigFileUsed(); path != "" {
+				fmt.Printf("%s: settings valid\n", path)
 			} else {
-				h = staticUpstreamResolver(dialer)
+				fmt.Println("settings valid")
 			}
-			var tempDelay time.Duration // how long to sleep on accept failure
-
-			log.Printf("proxy listening on %s", listener.Addr().String())
-			stats := runStats()
-			defer close(stats)
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					if ne, ok := err.(net.Error); ok && ne.Temporary() {
-						if tempDelay == 0 {
-							tempDelay = 5 * time.Millisecond
-						} else {
-							tempDelay *= 2
-						}
-						if max := 1 * time.Second; tempDelay > max {
-							tempDelay = max
-						}
-						log.Printf("net/accept error: %v; retrying in %v", err, tempDelay)
-						time.Sleep(tempDelay)
-						continue
-					}
-					panic(err)
-				}
-				go runHandler(stats, h, conn)
+		},
+	})
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "print the counters and the active connections of a running nanoproxy, read from its admin API",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			addr := config.GetString("address")
+			if addr == "" {
+				addr = config.GetString("admin")
+			}
+			if addr == "" {
+				log.Fatal("--address is required, unless admin is set in the config file")
+			}
+			if err := printStats(os.Stdout, newAdminClient(addr, config.GetDuration("stats-timeout"))); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	stats.Flags().String("address", "", "address of the admin API, or path of its unix socket (defaults to the admin setting of the config file)")
+	stats.Flags().Duration("stats-timeout", 10*time.Second, "maximum duration of the queries to the admin API")
+	config.BindPFlag("address", stats.Flags().Lookup("address"))
+	config.BindPFlag("stats-timeout", stats.Flags().Lookup("stats-timeout"))
+	root.AddCommand(stats)
+	initConfig := &cobra.Command{
+		Use:   "init",
+		Short: "write a commented config file, asking about the bind address, the authentication, the upstream proxy and the filtering",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			if err := runInit(os.Stdin, os.Stdout, config.GetString("output"), config.GetBool("force")); err != nil {
+				log.Fatal(err)
 			}
 		},
 	}
-	root.Flags().StringP("bind", "b", "0.0.0.0:8888", "bind to this address")
-	root.Flags().StringP("upstream", "u", "", "forward requests to this proxy server")
-	config.BindPFlag("bind", root.Flags().Lookup("bind"))
-	config.BindPFlag("upstream", root.Flags().Lookup("upstream"))
+	initConfig.Flags().StringP("output", "o", "nanoproxy.yaml", "write the config file at this path")
+	initConfig.Flags().Bool("force", false, "overwrite the config file when it exists")
+	config.BindPFlag("output", initConfig.Flags().Lookup("output"))
+	config.BindPFlag("force", initConfig.Flags().Lookup("force"))
+	root.AddCommand(initConfig)
+	doctor := &cobra.Command{
+		Use:   "doctor",
+		Short: "check that the listen addresses are free, that DNS works, that the upstream proxy accepts the credentials and that the certificates are valid",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			runDoctor(config)
+		},
+	}
+	doctor.Flags().String("probe", "www.google.com", "destination the DNS, the upstream proxy and the certificates are checked against")
+	doctor.Flags().Duration("doctor-timeout", 5*time.Second, "maximum duration of each check")
+	config.BindPFlag("probe", doctor.Flags().Lookup("probe"))
+	config.BindPFlag("doctor-timeout", doctor.Flags().Lookup("doctor-timeout"))
+	root.AddCommand(doctor)
+	root.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "print the version of nanoproxy",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			fmt.Printf("nanoproxy %s (%s)\n", version, runtime.Version())
+		},
+	})
+
+	root.PersistentFlags().String("config", "", "read the settings from this YAML, TOML or JSON file, URL, or Consul or etcd key (like consul://127.0.0.1:8500/nanoproxy.yaml), under the names of the flags, which take precedence over them like the environment")
+	root.PersistentFlags().String("config-public-key", "", "PEM file of the Ed25519 public key the config fetched from a URL must be signed with, its signature being fetched from the same URL with a .sig suffix")
+	root.PersistentFlags().Duration("config-poll-interval", 5*time.Minute, "when the config is fetched from a URL, check it for changes at this interval, and apply them like on SIGHUP (0 to disable)")
+	config.BindPFlag("config", root.PersistentFlags().Lookup("config"))
+	config.BindPFlag("config-public-key", root.PersistentFlags().Lookup("config-public-key"))
+	config.BindPFlag("config-poll-interval", root.PersistentFlags().Lookup("config-poll-interval"))
+	root.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if path := config.GetString("config"); path != "" {
+			if err := readConfigFile(config, serve, path); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	root.PersistentFlags().String("records-file", "", "persist a record of each connection in this file")
+	root.PersistentFlags().String("records-db", "", "persist a record of each connection in this SQLite database")
+	root.PersistentFlags().Duration("records-retention", 30*24*time.Hour, "prune the connection records of the SQLite database older than this duration (0 to keep them all)")
+	config.BindPFlag("records-file", root.PersistentFlags().Lookup("records-file"))
+	config.BindPFlag("records-db", root.PersistentFlags().Lookup("records-db"))
+	config.BindPFlag("records-retention", root.PersistentFlags().Lookup("records-retention"))
+	serve.Flags().StringP("bind", "b", "0.0.0.0:8888", "bind to this address")
+	serve.Flags().StringP("upstream", "u", "", "forward requests to this proxy server")
+	serve.Flags().Bool("upstream-h2", false, "carry CONNECT tunnels as streams of HTTP/2 connections to the upstream proxy, which must be an https:// URL")
+	serve.Flags().Bool("strict-upstream", false, "write the requests sent to the upstream proxy by hand, keeping the order of their header fields")
+	serve.Flags().String("admin", "", "serve the admin API on this address, or on the unix socket at this path")
+	serve.Flags().Bool("top", false, "display a live dashboard of active connections instead of logging them")
+	serve.Flags().Duration("summary-interval", 0, "log a summary of the proxy activity at this interval (0 to disable)")
+	serve.Flags().Int("max-conns", 0, "maximum number of connections handled at once (0 for unlimited)")
+	serve.Flags().Duration("max-conns-wait", 0, "how long a connection waits for a free slot before being rejected, when --max-conns is reached")
+	serve.Flags().Duration("dial-timeout", 10*time.Second, "maximum duration of a connection attempt to a destination or upstream proxy (0 to disable)")
+	serve.Flags().Duration("dns-cache-ttl", 0, "cache resolved hostnames for this long, and refresh the popular ones before they expire (0 to disable)")
+	serve.Flags().Duration("resolver-timeout", 30*time.Second, "maximum duration for a client to send its request and for its destination to be reached (0 to disable)")
+	serve.Flags().Duration("header-timeout", 10*time.Second, "maximum duration for a client to send its request header (0 to disable)")
+	serve.Flags().Int("max-header-size", 1<<20, "maximum size of a request header, in bytes (0 to disable)")
+	serve.Flags().Duration("keepalive", 15*time.Second, "interval between TCP keep-alive probes on outgoing connections (negative to disable)")
+	serve.Flags().Bool("client-nodelay", true, "disable Nagle's algorithm on client connections")
+	serve.Flags().String("client-send-buffer", "", "size of the socket send buffer of client connections (like 256k, system default if empty)")
+	serve.Flags().String("client-recv-buffer", "", "size of the socket receive buffer of client connections (like 256k, system default if empty)")
+	serve.Flags().Duration("client-keepalive", 15*time.Second, "interval between TCP keep-alive probes on client connections (negative to disable)")
+	serve.Flags().Duration("client-user-timeout", 0, "drop client connections whose sent data stays unacknowledged for this long (Linux only, 0 to disable)")
+	serve.Flags().Bool("upstream-nodelay", true, "disable Nagle's algorithm on outgoing connections")
+	serve.Flags().String("upstream-send-buffer", "", "size of the socket send buffer of outgoing connections (like 256k, system default if empty)")
+	serve.Flags().String("upstream-recv-buffer", "", "size of the socket receive buffer of outgoing connections (like 256k, system default if empty)")
+	serve.Flags().Duration("upstream-user-timeout", 0, "drop outgoing connections whose sent data stays unacknowledged for this long (Linux only, 0 to disable)")
+	serve.Flags().Int("prewarm", 0, "connections kept established ahead of time to each of the most requested CONNECT destinations, or to the upstream proxy (0 to disable)")
+	serve.Flags().Int("prewarm-destinations", 10, "number of destinations to keep connections established to")
+	serve.Flags().Duration("prewarm-max-age", 10*time.Second, "close connections established ahead of time and unused for this long")
+	serve.Flags().Int("pool-size", 2, "idle connections kept per destination for plain HTTP requests (0 to disable)")
+	serve.Flags().Duration("pool-idle-timeout", 90*time.Second, "close pooled connections idle for this long (0 to disable)")
+	serve.Flags().Bool("keep-hop-by-hop-headers", false, "forward the hop-by-hop headers, like Connection or Keep-Alive, instead of removing them")
+	serve.Flags().Bool("safe-search", false, "send the requests to Google, Bing and DuckDuckGo to their SafeSearch hosts, and the ones to YouTube to its restricted mode")
+	serve.Flags().String("youtube-restrict", "moderate", "restricted mode enforced on YouTube by --safe-search, strict or moderate")
+	serve.Flags().String("forwarded-for", "keep", "what to do with the X-Forwarded-For and Forwarded headers of plain HTTP requests: keep them, append the client address, set them to it, or strip them")
+	serve.Flags().String("request-id-header", "", "send the ID of each plain HTTP request to its destination in this header, like X-Request-Id")
+	serve.Flags().String("tag-header", "X-Nanoproxy-Tag", "header clients label their traffic with, for it to be accounted per label; it is removed from the forwarded requests, and past 100 distinct labels the new ones are accounted together as (other) (empty to disable)")
+	serve.Flags().Float64("debug-sample-rate", 0, "log the complete header of this share of the requests and of their responses, between 0 and 1, with their credentials redacted")
+	serve.Flags().StringSlice("debug-route", nil, "also log the complete header of the requests on these routes, like example.net/api, and of their responses")
+	serve.Flags().StringSlice("redact-header", nil, "also redact these headers from the logs, along with Authorization, Proxy-Authorization, Cookie, Set-Cookie, X-Api-Key and X-Auth-Token")
+	serve.Flags().Bool("log-sensitive-headers", false, "log the values of the sensitive headers instead of redacting them")
+	serve.Flags().String("via", "nanoproxy", "name of the proxy in the Via header added to forwarded requests and responses (empty to disable)")
+	serve.Flags().Bool("hardened", false, "apply safe defaults for a proxy exposed to the internet: block local destinations, only allow ports 80 and 443, and shorten the header limits and timeouts, unless set otherwise; --auth is then required")
+	serve.Flags().StringSlice("auth", nil, "require clients to authenticate as one of these user:password credentials")
+	serve.Flags().StringSlice("allowed-ports", nil, "only allow destinations on these ports (all ports if empty)")
+	serve.Flags().Bool("block-local-destinations", false, "refuse destinations on loopback, private and link-local addresses")
+	serve.Flags().String("error-page", "", "answer the denied and failed requests with this HTML template, given the .Status, .StatusText, .Title, .Reason and .Contact of the error")
+	serve.Flags().String("error-contact", "", "contact info given by the error and block pages, like an email address")
+	serve.Flags().StringSlice("rewrite", nil, "rewrite the URL of plain HTTP requests matching a regular expression, the first matching rule applying (like '^http://old.example.net/(.*) http://new.example.net/v2/$1')")
+	serve.Flags().String("cache-size", "", "cache the responses of plain HTTP requests, up to this size (like 256MB)")
+	serve.Flags().String("cache-dir", "", "store the cached responses in this directory rather than in memory, to keep them across restarts")
+	serve.Flags().String("cache-max-object-size", "8MB", "largest response body stored in the cache")
+	serve.Flags().StringSlice("follow-redirects", nil, "follow the redirects of plain HTTP responses on these routes, up to 5 hops or the given number, and answer with the final response (like example.net/downloads or /:hops=3 for all requests)")
+	serve.Flags().StringSlice("request-header", nil, "edit the header of plain HTTP requests, optionally toward a domain or a route only (like remove:DNT, replace:User-Agent:nanoproxy or api.example.net/v2=add:X-Token:secret)")
+	serve.Flags().StringSlice("response-header", nil, "edit the header of plain HTTP responses, optionally from a domain or a route only (like remove:Server, add:X-Frame-Options:DENY or example.net=replace:Cache-Control:no-store)")
+	serve.Flags().String("icap-reqmod", "", "have plain HTTP requests inspected, modified or blocked by this ICAP REQMOD service (like icap://scanner.example.net/reqmod)")
+	serve.Flags().String("icap-respmod", "", "have plain HTTP responses inspected, modified or blocked by this ICAP RESPMOD service (like icap://scanner.example.net/respmod)")
+	serve.Flags().String("icap-max-body-size", "10MB", "largest body sent to the ICAP services, larger ones going through uninspected")
+	serve.Flags().Duration("icap-timeout", 30*time.Second, "maximum duration of an exchange with an ICAP service")
+	serve.Flags().String("script", "", "run the on_request, on_route and on_response hooks of this Lua script for each request")
+	serve.Flags().StringSlice("inject-banner", nil, "insert the HTML of a file after the opening body tag of the uncompressed HTML pages, optionally of a domain or a route only (like banner.html or intranet.example.net=banner.html)")
+	serve.Flags().StringSlice("redact", nil, "replace the matches of these regular expressions with [REDACTED] in the uncompressed textual responses, line by line")
+	serve.Flags().Bool("compress", false, "compress the textual plain HTTP responses their origin did not compress, with brotli or gzip, for the clients accepting it")
+	serve.Flags().String("compress-min-size", "1KB", "smallest response body compressed by --compress")
+	serve.Flags().Bool("data-saver", false, "re-encode the large JPEG and PNG images of plain HTTP responses smaller, for slow or metered links")
+	serve.Flags().String("data-saver-min-size", "32KB", "smallest image re-encoded by --data-saver")
+	serve.Flags().String("data-saver-max-size", "8MB", "largest image re-encoded by --data-saver")
+	serve.Flags().Int("data-saver-quality", 50, "quality of the JPEG images re-encoded by --data-saver, from 1 to 100")
+	serve.Flags().Int("data-saver-max-dimension", 1280, "shrink the images re-encoded by --data-saver to fit in a square of this many pixels (0 to keep their size)")
+	serve.Flags().StringSlice("block-type", nil, "replace the plain HTTP responses of these media types, or top-level types like video/*, with a block page")
+	serve.Flags().StringSlice("strip-type", nil, "answer the plain HTTP requests whose response is of these media types with an empty 204 response")
+	serve.Flags().StringSlice("allow-type", nil, "media types let through with --type-policy deny")
+	serve.Flags().String("type-policy", "allow", "whether the media types not blocked are allowed (allow), or the ones not allowed blocked (deny)")
+	serve.Flags().String("clamd", "", "scan the bodies of plain HTTP responses with clamd, listening on this socket path or host:port, and replace the infected ones with a block page")
+	serve.Flags().String("clamd-max-size", "25MB", "largest response body scanned by clamd, larger ones going through unscanned")
+	serve.Flags().Duration("clamd-timeout", 30*time.Second, "maximum duration of a clamd scan")
+	serve.Flags().String("rate-limit", "", "cap the bandwidth of each direction of a tunnel to this many bytes per second (like 5MB)")
+	serve.Flags().StringSlice("destination-limit", nil, "limit the connections per second and the shared bandwidth toward a domain, optionally between some hours (like backup.example.net:conns=5:rate=1MB:hours=9-18)")
+	serve.Flags().StringSlice("fault", nil, "degrade the requests to a domain, or to any destination with *, to test how clients cope: delay them, fail a share of them with a 502, and cap the bandwidth of each (like api.example.net:latency=2s:error=0.1:rate=10KB)")
+	serve.Flags().Float64("chaos-error", 0, "fail this share of the requests with a 502, between 0 and 1, for chaos experiments")
+	serve.Flags().Float64("chaos-reset", 0, "reset this share of the connections mid-transfer, between 0 and 1, for chaos experiments")
+	serve.Flags().Duration("chaos-reset-within", 5*time.Second, "reset the connections picked by --chaos-reset at a random point within this duration")
+	serve.Flags().StringSlice("mock", nil, "answer the plain HTTP requests on a route with a canned response instead of forwarding them, to stub APIs in test environments (like api.example.net/v1/users:status=200:header=Cache-Control=no-cache:body=users.json)")
+	serve.Flags().Duration("idle-timeout", 0, "close tunnels without traffic for this long (0 to disable)")
+	serve.Flags().String("handoff-socket", "", "hand the listener over to a new nanoproxy process started with the same socket path, for restarts without downtime")
+	serve.Flags().Duration("grace-period", 30*time.Second, "on SIGINT or SIGTERM, how long to wait for active connections to finish before closing them")
+	serve.Flags().Duration("max-lifetime", 0, "close tunnels open for longer than this duration, like 12h (0 to disable)")
+	serve.Flags().Duration("linger", 0, "once a direction of a tunnel ended, how long to wait for the other one before closing (0 to wait until it ends, negative to close right away)")
+	serve.Flags().String("memory-budget", "", "reject new connections while the proxy uses more memory than this (like 512MB)")
+	serve.Flags().String("copy-buffer-size", "32k", "size of the buffer of each direction of a tunnel, larger for fat pipes, smaller for many idle tunnels")
+	serve.Flags().Int("event-loops", 0, "relay the tunnels between plain TCP connections with this many epoll loops rather than two goroutines each (Linux only, 0 to disable)")
+	serve.Flags().Int("workers", 0, "handle connections with this many workers, and stop accepting new ones while they are all busy (0 to start a goroutine per connection)")
+	serve.Flags().Duration("slow-setup-threshold", 0, "log connections taking longer than this duration to reach their destination (0 to disable)")
+	serve.Flags().Duration("slow-threshold", 0, "log connections lasting longer than this duration (0 to disable)")
+	serve.Flags().String("log-level", "info", "log the messages of this level and above: debug, info (along with a line per connection), warn or error")
+	serve.Flags().BoolP("quiet", "q", false, "only log warnings and errors, without a line per connection, like --log-level warn")
+	serve.Flags().String("access-log", "", "write the access log to this file instead of stdout")
+	serve.Flags().String("error-log", "", "write the error log to this file instead of stderr")
+	serve.Flags().Int("log-max-size", 100, "rotate log files once they reach this size, in megabytes (0 to disable)")
+	serve.Flags().Duration("log-max-age", 0, "rotate log files once they get older than this duration (0 to disable)")
+	serve.Flags().Int("log-max-backups", 7, "number of rotated log files to keep (0 to keep all)")
+	serve.Flags().String("syslog", "", "also send logs to this syslog endpoint (udp://, tcp://, tls:// or unix:// URL)")
+	serve.Flags().String("syslog-facility", "daemon", "syslog facility to log with")
+	serve.Flags().String("syslog-ca", "", "PEM file of the CA certificates to check the certificate of a tls:// syslog endpoint against, instead of the system ones")
+	serve.Flags().String("syslog-server-name", "", "name the certificate of a tls:// syslog endpoint must be issued for, instead of its host")
+	serve.Flags().String("har-dir", "", "record plain HTTP exchanges as HAR files in this directory")
+	serve.Flags().Int("har-max-body", 0, "include up to this many bytes of each body in HAR files")
+	serve.Flags().String("record-session", "", "record where the requests were routed, and the responses to the plain HTTP ones, to this file, for --replay-session")
+	serve.Flags().String("replay-session", "", "answer the requests with the responses recorded by --record-session in this file, without dialing anything, for reproducible test runs")
+	serve.Flags().String("capture-dir", "", "write the tunneled bytes of matching connections as pcap-ng files in this directory")
+	serve.Flags().StringSlice("capture-host", nil, "only capture connections to these destination hosts or domains")
+	serve.Flags().StringSlice("capture-client", nil, "only capture connections from these client addresses or networks")
+	serve.Flags().String("audit-log", "", "append a record of each connection to this file, each entry hashing the previous one, for verify-audit-log to prove the log was not altered")
+	serve.Flags().StringSlice("webhook", nil, "post connection events to these URLs")
+	serve.Flags().Int("webhook-batch-size", 50, "maximum number of events posted at once to webhooks")
+	serve.Flags().Duration("webhook-flush-interval", 5*time.Second, "maximum delay before pending events are posted to webhooks")
+	serve.Flags().Int("webhook-retries", 3, "number of times a failed webhook post is retried")
+	serve.Flags().String("exfiltration-threshold", "", "alert, in the logs and through webhooks, when a client uploads more than this to an external destination within --exfiltration-window (like 500MB)")
+	serve.Flags().Duration("exfiltration-window", time.Hour, "window over which the uploads are compared to --exfiltration-threshold")
+	config.BindPFlag("bind", serve.Flags().Lookup("bind"))
+	config.BindPFlag("upstream", serve.Flags().Lookup("upstream"))
+	config.BindPFlag("upstream-h2", serve.Flags().Lookup("upstream-h2"))
+	config.BindPFlag("strict-upstream", serve.Flags().Lookup("strict-upstream"))
+	config.BindPFlag("admin", serve.Flags().Lookup("admin"))
+	config.BindPFlag("top", serve.Flags().Lookup("top"))
+	config.BindPFlag("summary-interval", serve.Flags().Lookup("summary-interval"))
+	config.BindPFlag("max-conns", serve.Flags().Lookup("max-conns"))
+	config.BindPFlag("max-conns-wait", serve.Flags().Lookup("max-conns-wait"))
+	config.BindPFlag("dial-timeout", serve.Flags().Lookup("dial-timeout"))
+	config.BindPFlag("dns-cache-ttl", serve.Flags().Lookup("dns-cache-ttl"))
+	config.BindPFlag("resolver-timeout", serve.Flags().Lookup("resolver-timeout"))
+	config.BindPFlag("header-timeout", serve.Flags().Lookup("header-timeout"))
+	config.BindPFlag("max-header-size", serve.Flags().Lookup("max-header-size"))
+	config.BindPFlag("keepalive", serve.Flags().Lookup("keepalive"))
+	config.BindPFlag("client-nodelay", serve.Flags().Lookup("client-nodelay"))
+	config.BindPFlag("client-send-buffer", serve.Flags().Lookup("client-send-buffer"))
+	config.BindPFlag("client-recv-buffer", serve.Flags().Lookup("client-recv-buffer"))
+	config.BindPFlag("client-keepalive", serve.Flags().Lookup("client-keepalive"))
+	config.BindPFlag("client-user-timeout", serve.Flags().Lookup("client-user-timeout"))
+	config.BindPFlag("upstream-nodelay", serve.Flags().Lookup("upstream-nodelay"))
+	config.BindPFlag("upstream-send-buffer", serve.Flags().Lookup("upstream-send-buffer"))
+	config.BindPFlag("upstream-recv-buffer", serve.Flags().Lookup("upstream-recv-buffer"))
+	config.BindPFlag("upstream-user-timeout", serve.Flags().Lookup("upstream-user-timeout"))
+	config.BindPFlag("prewarm", serve.Flags().Lookup("prewarm"))
+	config.BindPFlag("prewarm-destinations", serve.Flags().Lookup("prewarm-destinations"))
+	config.BindPFlag("prewarm-max-age", serve.Flags().Lookup("prewarm-max-age"))
+	config.BindPFlag("pool-size", serve.Flags().Lookup("pool-size"))
+	config.BindPFlag("pool-idle-timeout", serve.Flags().Lookup("pool-idle-timeout"))
+	config.BindPFlag("keep-hop-by-hop-headers", serve.Flags().Lookup("keep-hop-by-hop-headers"))
+	config.BindPFlag("safe-search", serve.Flags().Lookup("safe-search"))
+	config.BindPFlag("youtube-restrict", serve.Flags().Lookup("youtube-restrict"))
+	config.BindPFlag("forwarded-for", serve.Flags().Lookup("forwarded-for"))
+	config.BindPFlag("request-id-header", serve.Flags().Lookup("request-id-header"))
+	config.BindPFlag("tag-header", serve.Flags().Lookup("tag-header"))
+	config.BindPFlag("debug-sample-rate", serve.Flags().Lookup("debug-sample-rate"))
+	config.BindPFlag("debug-route", serve.Flags().Lookup("debug-route"))
+	config.BindPFlag("redact-header", serve.Flags().Lookup("redact-header"))
+	config.BindPFlag("log-sensitive-headers", serve.Flags().Lookup("log-sensitive-headers"))
+	config.BindPFlag("via", serve.Flags().Lookup("via"))
+	config.BindPFlag("hardened", serve.Flags().Lookup("hardened"))
+	config.BindPFlag("auth", serve.Flags().Lookup("auth"))
+	config.BindPFlag("allowed-ports", serve.Flags().Lookup("allowed-ports"))
+	config.BindPFlag("block-local-destinations", serve.Flags().Lookup("block-local-destinations"))
+	config.BindPFlag("error-page", serve.Flags().Lookup("error-page"))
+	config.BindPFlag("error-contact", serve.Flags().Lookup("error-contact"))
+	config.BindPFlag("rewrite", serve.Flags().Lookup("rewrite"))
+	config.BindPFlag("cache-size", serve.Flags().Lookup("cache-size"))
+	config.BindPFlag("cache-dir", serve.Flags().Lookup("cache-dir"))
+	config.BindPFlag("cache-max-object-size", serve.Flags().Lookup("cache-max-object-size"))
+	config.BindPFlag("follow-redirects", serve.Flags().Lookup("follow-redirects"))
+	config.BindPFlag("request-header", serve.Flags().Lookup("request-header"))
+	config.BindPFlag("response-header", serve.Flags().Lookup("response-header"))
+	config.BindPFlag("icap-reqmod", serve.Flags().Lookup("icap-reqmod"))
+	config.BindPFlag("icap-respmod", serve.Flags().Lookup("icap-respmod"))
+	config.BindPFlag("icap-max-body-size", serve.Flags().Lookup("icap-max-body-size"))
+	config.BindPFlag("icap-timeout", serve.Flags().Lookup("icap-timeout"))
+	config.BindPFlag("script", serve.Flags().Lookup("script"))
+	config.BindPFlag("inject-banner", serve.Flags().Lookup("inject-banner"))
+	config.BindPFlag("redact", serve.Flags().Lookup("redact"))
+	config.BindPFlag("compress", serve.Flags().Lookup("compress"))
+	config.BindPFlag("compress-min-size", serve.Flags().Lookup("compress-min-size"))
+	config.BindPFlag("data-saver", serve.Flags().Lookup("data-saver"))
+	config.BindPFlag("data-saver-min-size", serve.Flags().Lookup("data-saver-min-size"))
+	config.BindPFlag("data-saver-max-size", serve.Flags().Lookup("data-saver-max-size"))
+	config.BindPFlag("data-saver-quality", serve.Flags().Lookup("data-saver-quality"))
+	config.BindPFlag("data-saver-max-dimension", serve.Flags().Lookup("data-saver-max-dimension"))
+	config.BindPFlag("block-type", serve.Flags().Lookup("block-type"))
+	config.BindPFlag("strip-type", serve.Flags().Lookup("strip-type"))
+	config.BindPFlag("allow-type", serve.Flags().Lookup("allow-type"))
+	config.BindPFlag("type-policy", serve.Flags().Lookup("type-policy"))
+	config.BindPFlag("clamd", serve.Flags().Lookup("clamd"))
+	config.BindPFlag("clamd-max-size", serve.Flags().Lookup("clamd-max-size"))
+	config.BindPFlag("clamd-timeout", serve.Flags().Lookup("clamd-timeout"))
+	config.BindPFlag("rate-limit", serve.Flags().Lookup("rate-limit"))
+	config.BindPFlag("destination-limit", serve.Flags().Lookup("destination-limit"))
+	config.BindPFlag("fault", serve.Flags().Lookup("fault"))
+	config.BindPFlag("chaos-error", serve.Flags().Lookup("chaos-error"))
+	config.BindPFlag("chaos-reset", serve.Flags().Lookup("chaos-reset"))
+	config.BindPFlag("chaos-reset-within", serve.Flags().Lookup("chaos-reset-within"))
+	config.BindPFlag("mock", serve.Flags().Lookup("mock"))
+	config.BindPFlag("idle-timeout", serve.Flags().Lookup("idle-timeout"))
+	config.BindPFlag("handoff-socket", serve.Flags().Lookup("handoff-socket"))
+	config.BindPFlag("grace-period", serve.Flags().Lookup("grace-period"))
+	config.BindPFlag("max-lifetime", serve.Flags().Lookup("max-lifetime"))
+	config.BindPFlag("linger", serve.Flags().Lookup("linger"))
+	config.BindPFlag("memory-budget", serve.Flags().Lookup("memory-budget"))
+	config.BindPFlag("copy-buffer-size", serve.Flags().Lookup("copy-buffer-size"))
+	config.BindPFlag("event-loops", serve.Flags().Lookup("event-loops"))
+	config.BindPFlag("workers", serve.Flags().Lookup("workers"))
+	config.BindPFlag("slow-setup-threshold", serve.Flags().Lookup("slow-setup-threshold"))
+	config.BindPFlag("slow-threshold", serve.Flags().Lookup("slow-threshold"))
+	config.BindPFlag("log-level", serve.Flags().Lookup("log-level"))
+	config.BindPFlag("quiet", serve.Flags().Lookup("quiet"))
+	config.BindPFlag("access-log", serve.Flags().Lookup("access-log"))
+	config.BindPFlag("error-log", serve.Flags().Lookup("error-log"))
+	config.BindPFlag("log-max-size", serve.Flags().Lookup("log-max-size"))
+	config.BindPFlag("log-max-age", serve.Flags().Lookup("log-max-age"))
+	config.BindPFlag("log-max-backups", serve.Flags().Lookup("log-max-backups"))
+	config.BindPFlag("syslog", serve.Flags().Lookup("syslog"))
+	config.BindPFlag("syslog-facility", serve.Flags().Lookup("syslog-facility"))
+	config.BindPFlag("syslog-ca", serve.Flags().Lookup("syslog-ca"))
+	config.BindPFlag("syslog-server-name", serve.Flags().Lookup("syslog-server-name"))
+	config.BindPFlag("har-dir", serve.Flags().Lookup("har-dir"))
+	config.BindPFlag("har-max-body", serve.Flags().Lookup("har-max-body"))
+	config.BindPFlag("record-session", serve.Flags().Lookup("record-session"))
+	config.BindPFlag("replay-session", serve.Flags().Lookup("replay-session"))
+	config.BindPFlag("capture-dir", serve.Flags().Lookup("capture-dir"))
+	config.BindPFlag("capture-host", serve.Flags().Lookup("capture-host"))
+	config.BindPFlag("capture-client", serve.Flags().Lookup("capture-client"))
+	config.BindPFlag("audit-log", serve.Flags().Lookup("audit-log"))
+	config.BindPFlag("webhook", serve.Flags().Lookup("webhook"))
+	config.BindPFlag("webhook-batch-size", serve.Flags().Lookup("webhook-batch-size"))
+	config.BindPFlag("webhook-flush-interval", serve.Flags().Lookup("webhook-flush-interval"))
+	config.BindPFlag("webhook-retries", serve.Flags().Lookup("webhook-retries"))
+	config.BindPFlag("exfiltration-threshold", serve.Flags().Lookup("exfiltration-threshold"))
+	config.BindPFlag("exfiltration-window", serve.Flags().Lookup("exfiltration-window"))
 	config.AutomaticEnv()
+	if len(os.Args) == 1 || (strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "--help") {
+		// nanoproxy used to serve without a subcommand
+		root.SetArgs(append([]string{"serve"}, os.Args[1:]...))
+	}
 	err := root.Execute()
 	if err != nil {
 		log.Fatal(err)
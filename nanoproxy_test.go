@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestConnectAddress(t *testing.T) {
+	tests := []struct {
+		target  string
+		address string
+		invalid bool
+	}{
+		{target: "example.com:443", address: "example.com:443"},
+		{target: "192.0.2.1:8443", address: "192.0.2.1:8443"},
+		{target: "[2001:db8::1]:443", address: "[2001:db8::1]:443"},
+		{target: "[::1]:22", address: "[::1]:22"},
+		{target: "2001:db8::1:443", invalid: true},
+		{target: "[2001:db8::1]", invalid: true},
+		{target: "[not:an:address]:443", invalid: true},
+		{target: "[fe80::1%eth0]:443", invalid: true},
+		{target: "[2001:db8::1]:0", invalid: true},
+		{target: "[2001:db8::1]:65536", invalid: true},
+		{target: "[]:443", invalid: true},
+		{target: "example.com", invalid: true},
+		{target: "example.com:https", invalid: true},
+		{target: ":443", invalid: true},
+	}
+	for _, test := range tests {
+		address, err := connectAddress(test.target)
+		switch {
+		case test.invalid && err == nil:
+			t.Errorf("connectAddress(%q) = %q, expected an error", test.target, address)
+		case !test.invalid && err != nil:
+			t.Errorf("connectAddress(%q) failed: %v", test.target, err)
+		case !test.invalid && address != test.address:
+			t.Errorf("connectAddress(%q) = %q, expected %q", test.target, address, test.address)
+		}
+	}
+}
+
+func TestDestinationAddress(t *testing.T) {
+	tests := []struct {
+		url     string
+		address string
+		invalid bool
+	}{
+		{url: "http://example.com/", address: "example.com:80"},
+		{url: "https://example.com:8443/", address: "example.com:8443"},
+		{url: "http://[2001:db8::1]/", address: "[2001:db8::1]:80"},
+		{url: "http://[2001:db8::1]:8080/path", address: "[2001:db8::1]:8080"},
+		{url: "wss://[::1]/socket", address: "[::1]:443"},
+		{url: "http://[2001:db8::1]:70000/", invalid: true},
+		{url: "ftp://example.com/", invalid: true},
+		{url: "/relative", invalid: true},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", test.url, err)
+		}
+		address, err := destinationAddress(u)
+		switch {
+		case test.invalid && err == nil:
+			t.Errorf("destinationAddress(%q) = %q, expected an error", test.url, address)
+		case !test.invalid && err != nil:
+			t.Errorf("destinationAddress(%q) failed: %v", test.url, err)
+		case !test.invalid && address != test.address:
+			t.Errorf("destinationAddress(%q) = %q, expected %q", test.url, address, test.address)
+		}
+	}
+}
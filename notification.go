@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+const (
+	notifyConnOpened   = "connection.opened"
+	notifyConnClosed   = "connection.closed"
+	notifyUpstreamDown = "upstream.down"
+	notifyExfiltration = "exfiltration.suspected"
+	notifyBlocked      = "request.blocked"
+	notifyAuthFailure  = "auth.failed"
+)
+
+// notification describes an event published to webhooks and to the admin
+// API event stream.
+type notification struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Duration   float64   `json:"duration_ms,omitempty"`
+	Uploaded   uint64    `json:"uploaded_bytes,omitempty"`
+	Downloaded uint64    `json:"downloaded_bytes,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func connNotification(kind string, conn *metricConn) notification {
+	n := notification{
+		Type:   kind,
+		Time:   time.Now(),
+		ID:     conn.id,
+		Client: conn.conn.RemoteAddr().String(),
+		Tag:    conn.tag,
+		Method: conn.remote.method,
+		Host:   conn.remote.host,
+	}
+	if kind == notifyConnClosed {
+		n.Duration = milliseconds(time.Since(conn.startedAt))
+		counters := conn.snapshot()
+		n.Uploaded = counters.readBytes
+		n.Downloaded = counters.writtenBytes
+		n.Status = conn.remote.status
+	}
+	return n
+}
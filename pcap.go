@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pcapBlockSection   = 0x0A0D0D0A
+	pcapBlockInterface = 0x00000001
+	pcapBlockPacket    = 0x00000006
+	pcapLinkTypeRaw    = 101
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+
+	maxSegmentSize = 65535 - 60 - 20
+)
+
+// captureFilter selects the connections whose tunneled bytes are written to
+// pcap-ng files. Empty host and client lists match every connection.
+type captureFilter struct {
+	dir     string
+	hosts   []string
+	clients []*net.IPNet
+}
+
+func newCaptureFilter(dir string, hosts []string, clients []string) (*captureFilter, error) {
+	f := &captureFilter{dir: dir, hosts: hosts}
+	for _, client := range clients {
+		if !strings.Contains(client, "/") {
+			if strings.Contains(client, ":") {
+				client += "/128"
+			} else {
+				client += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, err
+		}
+		f.clients = append(f.clients, network)
+	}
+	return f, nil
+}
+
+func hostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// without a port, IPv6 literals may still be bracketed
+		return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	return host
+}
+
+func (f *captureFilter) match(client net.Addr, host string) bool {
+	if len(f.hosts) > 0 {
+		found := false
+		host = hostname(host)
+		for _, pattern := range f.hosts {
+			if host == pattern || strings.HasSuffix(host, "."+pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.clients) > 0 {
+		addr, ok := client.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		for _, network := range f.clients {
+			if network.Contains(addr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// pcapWriter writes the bytes exchanged between a client and a server as
+// synthetic TCP segments in a pcap-ng file.
+type pcapWriter struct {
+	mtx    sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	client *net.TCPAddr
+	server *net.TCPAddr
+	// next sequence number of the client and of the server
+	seq    [2]uint32
+	closed bool
+}
+
+func (f *captureFilter) open(client, server net.Addr, host string) (*pcapWriter, error) {
+	clientAddr, ok := client.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported client address %s", client)
+	}
+	serverAddr, ok := server.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported server address %s", server)
+	}
+	name := fmt.Sprintf("%s-%s-%s.pcapng", time.Now().Format("20060102T150405.000000000"),
+		clientAddr.IP, strings.NewReplacer(":", "_", "[", "", "]", "").Replace(host))
+	file, err := os.Create(filepath.Join(f.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		client: clientAddr,
+		server: serverAddr,
+		seq:    [2]uint32{1000, 5000},
+	}
+	p.block(pcapBlockSection, func(buf []byte) []byte {
+		buf = appendUint32(buf, 0x1A2B3C4D)
+		buf = appendUint16(buf, 1)
+		buf = appendUint16(buf, 0)
+		// unspecified section length
+		return appendUint64(buf, 0xFFFFFFFFFFFFFFFF)
+	})
+	p.block(pcapBlockInterface, func(buf []byte) []byte {
+		buf = appendUint16(buf, pcapLinkTypeRaw)
+		buf = appendUint16(buf, 0)
+		return appendUint32(buf, 0)
+	})
+	p.segment(true, tcpSyn, nil)
+	p.segment(false, tcpSyn|tcpAck, nil)
+	p.segment(true, tcpAck, nil)
+	return p, nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v)), uint32(v>>32))
+}
+
+// block writes a pcap-ng block, whose body is built by fn.
+func (p *pcapWriter) block(kind uint32, fn func([]byte) []byte) {
+	body := fn(nil)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(len(body) + 12)
+	buf := appendUint32(nil, kind)
+	buf = appendUint32(buf, length)
+	buf = append(buf, body...)
+	buf = appendUint32(buf, length)
+	p.w.Write(buf)
+}
+
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// packet builds an IP packet holding a TCP segment.
+func (p *pcapWriter) packet(fromClient bool, flags byte, payload []byte) []byte {
+	src, dst := p.client, p.server
+	self, peer := 0, 1
+	if !fromClient {
+		src, dst = dst, src
+		self, peer = 1, 0
+	}
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], p.seq[self])
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], p.seq[peer])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+	p.seq[self] += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		p.seq[self]++
+	}
+
+	var pseudo []byte
+	var ip []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		pseudo = append(append([]byte{}, src4...), dst4...)
+		pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+		pseudo = append(append([]byte{}, src.IP.To16()...), dst.IP.To16()...)
+		pseudo = append(pseudo, 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	}
+	var sum uint32
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(pseudo[i])<<8 | uint32(pseudo[i+1])
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum))
+	return append(ip, tcp...)
+}
+
+func (p *pcapWriter) segment(fromClient bool, flags byte, payload []byte) {
+	packet := p.packet(fromClient, flags, payload)
+	ts := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	p.block(pcapBlockPacket, func(buf []byte) []byte {
+		buf = appendUint32(buf, 0)
+		buf = appendUint32(buf, uint32(ts>>32))
+		buf = appendUint32(buf, uint32(ts))
+		buf = appendUint32(buf, uint32(len(packet)))
+		buf = appendUint32(buf, uint32(len(packet)))
+		return append(buf, packet...)
+	})
+}
+
+func (p *pcapWriter) write(fromClient bool, payload []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return
+	}
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxSegmentSize {
+			n = maxSegmentSize
+		}
+		p.segment(fromClient, tcpPsh|tcpAck, payload[:n])
+		payload = payload[n:]
+	}
+}
+
+func (p *pcapWriter) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	p.segment(true, tcpFin|tcpAck, nil)
+	p.segment(false, tcpFin|tcpAck, nil)
+	p.segment(true, tcpAck, nil)
+	err := p.w.Flush()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// capturingConn copies the bytes flowing through a client connection to a
+// pcap-ng file.
+type capturingConn struct {
+	io.ReadWriter
+	pcap *pcapWriter
+}
+
+func (c *capturingConn) Close() error {
+	if closer, ok := c.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *capturingConn) CloseWrite() error {
+	return closeWrite(c.ReadWriter)
+}
+
+func (c *capturingConn) Read(buf []byte) (int, error) {
+	n, err := c.ReadWriter.Read(buf)
+	if n > 0 {
+		c.pcap.write(true, buf[:n])
+	}
+	return n, err
+}
+
+func (c *capturingConn) Write(buf []byte) (int, error) {
+	n, err := c.ReadWriter.Write(buf)
+	if n > 0 {
+		c.pcap.write(false, buf[:n])
+	}
+	return n, err
+}
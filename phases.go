@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var slowConns = expvar.NewMap("slow_connections")
+
+type phasesKey struct{}
+
+// connPhases records when the setup phases of a connection ended, so slow
+// connections can be blamed on the client, on DNS, on the dial or on the
+// transfer itself.
+type connPhases struct {
+	dialStart    time.Time
+	connectOnce  sync.Once
+	connectStart time.Time
+	dialEnd      time.Time
+	resolved     time.Time
+}
+
+// proxyDialer connects to destinations and upstream proxies, resolving
+// their hostnames through dns when set.
+type proxyDialer struct {
+	net.Dialer
+	dns *dnsCache
+}
+
+// dial connects to address, recording the DNS and dial phases in the
+// connPhases of ctx, if any.
+func (d *proxyDialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	phases, ok := ctx.Value(phasesKey{}).(*connPhases)
+	if !ok {
+		return d.dialCached(ctx, d.Dialer, address)
+	}
+	phases.dialStart = time.Now()
+	dialer := d.Dialer
+	control := dialer.Control
+	// Control is called once the address is resolved, before connecting
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		phases.connectOnce.Do(func() {
+			phases.connectStart = time.Now()
+		})
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	conn, err := d.dialCached(ctx, dialer, address)
+	phases.dialEnd = time.Now()
+	return conn, err
+}
+
+// dialCached connects to address, trying each of its cached addresses in
+// turn.
+func (d *proxyDialer) dialCached(ctx context.Context, dialer net.Dialer, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if d.dns == nil || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	addrs, err := d.dns.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// checkSlow logs and counts the connections whose setup or total duration
+// exceeded the configured thresholds.
+func (h *handler) checkSlow(local *metricConn, phases *connPhases) {
+	setup := phases.resolved.Sub(local.startedAt)
+	total := time.Since(local.startedAt)
+	if (h.slowSetup == 0 || setup < h.slowSetup) && (h.slowTotal == 0 || total < h.slowTotal) {
+		return
+	}
+	var dns, dialing time.Duration
+	if !phases.dialStart.IsZero() {
+		if phases.connectStart.IsZero() {
+			dns = phases.dialEnd.Sub(phases.dialStart)
+		} else {
+			dns = phases.connectStart.Sub(phases.dialStart)
+			dialing = phases.dialEnd.Sub(phases.connectStart)
+		}
+	}
+	client := setup - dns - dialing
+	transfer := total - setup
+	cause := "transfer"
+	if h.slowSetup > 0 && setup >= h.slowSetup {
+		cause = "client"
+		if dns > client && dns >= dialing {
+			cause = "dns"
+		} else if dialing > client && dialing > dns {
+			cause = "dial"
+		}
+	}
+	slowConns.Add(cause, 1)
+	warnf("slow connection %s %s: %s (client %s, dns %s, dial %s, transfer %s), blaming %s",
+		local.remote.method, local.remote.host, humanDuration(total), humanDuration(client),
+		humanDuration(dns), humanDuration(dialing), humanDuration(transfer), cause)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+var reusedConns = expvar.NewInt("reused_upstream_connections")
+
+// pooledConn is an upstream connection able to carry several plain HTTP
+// requests, one after the other.
+type pooledConn struct {
+	net.Conn
+	reader *bufio.Reader
+	idleAt time.Time
+}
+
+func newPooledConn(conn net.Conn) *pooledConn {
+	return &pooledConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *pooledConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *pooledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// alive tells whether the destination neither closed the connection nor
+// sent anything while it was idle.
+func (c *pooledConn) alive() bool {
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.reader.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// connPool keeps idle upstream connections per destination, so plain HTTP
+// requests do not pay a handshake each.
+type connPool struct {
+	mtx         sync.Mutex
+	idle        map[string][]*pooledConn
+	maxIdle     int
+	idleTimeout time.Duration
+}
+
+func newConnPool(maxIdle int, idleTimeout time.Duration) *connPool {
+	p := &connPool{idle: make(map[string][]*pooledConn), maxIdle: maxIdle, idleTimeout: idleTimeout}
+	if idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(idleTimeout / 2)
+			for range ticker.C {
+				p.expire()
+			}
+		}()
+	}
+	return p
+}
+
+// get returns an idle connection to address, or nil if there is none.
+func (p *connPool) get(address string) *pooledConn {
+	for {
+		p.mtx.Lock()
+		conns := p.idle[address]
+		if len(conns) == 0 {
+			p.mtx.Unlock()
+			return nil
+		}
+		conn := conns[len(conns)-1]
+		if len(conns) == 1 {
+			delete(p.idle, address)
+		} else {
+			p.idle[address] = conns[:len(conns)-1]
+		}
+		p.mtx.Unlock()
+		if (p.idleTimeout <= 0 || time.Since(conn.idleAt) < p.idleTimeout) && conn.alive() {
+			reusedConns.Add(1)
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// put makes conn available to the next requests to address.
+func (p *connPool) put(address string, conn *pooledConn) {
+	conn.idleAt = time.Now()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(p.idle[address]) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[address] = append(p.idle[address], conn)
+}
+
+func (p *connPool) expire() {
+	deadline := time.Now().Add(-p.idleTimeout)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for host, conns := range p.idle {
+		kept := conns[:0]
+		for _, conn := range conns {
+			if conn.idleAt.Before(deadline) {
+				conn.Close()
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, host)
+		} else {
+			p.idle[host] = kept
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxIdle     int
+		idleTimeout time.Duration
+		// how many connections are put back to the pool, and what their
+		// peer does meanwhile
+		put   int
+		peer  func(net.Conn)
+		idle  time.Duration
+		reuse int
+	}{
+		{name: "reused", maxIdle: 2, put: 1, peer: func(net.Conn) {}, reuse: 1},
+		{name: "over the limit", maxIdle: 2, put: 3, peer: func(net.Conn) {}, reuse: 2},
+		{name: "closed by the destination", maxIdle: 2, put: 1, peer: func(c net.Conn) { c.Close() }},
+		{name: "unsolicited bytes", maxIdle: 2, put: 1, peer: func(c net.Conn) { go c.Write([]byte("HTTP/1.1 408")) }},
+		{name: "idle for too long", maxIdle: 2, idleTimeout: 10 * time.Millisecond, put: 1, peer: func(net.Conn) {}, idle: 20 * time.Millisecond},
+	}
+	for _, test := range tests {
+		// without the background expiry, checked below
+		pool := &connPool{idle: make(map[string][]*pooledConn), maxIdle: test.maxIdle, idleTimeout: test.idleTimeout}
+		var peers []net.Conn
+		for i := 0; i < test.put; i++ {
+			conn, peer := net.Pipe()
+			peers = append(peers, peer)
+			pool.put("example.com:80", newPooledConn(conn))
+			test.peer(peer)
+		}
+		time.Sleep(test.idle)
+		reused := 0
+		for pool.get("example.com:80") != nil {
+			reused++
+		}
+		if reused != test.reuse {
+			t.Errorf("%s: reused %d connections, expected %d", test.name, reused, test.reuse)
+		}
+		if conn := pool.get("other.example.com:80"); conn != nil {
+			t.Errorf("%s: reused a connection to another destination", test.name)
+		}
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}
+}
+
+func TestConnPoolExpire(t *testing.T) {
+	pool := &connPool{idle: make(map[string][]*pooledConn), maxIdle: 2, idleTimeout: time.Minute}
+	for _, idleAt := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now()} {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		pooled := newPooledConn(conn)
+		pool.put("example.com:80", pooled)
+		pooled.idleAt = idleAt
+	}
+	pool.expire()
+	if count := len(pool.idle["example.com:80"]); count != 1 {
+		t.Errorf("%d connections kept, expected 1", count)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	prewarmInterval = time.Second
+	// request counts are halved this often, so that the destinations
+	// reflect the recent traffic
+	prewarmDecayInterval = time.Minute
+	// destinations requested less often are not worth a connection
+	prewarmMinRequests = 2
+)
+
+var prewarmedConns = expvar.NewInt("prewarmed_connections_used")
+
+type warmConn struct {
+	conn     net.Conn
+	openedAt time.Time
+}
+
+// warmer learns the most requested destinations, and keeps connections to
+// them established ahead of time, so tunnels skip the handshake.
+type warmer struct {
+	dialer       *proxyDialer
+	size         int
+	destinations int
+	maxAge       time.Duration
+	mtx          sync.Mutex
+	requests     map[string]int
+	ready        map[string][]warmConn
+	dialing      map[string]int
+}
+
+func runWarmer(dialer *proxyDialer, size, destinations int, maxAge time.Duration) *warmer {
+	w := &warmer{
+		dialer:       dialer,
+		size:         size,
+		destinations: destinations,
+		maxAge:       maxAge,
+		requests:     make(map[string]int),
+		ready:        make(map[string][]warmConn),
+		dialing:      make(map[string]int),
+	}
+	go w.run()
+	return w
+}
+
+// take counts a request to address, and returns an established connection
+// to it, if any.
+func (w *warmer) take(address string) net.Conn {
+	if w == nil {
+		return nil
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.requests[address]++
+	conns := w.ready[address]
+	for len(conns) > 0 {
+		warm := conns[0]
+		conns = conns[1:]
+		if time.Since(warm.openedAt) < w.maxAge {
+			w.ready[address] = conns
+			prewarmedConns.Add(1)
+			return warm.conn
+		}
+		warm.conn.Close()
+	}
+	delete(w.ready, address)
+	return nil
+}
+
+// wanted returns the destinations worth keeping connections to.
+func (w *warmer) wanted() map[string]bool {
+	addresses := make([]string, 0, len(w.requests))
+	for address, count := range w.requests {
+		if count >= prewarmMinRequests {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return w.requests[addresses[i]] > w.requests[addresses[j]]
+	})
+	if len(addresses) > w.destinations {
+		addresses = addresses[:w.destinations]
+	}
+	wanted := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		wanted[address] = true
+	}
+	return wanted
+}
+
+func (w *warmer) run() {
+	ticker := time.NewTicker(prewarmInterval)
+	defer ticker.Stop()
+	lastDecay := time.Now()
+	for range ticker.C {
+		w.mtx.Lock()
+		if time.Since(lastDecay) >= prewarmDecayInterval {
+			lastDecay = time.Now()
+			for address := range w.requests {
+				w.requests[address] /= 2
+				if w.requests[address] == 0 {
+					delete(w.requests, address)
+				}
+			}
+		}
+		wanted := w.wanted()
+		for address, conns := range w.ready {
+			kept := conns[:0]
+			for _, warm := range conns {
+				if wanted[address] && time.Since(warm.openedAt) < w.maxAge {
+					kept = append(kept, warm)
+				} else {
+					warm.conn.Close()
+				}
+			}
+			w.ready[address] = kept
+		}
+		for address := range wanted {
+			for missing := w.size - len(w.ready[address]) - w.dialing[address]; missing > 0; missing-- {
+				w.dialing[address]++
+				go w.open(address)
+			}
+		}
+		w.mtx.Unlock()
+	}
+}
+
+func (w *warmer) open(address string) {
+	conn, err := w.dialer.dial(context.Background(), address)
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.dialing[address]--
+	if err != nil {
+		return
+	}
+	w.ready[address] = append(w.ready[address], warmConn{conn: conn, openedAt: time.Now()})
+}
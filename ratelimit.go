@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sizeUnits = map[string]float64{
+	"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12,
+}
+
+// parseSize parses sizes like "512", "64k", "5MB" or "1go", using decimal
+// units like humanBytes does.
+func parseSize(v string) (float64, error) {
+	s := strings.ToLower(strings.TrimSpace(v))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "b"), "o")
+	idx := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if idx == -1 {
+		idx = len(s)
+	}
+	multiplier, ok := sizeUnits[strings.TrimSpace(s[idx:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	n, err := strconv.ParseFloat(s[:idx], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * multiplier, nil
+}
+
+// tokenBucket allows rate bytes per second, with bursts of up to burst bytes.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// newBandwidthBucket returns a bucket allowing rate bytes per second.
+func newBandwidthBucket(rate float64) *tokenBucket {
+	burst := rate / 10
+	if burst < 4096 {
+		burst = 4096
+	}
+	return newTokenBucket(rate, burst)
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take consumes n tokens if they are available.
+func (b *tokenBucket) take(n float64) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// wait blocks until n bytes can be transferred.
+func (b *tokenBucket) wait(n int) {
+	b.mtx.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mtx.Unlock()
+	time.Sleep(delay)
+}
+
+// maxChunk returns the largest read allowed at once.
+func (b *tokenBucket) maxChunk() int {
+	return int(b.burst)
+}
+
+// throttledConn caps the bandwidth of each direction of a client
+// connection, waiting on every bucket of the direction.
+type throttledConn struct {
+	io.ReadWriter
+	upload   []*tokenBucket
+	download []*tokenBucket
+}
+
+func maxChunk(buckets []*tokenBucket, size int) int {
+	for _, bucket := range buckets {
+		if max := bucket.maxChunk(); size > max {
+			size = max
+		}
+	}
+	return size
+}
+
+func (t *throttledConn) Close() error {
+	if closer, ok := t.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (t *throttledConn) CloseWrite() error {
+	return closeWrite(t.ReadWriter)
+}
+
+func (t *throttledConn) Read(buf []byte) (int, error) {
+	n, err := t.ReadWriter.Read(buf[:maxChunk(t.upload, len(buf))])
+	for _, bucket := range t.upload {
+		bucket.wait(n)
+	}
+	return n, err
+}
+
+func (t *throttledConn) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		chunk := buf[:maxChunk(t.download, len(buf))]
+		for _, bucket := range t.download {
+			bucket.wait(len(chunk))
+		}
+		n, err := t.ReadWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
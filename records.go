@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// connRecord describes a completed connection.
+type connRecord struct {
+	ID         string    `json:"id,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Client     string    `json:"client"`
+	Tag        string    `json:"tag,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Uploaded   uint64    `json:"uploaded_bytes"`
+	Downloaded uint64    `json:"downloaded_bytes"`
+	Result     string    `json:"result"`
+}
+
+func newConnRecord(start time.Time, client net.Addr, remote *remote, local *metricConn, err error) connRecord {
+	counters := local.snapshot()
+	record := connRecord{
+		ID:         local.id,
+		Tag:        local.tag,
+		Start:      start,
+		End:        time.Now(),
+		Client:     hostname(client.String()),
+		Uploaded:   counters.readBytes,
+		Downloaded: counters.writtenBytes,
+		Result:     "ok",
+	}
+	if remote != nil {
+		record.Method = remote.method
+		record.Host = remote.host
+		record.Status = remote.status
+	}
+	if err != nil {
+		record.Result = err.Error()
+	}
+	return record
+}
+
+// recordStore persists connection records.
+type recordStore interface {
+	save(record connRecord) error
+	// query returns the records of the connections started between from
+	// and to.
+	query(from, to time.Time) ([]connRecord, error)
+}
+
+// openRecordStore opens the configured record store, if any.
+func openRecordStore(config *viper.Viper) (recordStore, error) {
+	if path := config.GetString("records-db"); path != "" {
+		return openSQLRecords("sqlite3", path, config.GetDuration("records-retention"))
+	}
+	if path := config.GetString("records-file"); path != "" {
+		return openRecordFile(path)
+	}
+	return nil, nil
+}
+
+// recordFile appends connection records to a file, as JSON lines.
+type recordFile struct {
+	mtx  sync.Mutex
+	path string
+	file *os.File
+	enc  *json.Encoder
+}
+
+func openRecordFile(path string) (*recordFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFile{path: path, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *recordFile) save(record connRecord) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.enc.Encode(record)
+}
+
+func (r *recordFile) query(from, to time.Time) ([]connRecord, error) {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	out := []connRecord{}
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for dec.More() {
+		record := connRecord{}
+		err := dec.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		if record.Start.Before(from) || record.Start.After(to) {
+			continue
+		}
+		out = append(out, record)
+	}
+	return out, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// without cgo, the driver fails to open the database
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const recordsSchema = `CREATE TABLE IF NOT EXISTS connections (
+	started_at INTEGER NOT NULL,
+	ended_at INTEGER NOT NULL,
+	client TEXT NOT NULL,
+	method TEXT NOT NULL,
+	host TEXT NOT NULL,
+	status INTEGER NOT NULL DEFAULT 0,
+	uploaded INTEGER NOT NULL,
+	downloaded INTEGER NOT NULL,
+	result TEXT NOT NULL,
+	request_id TEXT NOT NULL DEFAULT '',
+	tag TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS connections_started_at ON connections (started_at);`
+
+// sqlRecords stores connection records in a SQL database, one row per
+// connection, and prunes the rows older than its retention period.
+type sqlRecords struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+func openSQLRecords(driver, dsn string, retention time.Duration) (*sqlRecords, error) {
+	found := false
+	for _, name := range sql.Drivers() {
+		if name == driver {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("nanoproxy was built without the %s driver", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(recordsSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	// databases created before the status column was added
+	if _, err := db.Exec("SELECT status FROM connections LIMIT 0"); err != nil {
+		_, err = db.Exec("ALTER TABLE connections ADD COLUMN status INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	// and before the request_id and tag ones
+	for _, column := range []string{"request_id", "tag"} {
+		if _, err := db.Exec("SELECT " + column + " FROM connections LIMIT 0"); err != nil {
+			_, err = db.Exec("ALTER TABLE connections ADD COLUMN " + column + " TEXT NOT NULL DEFAULT ''")
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+	r := &sqlRecords{db: db, retention: retention}
+	if retention > 0 {
+		go r.runPruning()
+	}
+	return r, nil
+}
+
+func (r *sqlRecords) runPruning() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := r.prune(time.Now()); err != nil {
+			warnf("failed to prune connection records: %v", err)
+		} else if n > 0 {
+			infof("pruned %d connection records", n)
+		}
+		<-ticker.C
+	}
+}
+
+// prune deletes the records of the connections started more than the
+// retention period before now, and returns how many.
+func (r *sqlRecords) prune(now time.Time) (int64, error) {
+	result, err := r.db.Exec("DELETE FROM connections WHERE started_at < ?", now.Add(-r.retention).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *sqlRecords) save(record connRecord) error {
+	_, err := r.db.Exec(`INSERT INTO connections
+		(started_at, ended_at, client, method, host, status, uploaded, downloaded, result, request_id, tag)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Start.UnixNano(), record.End.UnixNano(), record.Client, record.Method, record.Host, record.Status,
+		int64(record.Uploaded), int64(record.Downloaded), record.Result, record.ID, record.Tag)
+	return err
+}
+
+func (r *sqlRecords) query(from, to time.Time) ([]connRecord, error) {
+	rows, err := r.db.Query(`SELECT started_at, ended_at, client, method, host, status, uploaded, downloaded, result,
+		request_id, tag FROM connections WHERE started_at BETWEEN ? AND ? ORDER BY started_at`,
+		from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []connRecord{}
+	for rows.Next() {
+		var start, end, uploaded, downloaded int64
+		record := connRecord{}
+		err := rows.Scan(&start, &end, &record.Client, &record.Method, &record.Host, &record.Status,
+			&uploaded, &downloaded, &record.Result, &record.ID, &record.Tag)
+		if err != nil {
+			return nil, err
+		}
+		record.Start = time.Unix(0, start)
+		record.End = time.Unix(0, end)
+		record.Uploaded = uint64(uploaded)
+		record.Downloaded = uint64(downloaded)
+		out = append(out, record)
+	}
+	return out, rows.Err()
+}
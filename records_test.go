@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLRecords(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		retention time.Duration
+		// how long before now each connection started
+		ages []time.Duration
+		// which of them are left once pruned, and queried over the last day
+		pruned  int64
+		queried []string
+	}{
+		{
+			name:      "no retention",
+			retention: 0,
+			ages:      []time.Duration{time.Hour, 48 * time.Hour},
+			queried:   []string{"a.example.com"},
+		},
+		{
+			name:      "pruned",
+			retention: 36 * time.Hour,
+			ages:      []time.Duration{time.Hour, 2 * time.Hour, 48 * time.Hour},
+			pruned:    1,
+			queried:   []string{"b.example.com", "a.example.com"},
+		},
+	}
+	for _, test := range tests {
+		// no pruning in the background, it is run below
+		records, err := openSQLRecords("sqlite3", filepath.Join(t.TempDir(), "records.db"), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		records.retention = test.retention
+		for i, age := range test.ages {
+			err := records.save(connRecord{
+				ID:         "id",
+				Start:      now.Add(-age),
+				End:        now.Add(-age).Add(time.Second),
+				Client:     "192.0.2.1",
+				Method:     "GET",
+				Host:       string(rune('a'+i)) + ".example.com",
+				Status:     200,
+				Uploaded:   10,
+				Downloaded: 20,
+				Result:     "ok",
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if test.retention > 0 {
+			pruned, err := records.prune(now)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			if pruned != test.pruned {
+				t.Errorf("%s: pruned %d records, expected %d", test.name, pruned, test.pruned)
+			}
+		}
+		found, err := records.query(now.Add(-24*time.Hour), now)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		var hosts []string
+		for _, record := range found {
+			hosts = append(hosts, record.Host)
+			if record.Uploaded != 10 || record.Downloaded != 20 || record.Status != 200 {
+				t.Errorf("%s: record of %s read back as %+v", test.name, record.Host, record)
+			}
+		}
+		if len(hosts) != len(test.queried) {
+			t.Errorf("%s: queried %v, expected %v", test.name, hosts, test.queried)
+		} else {
+			for i := range hosts {
+				if hosts[i] != test.queried[i] {
+					t.Errorf("%s: queried %v, expected %v", test.name, hosts, test.queried)
+					break
+				}
+			}
+		}
+		records.db.Close()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// redirectRule follows up to hops redirects answered on a route.
+type redirectRule struct {
+	route
+	hops int
+}
+
+// parseRedirectRule parses rules like "example.net/downloads:hops=3", the
+// route "/" matching every request.
+func parseRedirectRule(v string) (*redirectRule, error) {
+	tokens := strings.Split(v, ":")
+	if tokens[0] == "" {
+		return nil, fmt.Errorf("invalid redirect rule %q: expected route:key=value:...", v)
+	}
+	r := &redirectRule{route: parseRoute(tokens[0]), hops: 5}
+	for _, option := range tokens[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid redirect rule option %q", option)
+		}
+		switch kv[0] {
+		case "hops":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid number of hops %q", kv[1])
+			}
+			r.hops = n
+		default:
+			return nil, fmt.Errorf("unknown redirect rule option %q", kv[0])
+		}
+	}
+	return r, nil
+}
+
+// redirectFollower follows the redirects of plain HTTP responses on behalf
+// of the clients, and answers them with the final response.
+type redirectFollower struct {
+	rules     []*redirectRule
+	transport *http.Transport
+	// refuses the destinations clients are not allowed to reach
+	checkDestination func(address string) error
+}
+
+// redirectConfig reads the redirect rules, and returns the follower sending
+// the requests with dialer, or nil when there are none.
+func redirectConfig(config *viper.Viper, dialer *proxyDialer, checkDestination func(string) error) (*redirectFollower, error) {
+	var rules []*redirectRule
+	for _, v := range config.GetStringSlice("follow-redirects") {
+		rule, err := parseRedirectRule(v)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return newRedirectFollower(rules, dialer, config.GetString("upstream"), checkDestination)
+}
+
+// newRedirectFollower returns a follower sending the requests with dialer,
+// through the upstream proxy when upstreamURL is set, to the destinations
+// checkDestination allows.
+func newRedirectFollower(rules []*redirectRule, dialer *proxyDialer, upstreamURL string, checkDestination func(string) error) (*redirectFollower, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dialer.dial(ctx, address)
+		},
+		// bodies are relayed as they were sent
+		DisableCompression: true,
+		IdleConnTimeout:    90 * time.Second,
+	}
+	if upstreamURL != "" {
+		upstream, err := url.Parse(upstreamURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(upstream)
+	}
+	return &redirectFollower{rules: rules, transport: transport, checkDestination: checkDestination}, nil
+}
+
+func (f *redirectFollower) find(host, path string) *redirectRule {
+	for _, r := range f.rules {
+		if r.matches(host, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// followable tells whether a redirect to u can be followed.
+func (f *redirectFollower) followable(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	address, err := destinationAddress(u)
+	return err == nil && f.checkDestination(address) == nil
+}
+
+// follow returns the response the redirect resp to the request of remote
+// leads to, or nil when it is not to be followed. The body of a followed
+// redirect is read, and resp.Close is set when it could not be.
+func (f *redirectFollower) follow(ctx context.Context, remote *remote, resp *http.Response) (*http.Response, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+	rule := f.find(remote.host, remote.path)
+	if rule == nil {
+		return nil, nil
+	}
+	req := remote.request
+	method := req.Method
+	if method != "GET" && method != "HEAD" {
+		// the body of the request is gone, only the redirects turning it
+		// into a GET can be followed
+		seeOther := resp.StatusCode == http.StatusSeeOther
+		moved := resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusFound
+		if !seeOther && !(moved && method == "POST") {
+			return nil, nil
+		}
+		method = "GET"
+	}
+	location, err := resp.Location()
+	if err != nil || !f.followable(location) {
+		return nil, nil
+	}
+	next, err := http.NewRequestWithContext(ctx, method, location.String(), nil)
+	if err != nil {
+		return nil, nil
+	}
+	next.Header = req.Header.Clone()
+	// the transport authenticates to the upstream proxy itself
+	next.Header.Del("Proxy-Authorization")
+	if method != req.Method {
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	if !strings.EqualFold(location.Hostname(), req.URL.Hostname()) {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	// the upstream connection can serve another request once the body of
+	// the redirect is read
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		resp.Close = true
+	}
+	client := &http.Client{
+		Transport: f.transport,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if len(via) >= rule.hops || !f.followable(next.URL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	return client.Do(next)
+}
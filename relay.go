@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// defaultCopyBufferSize is the size of the buffer of each direction of a
+// relay, unless configured otherwise.
+const defaultCopyBufferSize = 32 * 1024
+
+// copyBuffers holds the buffers of the relays not done with splice(2), so
+// thousands of tunnels don't each allocate their own.
+type copyBuffers struct {
+	size int
+	pool sync.Pool
+}
+
+func newCopyBuffers(size int) *copyBuffers {
+	b := &copyBuffers{size: size}
+	b.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return b
+}
+
+// copyBufferConfig reads the size of the relay buffers.
+func copyBufferConfig(config *viper.Viper) (*copyBuffers, error) {
+	size := defaultCopyBufferSize
+	if v := config.GetString("copy-buffer-size"); v != "" {
+		bytes, err := parseSize(v)
+		if err != nil {
+			return nil, err
+		}
+		size = int(bytes)
+	}
+	return newCopyBuffers(size), nil
+}
+
+// spliceChunkSize is the number of bytes handed at once to the kernel when
+// relaying between two TCP connections, after which byte counters are
+// updated.
+const spliceChunkSize = 1 << 20
+
+// spliceable is implemented by connections wrapping a TCP connection, which
+// can be bypassed to relay bytes with splice(2). The wrapper is told about
+// the bytes it did not see.
+type spliceable interface {
+	tcpConn() (*net.TCPConn, bool)
+	accountRead(n int64)
+	accountWrite(n int64)
+}
+
+// the activity of spliced bytes can't be tracked
+func (m *metricConn) tcpConn() (*net.TCPConn, bool) {
+	conn, ok := m.conn.(*net.TCPConn)
+	return conn, ok && !m.trackActivity
+}
+func (m *metricConn) accountRead(n int64) {
+	m.addRead(n)
+}
+func (m *metricConn) accountWrite(n int64) {
+	m.addWritten(n)
+}
+
+// the response status of an upstream proxy must be seen before it can be
+// bypassed
+func (m *monitoredConn) tcpConn() (*net.TCPConn, bool) {
+	conn, ok := m.Conn.(*net.TCPConn)
+	return conn, ok && m.checked
+}
+func (m *monitoredConn) accountRead(n int64)  {}
+func (m *monitoredConn) accountWrite(n int64) {}
+
+// closeWriter is implemented by connections able to signal the end of
+// their outgoing stream while still reading.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// errNoHalfClose is returned when conn can't be half-closed.
+var errNoHalfClose = errors.New("connection can't be half-closed")
+
+// closeWrite half-closes conn, if it or the connection it wraps supports it.
+func closeWrite(conn interface{}) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+func unwrapTCP(v interface{}) (*net.TCPConn, spliceable) {
+	switch conn := v.(type) {
+	case *net.TCPConn:
+		return conn, nil
+	case spliceable:
+		tcp, ok := conn.tcpConn()
+		if ok {
+			return tcp, conn
+		}
+	}
+	return nil, nil
+}
+
+// relay copies src to dst until src reaches EOF. On Linux, bytes flowing
+// between two TCP connections do not go through user space, otherwise they
+// go through a buffer borrowed from buffers.
+func relay(dst io.Writer, src io.Reader, buffers *copyBuffers) error {
+	var buf *[]byte
+	defer func() {
+		if buf != nil {
+			buffers.pool.Put(buf)
+		}
+	}()
+	for {
+		if spliceSupported {
+			dstTCP, dstWrapper := unwrapTCP(dst)
+			srcTCP, srcWrapper := unwrapTCP(src)
+			if dstTCP != nil && srcTCP != nil {
+				// TCPConn.ReadFrom splices from a limited TCP reader
+				n, err := io.CopyN(dstTCP, srcTCP, spliceChunkSize)
+				if dstWrapper != nil {
+					dstWrapper.accountWrite(n)
+				}
+				if srcWrapper != nil {
+					srcWrapper.accountRead(n)
+				}
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if buf == nil {
+			buf = buffers.pool.Get().(*[]byte)
+		}
+		nr, err := src.Read(*buf)
+		if nr > 0 {
+			nw, werr := dst.Write((*buf)[:nr])
+			if werr != nil {
+				return werr
+			}
+			if nw != nr {
+				return io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
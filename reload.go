@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// reloadableSettings are the settings applied again on reload. Changing the
+// others requires a restart.
+var reloadableSettings = map[string]bool{
+	"auth":                     true,
+	"allowed-ports":            true,
+	"block-local-destinations": true,
+	"rewrite":                  true,
+	"mock":                     true,
+	"rate-limit":               true,
+	"destination-limit":        true,
+}
+
+// accessSettings are the settings that can change without a restart: the
+// credentials of the clients, the destinations they can reach, the rewrite
+// and mock rules, and the bandwidth limits.
+type accessSettings struct {
+	// password of each user clients can authenticate as, nil when clients
+	// do not have to authenticate
+	users map[string]string
+	// destination ports clients can reach, or nil for all of them
+	ports map[int]bool
+	// refuses the destinations on the proxy host or on its local networks
+	blockLocal bool
+	// tried in order on each request, the first matching one applying
+	rewrites []*rewriteRule
+	mocks    []*mockRule
+	// bandwidth cap of each direction of a tunnel, in bytes per second
+	rateLimit         float64
+	destinationLimits []*destinationLimit
+}
+
+// accessConfig reads the settings that can change without a restart.
+func accessConfig(config *viper.Viper) (*accessSettings, error) {
+	a := &accessSettings{blockLocal: config.GetBool("block-local-destinations")}
+	var err error
+	if credentials := config.GetStringSlice("auth"); len(credentials) > 0 {
+		if a.users, err = parseUsers(credentials); err != nil {
+			return nil, err
+		}
+	} else if config.GetBool("hardened") {
+		return nil, errors.New("hardened mode requires --auth")
+	}
+	if values := config.GetStringSlice("allowed-ports"); len(values) > 0 {
+		if a.ports, err = parsePorts(values); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range config.GetStringSlice("rewrite") {
+		rule, err := parseRewriteRule(v)
+		if err != nil {
+			return nil, err
+		}
+		a.rewrites = append(a.rewrites, rule)
+	}
+	for _, v := range config.GetStringSlice("mock") {
+		rule, err := parseMockRule(v)
+		if err != nil {
+			return nil, err
+		}
+		a.mocks = append(a.mocks, rule)
+	}
+	if limit := config.GetString("rate-limit"); limit != "" {
+		if a.rateLimit, err = parseSize(limit); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range config.GetStringSlice("destination-limit") {
+		limit, err := parseDestinationLimit(v)
+		if err != nil {
+			return nil, err
+		}
+		a.destinationLimits = append(a.destinationLimits, limit)
+	}
+	return a, nil
+}
+
+// applySettings applies the settings that can change without a restart,
+// all at once. Nothing is applied unless they are all valid.
+func (h *handler) applySettings(config *viper.Viper) error {
+	access, err := accessConfig(config)
+	if err != nil {
+		return err
+	}
+	h.settingsMtx.Lock()
+	h.access = access
+	h.settingsMtx.Unlock()
+	return nil
+}
+
+// settings returns the settings applied last, which a reload replaces
+// rather than changes.
+func (h *handler) settings() *accessSettings {
+	h.settingsMtx.RLock()
+	defer h.settingsMtx.RUnlock()
+	return h.access
+}
+
+// watchConfig reads the config file of cmd again on each reload signal, at
+// the poll interval when it is fetched from a URL, and as soon as it changes
+// when it is stored in Consul or etcd. It then applies the settings that can
+// change without a restart. The tunnels already open are left alone, along
+// with their bandwidth limits.
+func (h *handler) watchConfig(config *viper.Viper, cmd *cobra.Command) {
+	path := config.ConfigFileUsed()
+	if path == "" {
+		return
+	}
+	var signals chan os.Signal
+	if reloadSignal != nil {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, reloadSignal)
+	}
+	var poll <-chan time.Time
+	if interval := config.GetDuration("config-poll-interval"); isConfigURL(path) && interval > 0 {
+		poll = time.NewTicker(interval).C
+	}
+	var changes chan struct{}
+	if isKVConfig(path) {
+		changes = make(chan struct{}, 1)
+		watchKVConfig(path, func() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+	}
+	if signals == nil && poll == nil && changes == nil {
+		return
+	}
+	go func() {
+		current := config
+		for {
+			select {
+			case <-signals:
+			case <-poll:
+			case <-changes:
+			}
+			current = h.reloadSettings(current, cmd, path)
+		}
+	}()
+}
+
+// reloadSettings reads the config file at path again, into a new config
+// bound to the same flags as current, and applies its settings when they
+// are all valid. current is left alone: it returns the config read when
+// applied, and current otherwise.
+func (h *handler) reloadSettings(current *viper.Viper, cmd *cobra.Command, path string) *viper.Viper {
+	config := newConfig()
+	for _, key := range current.AllKeys() {
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil {
+			flag = cmd.InheritedFlags().Lookup(key)
+		}
+		if flag != nil {
+			config.BindPFlag(key, flag)
+		}
+	}
+	err := readConfigFile(config, cmd, path)
+	if err == errConfigUnchanged {
+		return current
+	}
+	if err != nil {
+		warnf("failed to reload the settings: %v", err)
+		return current
+	}
+	if err := h.applySettings(config); err != nil {
+		warnf("failed to reload the settings of %s, keeping the previous ones: %v", path, err)
+		return current
+	}
+	previous := current.AllSettings()
+	for key, value := range config.AllSettings() {
+		if !reloadableSettings[key] && !reflect.DeepEqual(previous[key], value) {
+			warnf("%s changed in %s, restart nanoproxy to apply it", key, path)
+		}
+	}
+	infof("reloaded the settings of %s", path)
+	return config
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestReloadSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		reloaded string
+		// the users of the proxy once reloaded, and whether the config
+		// read was swapped in
+		users   []string
+		swapped bool
+	}{
+		{name: "valid", reloaded: "auth: [\"bob:secret\"]\n", users: []string{"bob"}, swapped: true},
+		{name: "invalid credentials", reloaded: "auth: [\"bob\"]\n", users: []string{"alice"}},
+		{name: "unknown setting", reloaded: "auth: [\"bob:secret\"]\nbogus: 1\n", users: []string{"alice"}},
+		{name: "unparsable", reloaded: "auth: [\n", users: []string{"alice"}},
+	}
+	for _, test := range tests {
+		cmd := &cobra.Command{Use: "serve"}
+		cmd.Flags().StringSlice("auth", nil, "")
+		cmd.Flags().Duration("grace-period", 0, "")
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte("auth: [\"alice:secret\"]\ngrace-period: 5s\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := newConfig()
+		config.BindPFlag("auth", cmd.Flags().Lookup("auth"))
+		config.BindPFlag("grace-period", cmd.Flags().Lookup("grace-period"))
+		if err := readConfigFile(config, cmd, path); err != nil {
+			t.Fatal(err)
+		}
+		h, err := newHandler(config, &proxyDialer{Dialer: net.Dialer{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(test.reloaded), 0644); err != nil {
+			t.Fatal(err)
+		}
+		current := h.reloadSettings(config, cmd, path)
+		if swapped := current != config; swapped != test.swapped {
+			t.Errorf("%s: config swapped %v, expected %v", test.name, swapped, test.swapped)
+		}
+		users := h.settings().users
+		if len(users) != len(test.users) {
+			t.Errorf("%s: users %v, expected %v", test.name, users, test.users)
+		}
+		for _, user := range test.users {
+			if _, ok := users[user]; !ok {
+				t.Errorf("%s: users %v, expected %v", test.name, users, test.users)
+			}
+		}
+		// the config in use before is left alone
+		if auth := config.GetStringSlice("auth"); len(auth) != 1 || auth[0] != "alice:secret" {
+			t.Errorf("%s: previous config changed to auth %v", test.name, auth)
+		}
+		if grace := current.GetDuration("grace-period"); test.swapped != (grace == 0) {
+			t.Errorf("%s: grace period %s in the config in use", test.name, grace)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// errConfigUnchanged is returned when the remote config did not change
+// since it was last fetched.
+var errConfigUnchanged = errors.New("config unchanged")
+
+// remoteConfigClient fetches the remote configs.
+var remoteConfigClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteConfigState holds the validators of the last remote config fetched,
+// for the next fetch to only download it again when it changed.
+var remoteConfigState struct {
+	etag         string
+	lastModified string
+}
+
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// loadConfigPublicKey reads the Ed25519 public key in the PEM file at path.
+func loadConfigPublicKey(path string) (ed25519.PublicKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM public key found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+// remoteConfigFormat tells the format of the config at u, served as
+// contentType: by the extension of its path, or else by its media type.
+func remoteConfigFormat(u *url.URL, contentType string) string {
+	switch ext := strings.TrimPrefix(path.Ext(u.Path), "."); ext {
+	case "yaml", "yml", "toml", "json":
+		return ext
+	}
+	switch {
+	case strings.Contains(contentType, "json"):
+		return "json"
+	case strings.Contains(contentType, "toml"):
+		return "toml"
+	}
+	return "yaml"
+}
+
+// fetchRemote downloads rawURL, conditionally when validators are given,
+// and returns its body and response.
+func fetchRemote(rawURL, etag, lastModified string) ([]byte, *http.Response, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := remoteConfigClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp, nil
+}
+
+// readRemoteConfig reads the config at rawURL into config, unless it did not
+// change since it was last read. With a config-public-key, the config must
+// be signed with the matching private key: the base64 Ed25519 signature of
+// its content is fetched at rawURL.sig. Without one, it must be served over
+// HTTPS.
+func readRemoteConfig(config *viper.Viper, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	var publicKey ed25519.PublicKey
+	if path := config.GetString("config-public-key"); path != "" {
+		if publicKey, err = loadConfigPublicKey(path); err != nil {
+			return err
+		}
+	} else if u.Scheme != "https" {
+		return errors.New("remote configs must be served over HTTPS, or signed and checked with --config-public-key")
+	}
+	body, resp, err := fetchRemote(rawURL, remoteConfigState.etag, remoteConfigState.lastModified)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return errConfigUnchanged
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if publicKey != nil {
+		encoded, sigResp, err := fetchRemote(rawURL+".sig", "", "")
+		if err != nil {
+			return err
+		}
+		if sigResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to fetch the signature: unexpected status %s", sigResp.Status)
+		}
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+		if err != nil || !ed25519.Verify(publicKey, body, signature) {
+			return errors.New("invalid signature")
+		}
+	}
+	if err := readConfigData(config, remoteConfigFormat(u, resp.Header.Get("Content-Type")), body); err != nil {
+		return err
+	}
+	remoteConfigState.etag = resp.Header.Get("ETag")
+	remoteConfigState.lastModified = resp.Header.Get("Last-Modified")
+	return nil
+}
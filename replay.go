@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// replayResult is the outcome of a recorded request sent again.
+type replayResult struct {
+	method   string
+	url      string
+	recorded int
+	replayed int
+	err      error
+}
+
+func (r replayResult) changed() bool {
+	return r.err != nil || r.recorded != r.replayed
+}
+
+// loadHAR reads the entries of the HAR file at path.
+func loadHAR(path string) ([]harEntry, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	har := harLog{}
+	if err := json.Unmarshal(buf, &har); err != nil {
+		return nil, fmt.Errorf("invalid HAR file %s: %v", path, err)
+	}
+	return har.Log.Entries, nil
+}
+
+// harRequestOf rebuilds the recorded request of entry.
+func harRequestOf(entry harEntry) (*http.Request, error) {
+	var body io.Reader
+	if entry.Request.PostData != nil {
+		body = strings.NewReader(entry.Request.PostData.Text)
+	}
+	req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range entry.Request.Headers {
+		switch http.CanonicalHeaderKey(field.Name) {
+		case "Host":
+			req.Host = field.Value
+		case "Content-Length", "Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Te", "Upgrade":
+			// the transport frames the replayed requests itself
+		default:
+			req.Header.Add(field.Name, field.Value)
+		}
+	}
+	return req, nil
+}
+
+// replayHAR sends the recorded requests of entries through the proxy at
+// target, in order, and returns how they were answered.
+func replayHAR(entries []harEntry, target *url.URL, timeout time.Duration) []replayResult {
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(target)},
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// the redirects were recorded as entries of their own
+			return http.ErrUseLastResponse
+		},
+	}
+	results := make([]replayResult, 0, len(entries))
+	for _, entry := range entries {
+		result := replayResult{method: entry.Request.Method, url: entry.Request.URL, recorded: entry.Response.Status}
+		req, err := harRequestOf(entry)
+		if err == nil {
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				result.replayed = resp.StatusCode
+			}
+		}
+		result.err = err
+		results = append(results, result)
+	}
+	return results
+}
+
+// printReplay prints the results of a replay, flagging the requests
+// answered differently, and returns their number.
+func printReplay(w io.Writer, results []replayResult) int {
+	changed := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tMETHOD\tURL\tRECORDED\tREPLAYED")
+	for _, r := range results {
+		flag, replayed := "", fmt.Sprint(r.replayed)
+		if r.err != nil {
+			replayed = r.err.Error()
+		}
+		if r.changed() {
+			flag = "!"
+			changed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", flag, r.method, r.url, r.recorded, replayed)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d requests replayed, %d answered differently\n", len(results), changed)
+	return changed
+}
+
+// runReplay replays the HAR files at paths through target, and exits with
+// an error status when some requests were answered differently.
+func runReplay(paths []string, target string, timeout time.Duration) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	if targetURL.Host == "" {
+		return fmt.Errorf("invalid target %q: expected a proxy URL like http://127.0.0.1:8888", target)
+	}
+	results := []replayResult{}
+	for _, path := range paths {
+		entries, err := loadHAR(path)
+		if err != nil {
+			return err
+		}
+		results = append(results, replayHAR(entries, targetURL, timeout)...)
+	}
+	if printReplay(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
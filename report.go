@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+type talker struct {
+	name       string
+	conns      uint64
+	errors     uint64
+	uploaded   uint64
+	downloaded uint64
+}
+
+func topTalkers(records []connRecord, key func(connRecord) string) []*talker {
+	talkers := map[string]*talker{}
+	for _, record := range records {
+		name := key(record)
+		t, ok := talkers[name]
+		if !ok {
+			t = &talker{name: name}
+			talkers[name] = t
+		}
+		t.conns++
+		if record.Result != "ok" {
+			t.errors++
+		}
+		t.uploaded += record.Uploaded
+		t.downloaded += record.Downloaded
+	}
+	out := make([]*talker, 0, len(talkers))
+	for _, t := range talkers {
+		out = append(out, t)
+	}
+	return out
+}
+
+func printTalkers(w io.Writer, title string, talkers []*talker, less func(a, b *talker) bool, limit int) {
+	sort.Slice(talkers, func(i, j int) bool { return less(talkers[i], talkers[j]) })
+	if len(talkers) > limit {
+		talkers = talkers[:limit]
+	}
+	fmt.Fprintf(w, "%s\n", title)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCONNS\tERRORS\tUP\tDOWN\tTOTAL")
+	for _, t := range talkers {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", t.name, t.conns, t.errors,
+			humanBytes(t.uploaded), humanBytes(t.downloaded), humanBytes(t.uploaded+t.downloaded))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// printReport prints the top clients and destinations of the given records,
+// by volume and by connection count.
+func printReport(w io.Writer, records []connRecord, limit int) {
+	byBytes := func(a, b *talker) bool { return a.uploaded+a.downloaded > b.uploaded+b.downloaded }
+	byConns := func(a, b *talker) bool { return a.conns > b.conns }
+	clients := topTalkers(records, func(r connRecord) string { return r.Client })
+	destinations := topTalkers(records, func(r connRecord) string {
+		if r.Host == "" {
+			return "-"
+		}
+		return r.Host
+	})
+	fmt.Fprintf(w, "%d connections\n\n", len(records))
+	printTalkers(w, "Top clients by traffic", clients, byBytes, limit)
+	printTalkers(w, "Top clients by connections", clients, byConns, limit)
+	printTalkers(w, "Top destinations by traffic", destinations, byBytes, limit)
+	printTalkers(w, "Top destinations by connections", destinations, byConns, limit)
+}
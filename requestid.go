@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestIDKey holds the ID of the request being served in its context.
+type requestIDKey struct{}
+
+// newRequestID returns a random ID for a request, or a tunnel.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestID returns the ID of the request ctx is about, or "" outside of
+// one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
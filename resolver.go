@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// upstreamResolver reads the next request of a client connection, and
+// returns the connection to its destination.
+type upstreamResolver func(ctx context.Context, conn io.ReadWriter) (upstream *remote, err error)
+
+// resolution is a request on its way through the resolver stages.
+type resolution struct {
+	// the client connection, and its reader holding what follows the
+	// request head
+	conn    io.ReadWriter
+	reader  *bufio.Reader
+	request *http.Request
+	// with --strict-upstream, the order of the header fields of request
+	headerOrder []string
+	// host:port address the request goes to, set by the routing stage
+	address string
+}
+
+// resolveFunc resolves a request into the connection to its destination.
+type resolveFunc func(ctx context.Context, r *resolution) (*remote, error)
+
+// resolveStage is a step of the resolution of the requests, which hands
+// them to next once done with them, or answers them itself. It is run with
+// the handler of the proxy, holding its settings.
+type resolveStage struct {
+	name string
+	run  func(h *handler, ctx context.Context, r *resolution, next resolveFunc) (*remote, error)
+}
+
+// resolveStages are run in order on each request, before the resolver
+// dials its destination. Custom builds can add their own stages with
+// insertResolveStage, from the init function of a file of theirs.
+var resolveStages = []resolveStage{
+	{name: "debug", run: (*handler).debugStage},
+	{name: "tag", run: (*handler).tagStage},
+	{name: "auth", run: (*handler).authStage},
+	{name: "hooks", run: (*handler).hooksStage},
+	{name: "routing", run: (*handler).routingStage},
+	{name: "safesearch", run: (*handler).safeSearchStage},
+	{name: "acl", run: (*handler).aclStage},
+	{name: "faults", run: (*handler).faultStage},
+	{name: "chaos", run: (*handler).chaosStage},
+	{name: "mocks", run: (*handler).mockStage},
+}
+
+// insertResolveStage inserts stage before the stage named before, or after
+// the last one when there is none.
+func insertResolveStage(before string, stage resolveStage) {
+	for i, s := range resolveStages {
+		if s.name == before {
+			resolveStages = append(resolveStages[:i], append([]resolveStage{stage}, resolveStages[i:]...)...)
+			return
+		}
+	}
+	resolveStages = append(resolveStages, stage)
+}
+
+// chainResolver returns the resolver running the requests through the
+// stages, and then through dial.
+func (h *handler) chainResolver(dial resolveFunc) upstreamResolver {
+	return func(ctx context.Context, conn io.ReadWriter) (*remote, error) {
+		client := requestConn(conn)
+		req, order, err := readRequest(client, h.headers.strictUpstream)
+		if err != nil {
+			return nil, err
+		}
+		r := &resolution{conn: conn, reader: client.reader, request: req, headerOrder: order}
+		return h.runStages(ctx, resolveStages, r, dial)
+	}
+}
+
+func (h *handler) runStages(ctx context.Context, stages []resolveStage, r *resolution, dial resolveFunc) (*remote, error) {
+	if len(stages) == 0 {
+		return dial(ctx, r)
+	}
+	return stages[0].run(h, ctx, r, func(ctx context.Context, r *resolution) (*remote, error) {
+		return h.runStages(ctx, stages[1:], r, dial)
+	})
+}
+
+// authStage authenticates the clients.
+func (h *handler) authStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if err := h.authenticate(ctx, r.conn, r.request); err != nil {
+		return nil, err
+	}
+	return next(ctx, r)
+}
+
+// hooksStage runs the on_request hook of the script.
+func (h *handler) hooksStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if err := h.scripts.requestReceived(ctx, r.conn, r.request); err != nil {
+		return nil, err
+	}
+	return next(ctx, r)
+}
+
+// routingStage answers the requests about the proxy itself, and selects the
+// destination of the others.
+func (h *handler) routingStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	req := r.request
+	if err := answerOptions(r.conn, req); err != nil {
+		return nil, err
+	}
+	var err error
+	if req.Method == "CONNECT" {
+		r.address, err = connectAddress(req.Host)
+	} else {
+		if err := rewriteURL(h.settings().rewrites, req); err != nil {
+			return nil, err
+		}
+		r.address, err = destinationAddress(req.URL)
+	}
+	if err != nil {
+		return nil, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	if r.address, err = h.scripts.routeSelected(ctx, r.conn, req, r.address); err != nil {
+		return nil, err
+	}
+	return next(ctx, r)
+}
+
+// aclStage refuses the destinations clients are not allowed to reach.
+func (h *handler) aclStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if err := h.checkDestination(r.address); err != nil {
+		var refused *statusError
+		if errors.As(err, &refused) {
+			err = &deniedError{kind: notifyBlocked, method: r.request.Method, host: r.address, status: refused.status, reason: err.Error(), err: err}
+		}
+		return nil, err
+	}
+	return next(ctx, r)
+}
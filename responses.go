@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// statusError is an error the client is answered with a given status for.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// answeredError is returned by resolvers once they answered a request
+// addressed to the proxy itself.
+type answeredError struct {
+	// whether the client connection can carry another request
+	keepAlive bool
+}
+
+func (e *answeredError) Error() string {
+	return "request answered by the proxy"
+}
+
+// answerOptions answers the OPTIONS * requests, which are about the proxy
+// rather than about a destination.
+func answerOptions(w io.Writer, req *http.Request) error {
+	if req.Method != "OPTIONS" || req.RequestURI != "*" {
+		return nil
+	}
+	return answer(w, req, http.StatusOK, http.Header{
+		"Allow": {"OPTIONS, GET, HEAD, POST, PUT, PATCH, DELETE, CONNECT"},
+	})
+}
+
+// answer answers a request addressed to the proxy itself with status, header
+// and an empty body, once its body is read.
+func answer(w io.Writer, req *http.Request, status int, header http.Header) error {
+	return answerBody(w, req, status, header, "")
+}
+
+// answerError answers a request the proxy denied with status, header, and
+// the error page for reason.
+func (p *errorPages) answerError(ctx context.Context, w io.Writer, req *http.Request, status int, header http.Header, reason string) error {
+	body, contentType := p.errorBody(ctx, status, reason)
+	header.Set("Content-Type", contentType)
+	return answerBody(w, req, status, header, body)
+}
+
+func answerBody(w io.Writer, req *http.Request, status int, header http.Header, body string) error {
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return err
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Close {
+		header.Set("Connection", "close")
+	}
+	response := &bytes.Buffer{}
+	fmt.Fprintf(response, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(response)
+	response.WriteString("\r\n")
+	response.WriteString(body)
+	if _, err := w.Write(response.Bytes()); err != nil {
+		return err
+	}
+	return &answeredError{keepAlive: !req.Close}
+}
+
+// errorStatus returns the status to answer a request that failed with err,
+// or 0 when the client is gone or must not be answered.
+func errorStatus(err error) int {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status
+	}
+	if errors.Is(err, errHeaderTooLarge) {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		switch {
+		case opErr.Op == "dial" && opErr.Timeout():
+			return http.StatusGatewayTimeout
+		case opErr.Op == "dial":
+			return http.StatusBadGateway
+		case opErr.Timeout():
+			return http.StatusRequestTimeout
+		}
+		return 0
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	// anything else comes from parsing the request
+	return http.StatusBadRequest
+}
+
+// errorReasons are what the clients are told of the requests that failed
+// with each status. The errors themselves can tell about the network of the
+// proxy, and are only logged.
+var errorReasons = map[int]string{
+	http.StatusBadRequest:                  "the request is malformed",
+	http.StatusForbidden:                   "the request is not allowed by the proxy",
+	http.StatusRequestTimeout:              "the request was not received in time",
+	http.StatusTooManyRequests:             "too many requests, try again later",
+	http.StatusRequestHeaderFieldsTooLarge: "the request header is too large",
+	http.StatusInternalServerError:         "the proxy failed to handle the request",
+	http.StatusBadGateway:                  "the destination could not be reached",
+	http.StatusServiceUnavailable:          "the proxy is not available",
+	http.StatusGatewayTimeout:              "the destination did not answer in time",
+}
+
+// errorReason returns what the client is told of a request that failed
+// with status.
+func errorReason(status int) string {
+	if reason, ok := errorReasons[status]; ok {
+		return reason
+	}
+	return strings.ToLower(http.StatusText(status))
+}
+
+// writeError answers the request of ctx, that could not be served because
+// of err, with status and the error page describing it.
+func (p *errorPages) writeError(ctx context.Context, w io.Writer, status int, err error) error {
+	debugf("%s: answering %d: %v", requestID(ctx), status, err)
+	body, contentType := p.errorBody(ctx, status, errorReason(status))
+	_, werr := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), contentType, len(body), body)
+	return werr
+}
+
+// errorResponse is the response writeError writes, for the code relaying
+// responses rather than writing them.
+func (p *errorPages) errorResponse(ctx context.Context, req *http.Request, status int, err error) *http.Response {
+	debugf("%s: answering %d: %v", requestID(ctx), status, err)
+	body, contentType := p.errorBody(ctx, status, errorReason(status))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+}
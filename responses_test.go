@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 12), Port: 8080}, Err: errors.New("connection refused")}
+	tests := []struct {
+		status int
+		err    error
+		body   string
+	}{
+		{status: 502, err: dialErr, body: "502 Bad Gateway: the destination could not be reached\n"},
+		{status: 502, err: &net.DNSError{Err: "no such host", Name: "internal.example.net", Server: "10.0.0.2:53"}, body: "502 Bad Gateway: the destination could not be reached\n"},
+		{status: 403, err: errors.New("destination 10.0.0.12:8080 is a local address"), body: "403 Forbidden: the request is not allowed by the proxy\n"},
+		{status: 504, err: context.DeadlineExceeded, body: "504 Gateway Timeout: the destination did not answer in time\n"},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		if err := (*errorPages)(nil).writeError(context.Background(), out, test.status, test.err); err != nil {
+			t.Fatal(err)
+		}
+		if body := out.String()[strings.Index(out.String(), "\r\n\r\n")+4:]; body != test.body {
+			t.Errorf("%v: answered %q, expected %q", test.err, body, test.body)
+		}
+	}
+}
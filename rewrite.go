@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule replaces the URLs of plain HTTP requests matching pattern,
+// the submatches of pattern being expanded in replacement as $1, $2...
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseRewriteRule parses rules like
+// "^http://old.example.net/(.*) http://new.example.net/v2/$1".
+func parseRewriteRule(v string) (*rewriteRule, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid rewrite rule %q: expected pattern replacement", v)
+	}
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite rule %q: %v", v, err)
+	}
+	return &rewriteRule{pattern: pattern, replacement: fields[1]}, nil
+}
+
+// rewriteURL applies the first of rules matching the URL of req, which is
+// then sent to the host of the new URL.
+func rewriteURL(rules []*rewriteRule, req *http.Request) error {
+	from := req.URL.String()
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(from) {
+			continue
+		}
+		to := rule.pattern.ReplaceAllString(from, rule.replacement)
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" {
+			return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("rewriting %s: invalid URL %q", from, to)}
+		}
+		req.URL = u
+		req.Host = u.Host
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// safeSearch sends the requests to the search engines to their SafeSearch
+// variants, and the ones to YouTube to its restricted mode, youTubeRestrict
+// being either "strict" or "moderate".
+type safeSearch struct {
+	youTubeRestrict string
+}
+
+// safeSearchConfig reads the SafeSearch settings, and returns nil when it
+// is not enforced.
+func safeSearchConfig(config *viper.Viper) *safeSearch {
+	if !config.GetBool("safe-search") {
+		return nil
+	}
+	return &safeSearch{youTubeRestrict: config.GetString("youtube-restrict")}
+}
+
+// safeSearchEngine is a service enforcing SafeSearch on the clients of some
+// of its hosts, the way networks do with CNAME records.
+type safeSearchEngine struct {
+	matches func(host string) bool
+	// the host to send the requests to, given the YouTube restriction
+	safeHost func(youTubeRestrict string) string
+	// query parameter enforcing SafeSearch on plain HTTP searches, and
+	// header enforcing it on any plain HTTP request
+	param  string
+	value  string
+	header string
+}
+
+func hostIn(hosts ...string) func(string) bool {
+	return func(host string) bool {
+		for _, h := range hosts {
+			if host == h {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isGoogleHost tells whether host is one of the search domains of Google,
+// like www.google.com or google.co.uk.
+func isGoogleHost(host string) bool {
+	host = strings.TrimPrefix(host, "www.")
+	if !strings.HasPrefix(host, "google.") {
+		return false
+	}
+	labels := strings.Split(strings.TrimPrefix(host, "google."), ".")
+	return len(labels) == 1 || (len(labels) == 2 && (labels[0] == "co" || labels[0] == "com"))
+}
+
+var safeSearchEngines = []safeSearchEngine{
+	{
+		matches:  isGoogleHost,
+		safeHost: func(string) string { return "forcesafesearch.google.com" },
+		param:    "safe",
+		value:    "active",
+	},
+	{
+		matches:  hostIn("bing.com", "www.bing.com"),
+		safeHost: func(string) string { return "strict.bing.com" },
+		param:    "adlt",
+		value:    "strict",
+	},
+	{
+		matches:  hostIn("duckduckgo.com", "www.duckduckgo.com"),
+		safeHost: func(string) string { return "safe.duckduckgo.com" },
+		param:    "kp",
+		value:    "1",
+	},
+	{
+		matches: hostIn("youtube.com", "www.youtube.com", "m.youtube.com", "youtubei.googleapis.com",
+			"youtube.googleapis.com", "www.youtube-nocookie.com"),
+		safeHost: func(restrict string) string {
+			if restrict == "strict" {
+				return "restrict.youtube.com"
+			}
+			return "restrictmoderate.youtube.com"
+		},
+		header: "YouTube-Restrict",
+	},
+}
+
+// safeSearchStage sends the requests to the search engines to their
+// SafeSearch hosts, and sets their SafeSearch parameters on the plain HTTP
+// ones.
+func (h *handler) safeSearchStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if h.safeSearch == nil {
+		return next(ctx, r)
+	}
+	host, port, err := net.SplitHostPort(r.address)
+	if err != nil {
+		return next(ctx, r)
+	}
+	host = strings.ToLower(host)
+	for _, engine := range safeSearchEngines {
+		if !engine.matches(host) {
+			continue
+		}
+		r.address = net.JoinHostPort(engine.safeHost(h.safeSearch.youTubeRestrict), port)
+		req := r.request
+		if req.Method == "CONNECT" {
+			// for upstream proxies, TLS clients still asking for the
+			// original host
+			req.Host = r.address
+			req.RequestURI = r.address
+			break
+		}
+		if query := req.URL.Query(); engine.param != "" && query.Get("q") != "" {
+			query.Set(engine.param, engine.value)
+			req.URL.RawQuery = query.Encode()
+		}
+		if engine.header != "" {
+			restrict := "Moderate"
+			if h.safeSearch.youTubeRestrict == "strict" {
+				restrict = "Strict"
+			}
+			req.Header.Set(engine.header, restrict)
+		}
+		break
+	}
+	return next(ctx, r)
+}
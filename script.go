@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scriptHooks runs the hooks a Lua script defines as global functions:
+//
+//	on_request(req): once a request is received
+//	on_route(req, address): once the host:port address it goes to is selected
+//	on_response(req, resp): before a plain HTTP response is relayed
+//
+// req has the method, url, host and headers fields, resp the status and
+// headers ones, the header fields being keyed by their canonical names.
+// on_request can change the url, the host of CONNECT requests and the
+// headers, on_response the status and the headers. on_request and on_route
+// can answer the request themselves by returning a status code, and
+// optionally a table of header fields. on_route can also return another
+// host:port address to send the request to.
+type scriptHooks struct {
+	proto *lua.FunctionProto
+	// the states are not safe for concurrent use, each request borrows one
+	states sync.Pool
+}
+
+// scriptConfig loads the hooks of the --script file, and returns nil when
+// there is none.
+func scriptConfig(config *viper.Viper) (*scriptHooks, error) {
+	path := config.GetString("script")
+	if path == "" {
+		return nil, nil
+	}
+	return loadScript(path)
+}
+
+// loadScript compiles the Lua script at path, and runs it once to report
+// its errors early.
+func loadScript(path string) (*scriptHooks, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	chunk, err := parse.Parse(source, path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scriptHooks{proto: proto}
+	L, err := s.state()
+	if err != nil {
+		return nil, err
+	}
+	s.states.Put(L)
+	return s, nil
+}
+
+func (s *scriptHooks) state() (*lua.LState, error) {
+	if L, ok := s.states.Get().(*lua.LState); ok {
+		return L, nil
+	}
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	return L, nil
+}
+
+// call calls the hook name with the arguments args builds, if the script
+// defines it, and hands its two first results to results.
+func (s *scriptHooks) call(ctx context.Context, name string, args func(L *lua.LState) []lua.LValue, results func(L *lua.LState, r1, r2 lua.LValue) error) error {
+	L, err := s.state()
+	if err != nil {
+		return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("script: %v", err)}
+	}
+	fn := L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		s.states.Put(L)
+		return nil
+	}
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, args(L)...)
+	L.RemoveContext()
+	if err != nil {
+		L.SetTop(0)
+		s.states.Put(L)
+		warnf("script %s failed: %v", name, err)
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			// the stack trace stays in the logs
+			err = fmt.Errorf("%s", apiErr.Object)
+		}
+		return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("script %s: %v", name, err)}
+	}
+	r1, r2 := L.Get(-2), L.Get(-1)
+	L.SetTop(0)
+	err = results(L, r1, r2)
+	s.states.Put(L)
+	return err
+}
+
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range header {
+		t.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+// applyHeaderTable applies the changes a script made to the header fields
+// of t, which was built from header.
+func applyHeaderTable(header http.Header, t *lua.LTable) {
+	for name := range header {
+		if t.RawGetString(name) == lua.LNil {
+			header.Del(name)
+		}
+	}
+	t.ForEach(func(k, v lua.LValue) {
+		name := http.CanonicalHeaderKey(k.String())
+		if value := v.String(); strings.Join(header[name], ", ") != value {
+			header.Set(name, value)
+		}
+	})
+}
+
+func requestTable(L *lua.LState, req *http.Request) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	if req.Method != "CONNECT" {
+		t.RawSetString("url", lua.LString(req.URL.String()))
+	}
+	t.RawSetString("host", lua.LString(req.Host))
+	t.RawSetString("headers", headerTable(L, req.Header))
+	return t
+}
+
+// answerWith answers req with the status code a hook returned, if any.
+func answerWith(w io.Writer, req *http.Request, r1, r2 lua.LValue) error {
+	status, ok := r1.(lua.LNumber)
+	if !ok {
+		return nil
+	}
+	if status < 100 || status > 999 {
+		return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("script: invalid status code %v", status)}
+	}
+	header := http.Header{}
+	if t, ok := r2.(*lua.LTable); ok {
+		t.ForEach(func(k, v lua.LValue) {
+			header.Set(k.String(), v.String())
+		})
+	}
+	return answer(w, req, int(status), header)
+}
+
+// requestReceived runs the on_request hook for req, received from w.
+func (s *scriptHooks) requestReceived(ctx context.Context, w io.Writer, req *http.Request) error {
+	if s == nil {
+		return nil
+	}
+	var t *lua.LTable
+	return s.call(ctx, "on_request", func(L *lua.LState) []lua.LValue {
+		t = requestTable(L, req)
+		return []lua.LValue{t}
+	}, func(L *lua.LState, r1, r2 lua.LValue) error {
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(req.Header, headers)
+		}
+		if req.Method == "CONNECT" {
+			req.Host = t.RawGetString("host").String()
+			req.RequestURI = req.Host
+		} else if to := t.RawGetString("url").String(); to != req.URL.String() {
+			u, err := url.Parse(to)
+			if err != nil || u.Host == "" {
+				return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("script: invalid URL %q", to)}
+			}
+			req.URL = u
+			req.Host = u.Host
+		}
+		return answerWith(w, req, r1, r2)
+	})
+}
+
+// routeSelected runs the on_route hook for req, received from w and going
+// to address, and returns the address to send it to.
+func (s *scriptHooks) routeSelected(ctx context.Context, w io.Writer, req *http.Request, address string) (string, error) {
+	if s == nil {
+		return address, nil
+	}
+	err := s.call(ctx, "on_route", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{requestTable(L, req), lua.LString(address)}
+	}, func(L *lua.LState, r1, r2 lua.LValue) error {
+		to, ok := r1.(lua.LString)
+		if !ok {
+			return answerWith(w, req, r1, r2)
+		}
+		rerouted, err := connectAddress(string(to))
+		if err != nil {
+			return &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("script: %v", err)}
+		}
+		// the Host header of plain requests is kept for the new destination
+		address = rerouted
+		req.URL.Host = address
+		if req.Method == "CONNECT" {
+			req.Host = address
+			req.RequestURI = address
+		}
+		return nil
+	})
+	return address, err
+}
+
+// responseReceived runs the on_response hook for resp, answering req.
+func (s *scriptHooks) responseReceived(ctx context.Context, req *http.Request, resp *http.Response) error {
+	if s == nil {
+		return nil
+	}
+	var t *lua.LTable
+	return s.call(ctx, "on_response", func(L *lua.LState) []lua.LValue {
+		t = L.NewTable()
+		t.RawSetString("status", lua.LNumber(resp.StatusCode))
+		t.RawSetString("headers", headerTable(L, resp.Header))
+		return []lua.LValue{requestTable(L, req), t}
+	}, func(L *lua.LState, r1, r2 lua.LValue) error {
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(resp.Header, headers)
+		}
+		if status, ok := t.RawGetString("status").(lua.LNumber); ok && int(status) != resp.StatusCode {
+			if status < 100 || status > 999 {
+				return fmt.Errorf("script: invalid status code %v", status)
+			}
+			resp.StatusCode = int(status)
+			resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// runServe runs the proxy of nanoproxy serve, until it is stopped or hands
+// its listener over to a new process.
+func runServe(cmd *cobra.Command, config *viper.Viper) {
+	if errs := checkSettings(config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+		os.Exit(1)
+	}
+	accessLog, err := setupLogs(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if minLogLevel, err = parseLogLevel(config.GetString("log-level")); err != nil {
+		log.Fatal(err)
+	}
+	if config.GetBool("quiet") && minLogLevel < levelWarn {
+		minLogLevel = levelWarn
+	}
+	if config.GetBool("hardened") {
+		if err := harden(cmd, config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	handoff := config.GetString("handoff-socket")
+	listener, err := listen(config.GetString("bind"), handoff)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer := &proxyDialer{Dialer: net.Dialer{
+		Timeout:   config.GetDuration("dial-timeout"),
+		KeepAlive: config.GetDuration("keepalive"),
+	}}
+	if ttl := config.GetDuration("dns-cache-ttl"); ttl > 0 {
+		dialer.dns = runDNSCache(net.DefaultResolver, ttl)
+	}
+	h, err := newHandler(config, dialer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ready := &readiness{dialer: dialer.Dialer}
+	if upstreamURL := config.GetString("upstream"); upstreamURL != "" {
+		upstream, err := url.Parse(upstreamURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ready.upstream = upstream.Host
+	}
+
+	infof("proxy listening on %s", listener.Addr().String())
+	// the stats channel is never closed: the connections that outlive the
+	// grace period, and the admin server, can send to it until the process
+	// exits
+	h.stats = runStats(config.GetBool("top"), accessLog, config.GetDuration("summary-interval"))
+	dumpOnSignal(h.stats)
+	h.watchConfig(config, cmd)
+	if h.exfiltration != nil {
+		go h.exfiltration.run(h.stats)
+	}
+	if addr := config.GetString("admin"); addr != "" {
+		runAdmin(addr, h.stats, ready, h.cache)
+	}
+	stopper := newStopper(listener, ready)
+	stopper.stopOnSignal()
+	h.stopping = stopper.stopping
+	if handoff != "" {
+		err := serveHandoff(handoff, listener, func() {
+			stopper.stop("handed the listener over to a new process")
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	h.accept(listener, stopper, config.GetInt("workers"))
+	h.drain(config.GetDuration("grace-period"))
+}
+
+// listen takes the listener over from the previous process through the
+// handoff socket when there is one, and listens on bind otherwise.
+func listen(bind, handoff string) (net.Listener, error) {
+	if handoff != "" {
+		listener, err := takeOver(handoff)
+		if err != nil {
+			return nil, err
+		}
+		if listener != nil {
+			infof("took the listener over from the previous process")
+			return listener, nil
+		}
+	}
+	return net.Listen("tcp4", bind)
+}
+
+// newHandler returns the handler of the proxy, the settings of each of its
+// features read from config, dialing the destinations with dialer.
+func newHandler(config *viper.Viper, dialer *proxyDialer) (*handler, error) {
+	h := &handler{
+		slowSetup:       config.GetDuration("slow-setup-threshold"),
+		slowTotal:       config.GetDuration("slow-threshold"),
+		idleTimeout:     config.GetDuration("idle-timeout"),
+		maxLifetime:     config.GetDuration("max-lifetime"),
+		linger:          config.GetDuration("linger"),
+		resolverTimeout: config.GetDuration("resolver-timeout"),
+		headerTimeout:   config.GetDuration("header-timeout"),
+		maxHeaderSize:   config.GetInt("max-header-size"),
+		tagHeader:       config.GetString("tag-header"),
+		redaction:       redactionConfig(config),
+		safeSearch:      safeSearchConfig(config),
+		chaos:           chaosConfig(config),
+	}
+	h.ctx, h.closeAll = context.WithCancel(context.Background())
+	h.debug = debugConfig(config, h.redaction)
+	var err error
+	if err := h.applySettings(config); err != nil {
+		return nil, err
+	}
+	if config.GetString("upstream") == "" {
+		// the upstream proxy resolves the destinations otherwise
+		dialer.Control = h.refuseLocal
+	}
+	if h.clientSockets, err = socketConfig(config, "client"); err != nil {
+		return nil, err
+	}
+	if h.upstreamSockets, err = socketConfig(config, "upstream"); err != nil {
+		return nil, err
+	}
+	if h.pages, err = errorPagesConfig(config); err != nil {
+		return nil, err
+	}
+	if h.headers, err = headerConfig(config); err != nil {
+		return nil, err
+	}
+	if h.transforms, err = transformConfig(config); err != nil {
+		return nil, err
+	}
+	if h.compression, err = compressionConfig(config); err != nil {
+		return nil, err
+	}
+	if h.scripts, err = scriptConfig(config); err != nil {
+		return nil, err
+	}
+	if h.faults, err = faultConfig(config); err != nil {
+		return nil, err
+	}
+	if h.buffers, err = copyBufferConfig(config); err != nil {
+		return nil, err
+	}
+	if h.cache, err = cacheConfig(config, h.pages); err != nil {
+		return nil, err
+	}
+	if h.redirects, err = redirectConfig(config, dialer, h.checkDestination); err != nil {
+		return nil, err
+	}
+	if h.icap, err = icapConfig(config); err != nil {
+		return nil, err
+	}
+	h.types = typeFilterConfig(config, h.pages)
+	if h.antivirus, err = clamdConfig(config, h.pages); err != nil {
+		return nil, err
+	}
+	if h.dataSaver, err = dataSaverConfig(config); err != nil {
+		return nil, err
+	}
+	if h.memory, err = memoryConfig(config); err != nil {
+		return nil, err
+	}
+	if dir := config.GetString("har-dir"); dir != "" {
+		h.har = &harRecorder{dir: dir, maxBody: config.GetInt("har-max-body")}
+	}
+	if urls := config.GetStringSlice("webhook"); len(urls) > 0 {
+		h.webhooks = runWebhooks(urls, config.GetInt("webhook-batch-size"),
+			config.GetDuration("webhook-flush-interval"), config.GetInt("webhook-retries"))
+	}
+	if h.exfiltration, err = exfiltrationConfig(config, h.webhooks.notify); err != nil {
+		return nil, err
+	}
+	if h.records, err = openRecordStore(config); err != nil {
+		return nil, err
+	}
+	if path := config.GetString("audit-log"); path != "" {
+		if h.audit, err = openAuditLog(path); err != nil {
+			return nil, err
+		}
+	}
+	if dir := config.GetString("capture-dir"); dir != "" {
+		h.capture, err = newCaptureFilter(dir, config.GetStringSlice("capture-host"), config.GetStringSlice("capture-client"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if count := config.GetInt("event-loops"); count > 0 {
+		if h.loops, err = newEventLoops(count, h.buffers.size); err != nil {
+			return nil, err
+		}
+	}
+	if max := config.GetInt("max-conns"); max > 0 {
+		h.limiter = newConnLimiter(max, config.GetDuration("max-conns-wait"))
+	}
+	dial, err := h.dialConfig(config, dialer)
+	if err != nil {
+		return nil, err
+	}
+	h.resolver = h.chainResolver(dial)
+	return h, nil
+}
+
+// dialConfig returns the function connecting the requests to their
+// destination, through the upstream proxy when there is one, and recording
+// or replaying the session when told to.
+func (h *handler) dialConfig(config *viper.Viper, dialer *proxyDialer) (resolveFunc, error) {
+	var warm *warmer
+	if size := config.GetInt("prewarm"); size > 0 {
+		warm = runWarmer(dialer, size, config.GetInt("prewarm-destinations"), config.GetDuration("prewarm-max-age"))
+	}
+	var dial resolveFunc
+	var err error
+	if upstreamURL := config.GetString("upstream"); upstreamURL != "" {
+		dial = h.upstreamProxyDial(dialer, warm, upstreamURL)
+		if config.GetBool("upstream-h2") {
+			if dial, err = h.h2UpstreamDial(dialer, upstreamURL, dial); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		var pool *connPool
+		if size := config.GetInt("pool-size"); size > 0 {
+			pool = newConnPool(size, config.GetDuration("pool-idle-timeout"))
+		}
+		dial = h.directDial(dialer, warm, pool)
+	}
+	if path := config.GetString("record-session"); path != "" {
+		if h.session, err = openSessionRecorder(path); err != nil {
+			return nil, err
+		}
+		dial = h.session.dial(dial)
+	}
+	if path := config.GetString("replay-session"); path != "" {
+		session, err := loadSession(path)
+		if err != nil {
+			return nil, err
+		}
+		session.headers = h.headers
+		dial = session.dial
+		// for the faults and the chaos to strike the same requests
+		rand.Seed(1)
+	}
+	return dial, nil
+}
+
+// accept serves the connections of listener until stopper stops it, with
+// that many workers when set, and a goroutine each otherwise.
+func (h *handler) accept(listener net.Listener, stopper *stopper, workers int) {
+	var pool chan net.Conn
+	if workers > 0 {
+		pool = make(chan net.Conn)
+		for i := 0; i < workers; i++ {
+			go func() {
+				for conn := range pool {
+					h.serve(conn)
+				}
+			}()
+		}
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stopper.stopping:
+				if pool != nil {
+					close(pool)
+				}
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				infof("net/accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			panic(err)
+		}
+		acceptedConns.Add(1)
+		h.conns.Add(1)
+		if pool != nil {
+			// blocks while every worker is busy
+			pool <- conn
+		} else {
+			go h.serve(conn)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// sessionEntry is a request of a recorded session: the destination the
+// resolver picked for it and, for plain HTTP requests, the response of
+// that destination as received.
+type sessionEntry struct {
+	Method  string      `json:"method"`
+	Target  string      `json:"target"`
+	Address string      `json:"address"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+}
+
+func (e *sessionEntry) key() string {
+	return e.Method + " " + e.Target
+}
+
+// newSessionEntry returns the entry of the request of r, routed to its
+// destination.
+func newSessionEntry(r *resolution) *sessionEntry {
+	target := r.request.Host
+	if r.request.Method != "CONNECT" {
+		target = r.request.URL.String()
+	}
+	return &sessionEntry{Method: r.request.Method, Target: target, Address: r.address}
+}
+
+// sessionRecorder writes the requests served by the proxy to a session
+// file, as JSON lines, for them to be replayed later by a sessionReplayer.
+type sessionRecorder struct {
+	mtx  sync.Mutex
+	file *os.File
+}
+
+func openSessionRecorder(path string) (*sessionRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionRecorder{file: file}, nil
+}
+
+func (s *sessionRecorder) save(entry *sessionEntry) {
+	line, err := json.Marshal(entry)
+	if err == nil {
+		s.mtx.Lock()
+		_, err = s.file.Write(append(line, '\n'))
+		s.mtx.Unlock()
+	}
+	if err != nil {
+		warnf("failed to record %s: %v", entry.key(), err)
+	}
+}
+
+// dial records the decisions of the resolver, before handing the requests
+// to dial. Tunnels are saved at once, and plain HTTP requests along with
+// their response, through recordResponse.
+func (s *sessionRecorder) dial(dial resolveFunc) resolveFunc {
+	return func(ctx context.Context, r *resolution) (*remote, error) {
+		entry := newSessionEntry(r)
+		remote, err := dial(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if remote.request == nil {
+			s.save(entry)
+		} else {
+			remote.session = entry
+		}
+		return remote, nil
+	}
+}
+
+// recordResponse records resp, the final response to the request of
+// remote, once its body was read.
+func (s *sessionRecorder) recordResponse(remote *remote, resp *http.Response) {
+	if s == nil || remote.session == nil || resp.StatusCode < 200 {
+		return
+	}
+	entry := remote.session
+	remote.session = nil
+	entry.Status = resp.StatusCode
+	entry.Header = resp.Header.Clone()
+	resp.Body = &sessionBody{ReadCloser: resp.Body, done: func(body []byte) {
+		entry.Body = body
+		s.save(entry)
+	}}
+}
+
+// sessionBody keeps a copy of what is read from a response body, and hands
+// it to done once closed.
+type sessionBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte)
+	once sync.Once
+}
+
+func (b *sessionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *sessionBody) Close() error {
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
+
+// sessionReplayer answers the requests with the responses of a recorded
+// session, without dialing anything. The entries of each request are
+// replayed in the order they were recorded.
+type sessionReplayer struct {
+	mtx     sync.Mutex
+	entries map[string][]*sessionEntry
+	// edits the requests like the dial functions do, set before dial is
+	// used
+	headers *headerPolicy
+}
+
+func loadSession(path string) (*sessionReplayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	s := &sessionReplayer{entries: map[string][]*sessionEntry{}}
+	lines := bufio.NewScanner(file)
+	lines.Buffer(nil, 64<<20)
+	for line := 1; lines.Scan(); line++ {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		entry := &sessionEntry{}
+		if err := json.Unmarshal(lines.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("invalid session %s: line %d: %v", path, line, err)
+		}
+		s.entries[entry.key()] = append(s.entries[entry.key()], entry)
+	}
+	return s, lines.Err()
+}
+
+func (s *sessionReplayer) next(key string) *sessionEntry {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entries := s.entries[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	s.entries[key] = entries[1:]
+	return entries[0]
+}
+
+// dial answers the requests from the session, failing the ones it does not
+// hold, or that the resolver now sends elsewhere, with a 502. Tunnels are
+// encrypted end to end and cannot be replayed: only their destination is
+// checked before they are refused.
+func (s *sessionReplayer) dial(ctx context.Context, r *resolution) (*remote, error) {
+	current := newSessionEntry(r)
+	entry := s.next(current.key())
+	switch {
+	case entry == nil:
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("%s not recorded in the session", current.key())}
+	case entry.Address != current.Address:
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("%s routed to %s, but to %s in the session", current.key(), current.Address, entry.Address)}
+	case r.request.Method == "CONNECT":
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("%s cannot be replayed: tunnels are not recorded", current.key())}
+	}
+	req := r.request
+	s.headers.prepareRequest(ctx, req)
+	client, server := net.Pipe()
+	go replayResponse(server, entry)
+	return &remote{
+		conn:    newPooledConn(client),
+		host:    req.URL.Host,
+		method:  req.Method,
+		path:    req.URL.RequestURI(),
+		request: req,
+		reader:  r.reader,
+	}, nil
+}
+
+// replayResponse reads the request written to conn, and answers it with
+// the response of entry.
+func replayResponse(conn net.Conn, entry *sessionEntry) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    entry.Status,
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// forcedCloseDelay is how long connections are given to close once they are
+// forced to.
+const forcedCloseDelay = 5 * time.Second
+
+// stopper stops accepting connections and marks the proxy as draining, the
+// first time it is asked to.
+type stopper struct {
+	once     sync.Once
+	stopping chan struct{}
+	listener net.Listener
+	ready    *readiness
+}
+
+func newStopper(listener net.Listener, ready *readiness) *stopper {
+	return &stopper{stopping: make(chan struct{}), listener: listener, ready: ready}
+}
+
+func (s *stopper) stop(reason string) {
+	s.once.Do(func() {
+		infof("%s, no longer accepting connections", reason)
+		s.ready.drain()
+		close(s.stopping)
+		s.listener.Close()
+	})
+}
+
+// stopOnSignal stops once SIGINT or SIGTERM is received.
+func (s *stopper) stopOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		s.stop(fmt.Sprintf("received %s", sig))
+	}()
+}
+
+// drain waits up to grace for the active connections to finish, closes the
+// remaining ones, then waits for the stats goroutine to handle their last
+// events.
+func (h *handler) drain(grace time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(finished)
+	}()
+	if active := activeConns.Value(); active > 0 {
+		infof("waiting up to %s for %d connections to finish", humanDuration(grace), active)
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-finished:
+	case <-timer.C:
+		warnf("grace period expired, closing %d connections", activeConns.Value())
+		h.closeAll()
+		select {
+		case <-finished:
+		case <-time.After(forcedCloseDelay):
+			warnf("%d connections did not close", activeConns.Value())
+			return
+		}
+	}
+	// events are handled in order, so this returns after the last ones
+	inspect(h.stats, func(*stats) {})
+}
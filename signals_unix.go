@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// reopenSignal asks nanoproxy to reopen its log files.
+	reopenSignal os.Signal = syscall.SIGUSR2
+	// dumpSignal asks nanoproxy to log its state.
+	dumpSignal os.Signal = syscall.SIGUSR1
+	// reloadSignal asks nanoproxy to read its config file again.
+	reloadSignal os.Signal = syscall.SIGHUP
+)
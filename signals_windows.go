@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// reopenSignal, dumpSignal and reloadSignal are not available on Windows.
+var (
+	reopenSignal os.Signal
+	dumpSignal   os.Signal
+	reloadSignal os.Signal
+)
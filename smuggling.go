@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// checkRequestHead rejects the request headers that proxies and servers
+// down the chain could read differently than nanoproxy does: conflicting
+// body lengths, obsolete line folding and control characters.
+func checkRequestHead(head []byte) error {
+	lines := bytes.Split(bytes.TrimRight(head, "\r\n"), []byte("\n"))
+	var contentLength, transferEncoding bool
+	for i, line := range lines {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		for _, c := range line {
+			if (c < ' ' && c != '\t') || c == 0x7f {
+				return fmt.Errorf("control character %q in request header", c)
+			}
+		}
+		if i == 0 {
+			continue
+		}
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return errors.New("obsolete line folding in request header")
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			return fmt.Errorf("malformed request header line %q", line)
+		}
+		name := line[:colon]
+		if bytes.ContainsAny(name, " \t") {
+			return fmt.Errorf("whitespace in request header name %q", name)
+		}
+		switch {
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			contentLength = true
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			transferEncoding = true
+		}
+	}
+	if contentLength && transferEncoding {
+		return errors.New("request has both Content-Length and Transfer-Encoding")
+	}
+	return nil
+}
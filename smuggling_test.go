@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestCheckRequestHead(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    string
+		invalid bool
+	}{
+		{
+			name: "plain request",
+			head: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name: "content length",
+			head: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n",
+		},
+		{
+			name: "chunked",
+			head: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n",
+		},
+		{
+			name: "bare line feeds",
+			head: "GET http://example.com/ HTTP/1.1\nHost: example.com\n\n",
+		},
+		{
+			name: "tab in value",
+			head: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-List: a,\tb\r\n\r\n",
+		},
+		{
+			name:    "content length and transfer encoding",
+			head:    "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "transfer encoding and content length in other cases",
+			head:    "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\ntransfer-encoding: chunked\r\nCONTENT-LENGTH: 5\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "obs-fold with a space",
+			head:    "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Folded: a\r\n b\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "obs-fold with a tab",
+			head:    "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding:\r\n\tchunked\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "whitespace before the colon",
+			head:    "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding : chunked\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "line without colon",
+			head:    "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Broken\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "NUL in value",
+			head:    "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Value: a\x00b\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "bare carriage return",
+			head:    "GET http://example.com/ HTTP/1.1\r\nHost: example.com\rX-Injected: 1\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "DEL in name",
+			head:    "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-\x7fValue: 1\r\n\r\n",
+			invalid: true,
+		},
+		{
+			name:    "control character in request line",
+			head:    "GET http://example.com/\x01 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			invalid: true,
+		},
+	}
+	for _, test := range tests {
+		err := checkRequestHead([]byte(test.head))
+		switch {
+		case test.invalid && err == nil:
+			t.Errorf("%s: expected the header to be rejected", test.name)
+		case !test.invalid && err != nil:
+			t.Errorf("%s: rejected: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// socketOptions tunes the TCP sockets on one side of the proxy, for links
+// where the system defaults do not fit, like high-latency ones.
+type socketOptions struct {
+	noDelay    bool
+	sendBuffer int
+	recvBuffer int
+	// interval between keep-alive probes, zero to keep the system setting
+	// and negative to disable keep-alives
+	keepAlive time.Duration
+	// how long sent data may stay unacknowledged before the connection is
+	// dropped
+	userTimeout time.Duration
+}
+
+// socketConfig reads the socket options whose flags start with prefix.
+func socketConfig(config *viper.Viper, prefix string) (socketOptions, error) {
+	o := socketOptions{
+		noDelay:     config.GetBool(prefix + "-nodelay"),
+		keepAlive:   config.GetDuration(prefix + "-keepalive"),
+		userTimeout: config.GetDuration(prefix + "-user-timeout"),
+	}
+	for key, size := range map[string]*int{"-send-buffer": &o.sendBuffer, "-recv-buffer": &o.recvBuffer} {
+		value := config.GetString(prefix + key)
+		if value == "" {
+			continue
+		}
+		bytes, err := parseSize(value)
+		if err != nil {
+			return o, err
+		}
+		*size = int(bytes)
+	}
+	if o.userTimeout > 0 && !userTimeoutSupported {
+		return o, errors.New("TCP user timeout is only supported on Linux")
+	}
+	return o, nil
+}
+
+func (o socketOptions) apply(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(o.noDelay); err != nil {
+		return err
+	}
+	if o.sendBuffer > 0 {
+		if err := conn.SetWriteBuffer(o.sendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.recvBuffer > 0 {
+		if err := conn.SetReadBuffer(o.recvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.keepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.keepAlive > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := conn.SetKeepAlivePeriod(o.keepAlive); err != nil {
+			return err
+		}
+	}
+	if o.userTimeout > 0 {
+		return setUserTimeout(conn, o.userTimeout)
+	}
+	return nil
+}
+
+// tcpConnOf returns the TCP connection under a dialed upstream connection.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	switch wrapper := conn.(type) {
+	case *monitoredConn:
+		conn = wrapper.Conn
+	case *pooledConn:
+		conn = wrapper.Conn
+	case *recordingConn:
+		conn = wrapper.Conn
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	return tcp, ok
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const userTimeoutSupported = true
+
+// missing from the frozen syscall package
+const tcpUserTimeout = 0x12
+
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+const userTimeoutSupported = false
+
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return nil
+}
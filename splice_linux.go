@@ -0,0 +1,5 @@
+package main
+
+// spliceSupported tells whether the kernel can relay bytes between two
+// sockets.
+const spliceSupported = true
@@ -1,54 +1,292 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
+// statsQueueSize is the number of events waiting for the stats goroutine
+// past which new ones are dropped.
+const statsQueueSize = 1024
+
+var droppedEvents = expvar.NewMap("dropped_stats_events")
+
+// maxDestinations bounds the destination hosts whose traffic is tracked
+// one by one, the others adding up under otherDestinations.
+const maxDestinations = 1000
+
+const otherDestinations = "(other)"
+
 type kind int
 
 const (
 	connAdded kind = iota
 	connRemoved
+	connFailed
+	statsQueried
 )
 
 type event struct {
-	kind kind
-	conn *metricConn
+	kind  kind
+	conn  *metricConn
+	query func(*stats)
+}
+
+var kindNames = map[kind]string{
+	connAdded:   "added",
+	connRemoved: "removed",
+	connFailed:  "failed",
+}
+
+// emit queues e for the stats goroutine, dropping it rather than stalling
+// the connection when the goroutine can't keep up.
+func emit(ch chan event, e event) {
+	select {
+	case ch <- e:
+	default:
+		droppedEvents.Add(kindNames[e.kind], 1)
+	}
+}
+
+type destinationStats struct {
+	Host        string `json:"host"`
+	Connections uint64 `json:"connections"`
+	Uploaded    uint64 `json:"uploaded_bytes"`
+	Downloaded  uint64 `json:"downloaded_bytes"`
+}
+
+func (d destinationStats) total() uint64 {
+	return d.Uploaded + d.Downloaded
 }
 
 type stats struct {
-	events chan event
-	conn   []*metricConn
+	events       chan event
+	conn         []*metricConn
+	totalConns   uint64
+	uploaded     uint64
+	downloaded   uint64
+	destinations map[string]*destinationStats
+	tags         map[string]*tagStats
+	durations    *histogram
+	firstBytes   *histogram
+	sizes        *histogram
+	subscribers  map[chan notification]struct{}
+}
+
+// publish sends n to the subscribers of the event stream, skipping those
+// who can't keep up.
+func (s *stats) publish(n notification) {
+	for ch := range s.subscribers {
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+}
+
+// window aggregates the activity between two summary lines.
+type window struct {
+	conns      uint64
+	errors     uint64
+	uploaded   uint64
+	downloaded uint64
+}
+
+// transferred returns the number of bytes uploaded and downloaded since the
+// proxy started, including the connections still in flight.
+func (s *stats) transferred() (uploaded uint64, downloaded uint64) {
+	uploaded, downloaded = s.uploaded, s.downloaded
+	for _, conn := range s.conn {
+		counters := conn.snapshot()
+		uploaded += counters.readBytes
+		downloaded += counters.writtenBytes
+	}
+	return uploaded, downloaded
+}
+
+// growth returns how much a byte counter grew from last to now, or 0 when
+// it went back, as it does when the bytes read past the end of a request
+// are handed to the next one.
+func growth(last, now uint64) uint64 {
+	if now < last {
+		return 0
+	}
+	return now - last
 }
 
-func runStats() chan event {
-	ch := make(chan event, 20)
-	stats := &stats{}
+// histograms summarizes the duration, time to first byte, and volume of the
+// closed connections. Durations are in milliseconds.
+func (s *stats) histograms() map[string]histogramSummary {
+	return map[string]histogramSummary{
+		"duration_ms":           s.durations.summary(),
+		"time_to_first_byte_ms": s.firstBytes.summary(),
+		"transferred_bytes":     s.sizes.summary(),
+	}
+}
+
+// destinationEntry returns the entry of s.destinations counting the traffic
+// of host: its own while there is room for it, the shared one of the other
+// hosts otherwise.
+func (s *stats) destinationEntry(host string) string {
+	if _, ok := s.destinations[host]; ok || len(s.destinations) < maxDestinations {
+		return host
+	}
+	return otherDestinations
+}
+
+// topDestinations returns the traffic of each destination host, including
+// the connections still in flight, by decreasing volume.
+func (s *stats) topDestinations() []destinationStats {
+	hosts := make(map[string]destinationStats, len(s.destinations))
+	for host, destination := range s.destinations {
+		hosts[host] = *destination
+	}
+	for _, conn := range s.conn {
+		counters := conn.snapshot()
+		host := s.destinationEntry(conn.remote.host)
+		destination := hosts[host]
+		destination.Host = host
+		destination.Connections++
+		destination.Uploaded += counters.readBytes
+		destination.Downloaded += counters.writtenBytes
+		hosts[host] = destination
+	}
+	out := make([]destinationStats, 0, len(hosts))
+	for _, destination := range hosts {
+		out = append(out, destination)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].total() > out[j].total()
+	})
+	return out
+}
+
+// inspect runs fn on the stats goroutine, and waits for it to return.
+func inspect(ch chan event, fn func(*stats)) {
+	done := make(chan struct{})
+	ch <- event{kind: statsQueried, query: func(s *stats) {
+		defer close(done)
+		fn(s)
+	}}
+	<-done
+}
+
+// runStats handles the events sent to the returned channel on a goroutine
+// of its own, until the channel is closed once nothing sends to it anymore.
+func runStats(top bool, accessLog io.Writer, summaryInterval time.Duration) chan event {
+	ch := make(chan event, statsQueueSize)
+	stats := &stats{
+		destinations: map[string]*destinationStats{},
+		tags:         map[string]*tagStats{},
+		durations:    newHistogram(exponentialBounds(1, 2, 25)),
+		firstBytes:   newHistogram(exponentialBounds(1, 2, 16)),
+		sizes:        newHistogram(exponentialBounds(128, 2, 32)),
+		subscribers:  map[chan notification]struct{}{},
+	}
+	var board *dashboard
+	if top {
+		board = newDashboard(os.Stdout)
+	}
 	go func() {
 		ticker := time.NewTicker(300 * time.Millisecond)
 		defer ticker.Stop()
+		var summaries <-chan time.Time
+		if summaryInterval > 0 {
+			summaryTicker := time.NewTicker(summaryInterval)
+			defer summaryTicker.Stop()
+			summaries = summaryTicker.C
+		}
+		current := window{}
 		for {
 			select {
 			case <-ticker.C:
-				/*for _, conn := range stats.conn {
-					fmt.Printf("%s %s\n", conn.host, humanDuration(time.Since(conn.startedAt)))
-				}*/
-			case event := <-ch:
+				// forget the connections whose removal was dropped
+				open := stats.conn[:0]
+				for _, conn := range stats.conn {
+					if atomic.LoadInt32(&conn.closed) == 0 {
+						open = append(open, conn)
+					}
+				}
+				stats.conn = open
+				if board != nil {
+					board.render(stats)
+				}
+			case <-summaries:
+				uploaded, downloaded := stats.transferred()
+				infof("summary: %d active, %d new, %d errors, %s up, %s down in the last %s",
+					len(stats.conn), current.conns, current.errors,
+					humanBytes(growth(current.uploaded, uploaded)), humanBytes(growth(current.downloaded, downloaded)),
+					summaryInterval)
+				current = window{uploaded: uploaded, downloaded: downloaded}
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
 				switch event.kind {
 				case connAdded:
 					stats.conn = append(stats.conn, event.conn)
+					stats.totalConns++
+					current.conns++
+					stats.publish(connNotification(notifyConnOpened, event.conn))
+				case connFailed:
+					current.errors++
 				case connRemoved:
-					fmt.Printf("%s %s%s (%s %s)\n",
-						event.conn.remote.method, event.conn.remote.host, event.conn.remote.path,
-						humanDuration(time.Since(event.conn.startedAt)),
-						humanBytes(event.conn.readBytes+event.conn.writtenBytes))
+					counters := event.conn.snapshot()
+					stats.uploaded += counters.readBytes
+					stats.downloaded += counters.writtenBytes
+					stats.publish(connNotification(notifyConnClosed, event.conn))
+					host := stats.destinationEntry(event.conn.remote.host)
+					destination, ok := stats.destinations[host]
+					if !ok {
+						destination = &destinationStats{Host: host}
+						stats.destinations[host] = destination
+					}
+					destination.Connections++
+					destination.Uploaded += counters.readBytes
+					destination.Downloaded += counters.writtenBytes
+					if event.conn.tag != "" {
+						tag := stats.tagEntry(event.conn.tag)
+						totals, ok := stats.tags[tag]
+						if !ok {
+							totals = &tagStats{Tag: tag}
+							stats.tags[tag] = totals
+						}
+						totals.Connections++
+						totals.Uploaded += counters.readBytes
+						totals.Downloaded += counters.writtenBytes
+					}
+					stats.durations.observe(milliseconds(time.Since(event.conn.startedAt)))
+					stats.sizes.observe(float64(counters.transferred()))
+					if !counters.firstByteAt.IsZero() {
+						stats.firstBytes.observe(milliseconds(counters.firstByteAt.Sub(event.conn.startedAt)))
+					}
+					if board == nil && logEnabled(levelInfo) {
+						status := ""
+						if event.conn.remote.status != 0 {
+							status = fmt.Sprintf(" %d", event.conn.remote.status)
+						}
+						tag := ""
+						if event.conn.tag != "" {
+							tag = fmt.Sprintf(" tag=%q", event.conn.tag)
+						}
+						fmt.Fprintf(accessLog, "%s %s%s%s (%s %s) %s%s\n",
+							event.conn.remote.method, event.conn.remote.host, event.conn.remote.path, status,
+							humanDuration(time.Since(event.conn.startedAt)),
+							humanBytes(counters.transferred()), event.conn.id, tag)
+					}
 					for idx, conn := range stats.conn {
 						if conn == event.conn {
 							stats.conn = append(stats.conn[:idx], stats.conn[idx+1:]...)
 							break
 						}
 					}
+				case statsQueried:
+					event.query(stats)
 				}
 			}
 		}
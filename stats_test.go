@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGrowth(t *testing.T) {
+	tests := []struct {
+		last, now, growth uint64
+	}{
+		{last: 0, now: 0, growth: 0},
+		{last: 10, now: 25, growth: 15},
+		{last: 25, now: 10, growth: 0},
+		{last: 1 << 63, now: 1<<63 + 1, growth: 1},
+	}
+	for _, test := range tests {
+		if growth := growth(test.last, test.now); growth != test.growth {
+			t.Errorf("growth(%d, %d) = %d, expected %d", test.last, test.now, growth, test.growth)
+		}
+	}
+}
+
+// statsConn returns a connection to host, labeled with tag, which
+// transferred uploaded and downloaded bytes.
+func statsConn(host, tag string, uploaded, downloaded uint64) *metricConn {
+	client, _ := net.Pipe()
+	return &metricConn{
+		conn:         client,
+		remote:       &remote{method: "GET", host: host},
+		startedAt:    time.Now(),
+		readBytes:    uploaded,
+		writtenBytes: downloaded,
+		tag:          tag,
+	}
+}
+
+func TestDestinationStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts int
+		// the traffic of the hosts past maxDestinations, and of the
+		// connection still open to a host never seen before
+		other  uint64
+		tracks int
+	}{
+		{name: "under the limit", hosts: 10, tracks: 11},
+		{name: "at the limit", hosts: maxDestinations, other: 3, tracks: maxDestinations + 1},
+		{name: "over the limit", hosts: maxDestinations + 5, other: 18, tracks: maxDestinations + 1},
+	}
+	for _, test := range tests {
+		ch := runStats(false, ioutil.Discard, 0)
+		for i := 0; i < test.hosts; i++ {
+			ch <- event{kind: connRemoved, conn: statsConn(fmt.Sprintf("host%d.example.com:443", i), "", 1, 2)}
+		}
+		ch <- event{kind: connAdded, conn: statsConn("new.example.com:443", "", 1, 2)}
+		var destinations []destinationStats
+		inspect(ch, func(s *stats) {
+			destinations = s.topDestinations()
+		})
+		close(ch)
+		if len(destinations) != test.tracks {
+			t.Errorf("%s: %d destinations, expected %d", test.name, len(destinations), test.tracks)
+		}
+		var other, total uint64
+		for _, destination := range destinations {
+			if destination.Host == otherDestinations {
+				other = destination.total()
+			}
+			total += destination.total()
+		}
+		if other != test.other {
+			t.Errorf("%s: %d bytes to other destinations, expected %d", test.name, other, test.other)
+		}
+		if expected := uint64(test.hosts+1) * 3; total != expected {
+			t.Errorf("%s: %d bytes in total, expected %d", test.name, total, expected)
+		}
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	tests := []struct {
+		name string
+		tags int
+		// the traffic labeled with the tags past maxTags, and by the
+		// connection still open with a tag never seen before
+		other  uint64
+		tracks int
+	}{
+		{name: "under the limit", tags: 10, tracks: 11},
+		{name: "at the limit", tags: maxTags, other: 3, tracks: maxTags + 1},
+		{name: "over the limit", tags: maxTags + 5, other: 18, tracks: maxTags + 1},
+	}
+	for _, test := range tests {
+		ch := runStats(false, ioutil.Discard, 0)
+		for i := 0; i < test.tags; i++ {
+			ch <- event{kind: connRemoved, conn: statsConn("example.com:443", fmt.Sprintf("team%d", i), 1, 2)}
+		}
+		// untagged traffic is not accounted per tag
+		ch <- event{kind: connRemoved, conn: statsConn("example.com:443", "", 1, 2)}
+		ch <- event{kind: connAdded, conn: statsConn("example.com:443", "new", 1, 2)}
+		var tags []tagStats
+		inspect(ch, func(s *stats) {
+			tags = s.tagTotals()
+		})
+		close(ch)
+		if len(tags) != test.tracks {
+			t.Errorf("%s: %d tags, expected %d", test.name, len(tags), test.tracks)
+		}
+		var other, total uint64
+		for _, totals := range tags {
+			if totals.Tag == otherTags {
+				other = totals.Uploaded + totals.Downloaded
+			}
+			total += totals.Uploaded + totals.Downloaded
+		}
+		if other != test.other {
+			t.Errorf("%s: %d bytes labeled with other tags, expected %d", test.name, other, test.other)
+		}
+		if expected := uint64(test.tags+1) * 3; total != expected {
+			t.Errorf("%s: %d bytes in total, expected %d", test.name, total, expected)
+		}
+	}
+}
+
+func TestKeepAliveAccounting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	requests := []string{
+		"GET http://" + host + "/first HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+		"POST http://" + host + "/second HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\n\r\nhello",
+		"GET http://" + host + "/third HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n",
+	}
+	tests := []struct {
+		name string
+		// whether all the requests are sent at once, rather than each once
+		// the previous one is answered
+		pipelined bool
+	}{
+		{name: "sequential"},
+		{name: "pipelined", pipelined: true},
+	}
+	for _, test := range tests {
+		config := viper.New()
+		config.Set("records-file", filepath.Join(t.TempDir(), "records.json"))
+		h, err := newHandler(config, &proxyDialer{Dialer: net.Dialer{Timeout: time.Second}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, proxied := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.run(proxied)
+		}()
+		if test.pipelined {
+			go client.Write([]byte(strings.Join(requests, "")))
+		}
+		reader := bufio.NewReader(client)
+		for _, request := range requests {
+			if !test.pipelined {
+				go client.Write([]byte(request))
+			}
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			ioutil.ReadAll(resp.Body)
+		}
+		client.Close()
+		<-done
+		records, err := h.records.query(time.Now().Add(-time.Minute), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(requests) {
+			t.Fatalf("%s: %d records, expected %d", test.name, len(records), len(requests))
+		}
+		var uploaded, sent uint64
+		for i, record := range records {
+			uploaded += record.Uploaded
+			sent += uint64(len(requests[i]))
+			// the bytes of the requests read ahead are counted by the one
+			// being served then
+			if !test.pipelined && record.Uploaded != uint64(len(requests[i])) {
+				t.Errorf("%s: request %d uploaded %d bytes, expected %d", test.name, i, record.Uploaded, len(requests[i]))
+			}
+		}
+		if uploaded != sent {
+			t.Errorf("%s: %d bytes uploaded in total, expected %d", test.name, uploaded, sent)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+// logSeverities are the syslog severities of the log levels.
+var logSeverities = map[logLevel]int{
+	levelDebug: severityDebug,
+	levelInfo:  severityInfo,
+	levelWarn:  severityWarning,
+	levelError: severityError,
+}
+
+const (
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+	// interval between two attempts to reconnect to the syslog endpoint
+	syslogRetryInterval = 5 * time.Second
+)
+
+var errSyslogDisconnected = errors.New("syslog endpoint disconnected")
+
+// syslogConn sends RFC 5424 messages to a syslog endpoint, reconnecting in
+// the background when the connection is lost. The messages sent while it is
+// lost are dropped.
+type syslogConn struct {
+	mtx       sync.Mutex
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	appName   string
+	conn      net.Conn
+	dialing   bool
+}
+
+// dialSyslog connects to the syslog endpoint, checking the certificate of
+// tls:// endpoints against tlsConfig.
+func dialSyslog(endpoint string, facility string, tlsConfig *tls.Config) (*syslogConn, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	s := &syslogConn{
+		network:   u.Scheme,
+		addr:      u.Host,
+		tlsConfig: tlsConfig,
+		facility:  code,
+		hostname:  hostname,
+		appName:   filepath.Base(os.Args[0]),
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	case "unix", "unixgram":
+		s.addr = u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog scheme %q", u.Scheme)
+	}
+	if s.conn, err = s.dial(); err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog endpoint %s: %v", endpoint, err)
+	}
+	return s, nil
+}
+
+// syslogTLSConfig returns the TLS config of tls:// syslog endpoints, trusting
+// the CA certificates of the PEM file at caFile when set, and expecting the
+// certificate of serverName when set.
+func syslogTLSConfig(caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificate found", caFile)
+	}
+	return config, nil
+}
+
+func (s *syslogConn) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	switch s.network {
+	case "tls":
+		config := s.tlsConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		return tls.DialWithDialer(dialer, "tcp", s.addr, config)
+	case "unix":
+		// local syslog daemons usually listen on a datagram socket
+		conn, err := dialer.Dial("unixgram", s.addr)
+		if err != nil {
+			conn, err = dialer.Dial("unix", s.addr)
+		}
+		return conn, err
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+// reconnect dials the endpoint again in the background, unless it already
+// does. It is called with mtx held.
+func (s *syslogConn) reconnect() {
+	if s.dialing {
+		return
+	}
+	s.dialing = true
+	go func() {
+		for {
+			conn, err := s.dial()
+			if err == nil {
+				s.mtx.Lock()
+				s.conn = conn
+				s.dialing = false
+				s.mtx.Unlock()
+				return
+			}
+			time.Sleep(syslogRetryInterval)
+		}
+	}()
+}
+
+func (s *syslogConn) stream() bool {
+	_, ok := s.conn.(*net.UDPConn)
+	if ok {
+		return false
+	}
+	unix, ok := s.conn.(*net.UnixConn)
+	return !ok || unix.RemoteAddr().Network() != "unixgram"
+}
+
+func (s *syslogConn) send(severity int, msgID string, msg []byte) error {
+	msg = bytes.TrimRight(msg, "\n")
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.facility*8+severity, time.Now().Format(time.RFC3339Nano),
+		s.hostname, s.appName, os.Getpid(), msgID, msg)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.conn == nil {
+		s.reconnect()
+		return errSyslogDisconnected
+	}
+	// a stuck endpoint must not block the logging goroutines for long
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	var err error
+	if s.stream() {
+		// RFC 6587 octet-counting framing
+		_, err = fmt.Fprintf(s.conn, "%d %s", len(line), line)
+	} else {
+		_, err = s.conn.Write([]byte(line))
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.reconnect()
+	}
+	return err
+}
+
+// messageSeverity returns the syslog severity of a message of the standard
+// logger, told by the prefix of its level.
+func messageSeverity(msg []byte) int {
+	for level, prefix := range logLevelPrefixes {
+		// the prefix follows the date and time of the message
+		if i := bytes.Index(msg, []byte(prefix)); i >= 0 && i <= len("2006/01/02 15:04:05 ") {
+			return logSeverities[level]
+		}
+	}
+	return severityInfo
+}
+
+// syslogWriter is an io.Writer sending each write as a syslog message, at
+// severity, or at the severity of its level when leveled is set.
+type syslogWriter struct {
+	conn     *syslogConn
+	severity int
+	leveled  bool
+	msgID    string
+}
+
+func (w *syslogWriter) Write(buf []byte) (int, error) {
+	severity := w.severity
+	if w.leveled {
+		severity = messageSeverity(buf)
+	}
+	err := w.conn.send(severity, w.msgID, buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
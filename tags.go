@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// maxTagLength bounds the tags kept, longer ones being truncated.
+const maxTagLength = 64
+
+// maxTags bounds the tags whose traffic is tracked one by one, the others
+// adding up under otherTags.
+const maxTags = 100
+
+const otherTags = "(other)"
+
+// tagKey holds, in the context of resolvers, where the tag of the request
+// is to be stored.
+type tagKey struct{}
+
+type tagStats struct {
+	Tag         string `json:"tag"`
+	Connections uint64 `json:"connections"`
+	Uploaded    uint64 `json:"uploaded_bytes"`
+	Downloaded  uint64 `json:"downloaded_bytes"`
+}
+
+// tagStage takes the tag of the requests out of their header, before they
+// go anywhere.
+func (h *handler) tagStage(ctx context.Context, r *resolution, next resolveFunc) (*remote, error) {
+	if h.tagHeader == "" {
+		return next(ctx, r)
+	}
+	tag := strings.TrimSpace(r.request.Header.Get(h.tagHeader))
+	r.request.Header.Del(h.tagHeader)
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	if stored, ok := ctx.Value(tagKey{}).(*string); ok {
+		*stored = tag
+	}
+	return next(ctx, r)
+}
+
+// tagEntry returns the entry of s.tags counting the traffic labeled with
+// tag: its own while there is room for it, the shared one of the other tags
+// otherwise.
+func (s *stats) tagEntry(tag string) string {
+	if _, ok := s.tags[tag]; ok || len(s.tags) < maxTags {
+		return tag
+	}
+	return otherTags
+}
+
+// tagTotals returns the traffic of each tag, active connections included,
+// the largest first.
+func (s *stats) tagTotals() []tagStats {
+	tags := make(map[string]tagStats, len(s.tags))
+	for tag, totals := range s.tags {
+		tags[tag] = *totals
+	}
+	for _, conn := range s.conn {
+		if conn.tag == "" {
+			continue
+		}
+		counters := conn.snapshot()
+		tag := s.tagEntry(conn.tag)
+		totals := tags[tag]
+		totals.Tag = tag
+		totals.Connections++
+		totals.Uploaded += counters.readBytes
+		totals.Downloaded += counters.writtenBytes
+		tags[tag] = totals
+	}
+	out := make([]tagStats, 0, len(tags))
+	for _, totals := range tags {
+		out = append(out, totals)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Uploaded+out[i].Downloaded > out[j].Uploaded+out[j].Downloaded
+	})
+	return out
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const dashboardRows = 20
+
+// dashboard renders a live view of the active connections on a terminal,
+// refreshed on each tick of the stats goroutine.
+type dashboard struct {
+	out       io.Writer
+	lastFrame time.Time
+	lastBytes map[*metricConn]uint64
+}
+
+func newDashboard(out io.Writer) *dashboard {
+	return &dashboard{
+		out:       out,
+		lastFrame: time.Now(),
+		lastBytes: map[*metricConn]uint64{},
+	}
+}
+
+func (d *dashboard) render(s *stats) {
+	now := time.Now()
+	elapsed := now.Sub(d.lastFrame).Seconds()
+	d.lastFrame = now
+
+	seen := make(map[*metricConn]uint64, len(s.conn))
+	active := map[string]int{}
+	rates := map[string]float64{}
+	var inflight uint64
+	var rate float64
+	for _, conn := range s.conn {
+		transferred := conn.snapshot().transferred()
+		inflight += transferred
+		seen[conn] = transferred
+		active[conn.remote.host]++
+		// the counters can go back, when the bytes read past the end of a
+		// request are handed to the next one
+		if last := d.lastBytes[conn]; elapsed > 0 && transferred > last {
+			connRate := float64(transferred-last) / elapsed
+			rates[conn.remote.host] += connRate
+			rate += connRate
+		}
+	}
+	d.lastBytes = seen
+
+	destinations := s.topDestinations()
+	sort.SliceStable(destinations, func(i, j int) bool {
+		return rates[destinations[i].Host] > rates[destinations[j].Host]
+	})
+	conns := make([]*metricConn, len(s.conn))
+	copy(conns, s.conn)
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].startedAt.Before(conns[j].startedAt)
+	})
+
+	w := bufio.NewWriter(d.out)
+	defer w.Flush()
+	// move the cursor home and clear the screen
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "nanoproxy - %d active, %d total, %s transferred, %s/s\n\n",
+		len(s.conn), s.totalConns, humanBytes(s.uploaded+s.downloaded+inflight), humanBytes(uint64(rate)))
+	fmt.Fprintf(w, "%-48s %6s %6s %10s %10s %10s\n", "HOST", "ACTIVE", "CONNS", "UP", "DOWN", "RATE")
+	for idx, destination := range destinations {
+		if idx == dashboardRows {
+			fmt.Fprintf(w, "... %d more\n", len(destinations)-dashboardRows)
+			break
+		}
+		fmt.Fprintf(w, "%-48s %6d %6d %10s %10s %8s/s\n", destination.Host,
+			active[destination.Host], destination.Connections,
+			humanBytes(destination.Uploaded), humanBytes(destination.Downloaded),
+			humanBytes(uint64(rates[destination.Host])))
+	}
+	fmt.Fprintf(w, "\n%-8s %-56s %10s %10s\n", "METHOD", "DESTINATION", "AGE", "BYTES")
+	for idx, conn := range conns {
+		if idx == dashboardRows {
+			fmt.Fprintf(w, "... %d more\n", len(conns)-dashboardRows)
+			break
+		}
+		fmt.Fprintf(w, "%-8s %-56s %10s %10s\n", conn.remote.method,
+			conn.remote.host+conn.remote.path,
+			humanDuration(time.Since(conn.startedAt).Truncate(time.Second)),
+			humanBytes(conn.snapshot().transferred()))
+	}
+}
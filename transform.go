@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// bodyTransform rewrites the bodies of plain HTTP responses as they are
+// relayed.
+type bodyTransform interface {
+	// transform returns the body to relay in place of body, the one of resp
+	// answering req, or nil when the transform does not apply to resp.
+	transform(req *http.Request, resp *http.Response, body io.Reader) io.Reader
+}
+
+// bodyTransforms are applied in order to the uncompressed bodies.
+type bodyTransforms []bodyTransform
+
+// transformConfig reads the banners to inject and the patterns to redact.
+func transformConfig(config *viper.Viper) (bodyTransforms, error) {
+	var transforms bodyTransforms
+	for _, banner := range config.GetStringSlice("inject-banner") {
+		b, err := parseBanner(banner)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, b)
+	}
+	if patterns := config.GetStringSlice("redact"); len(patterns) > 0 {
+		redact := &redactTransform{}
+		for _, pattern := range patterns {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			redact.patterns = append(redact.patterns, compiled)
+		}
+		transforms = append(transforms, redact)
+	}
+	return transforms, nil
+}
+
+// transformBody runs the body of resp, answering req, through the
+// transforms. The transformed bodies are chunked, their length being
+// unknown.
+func (transforms bodyTransforms) transformBody(req *http.Request, resp *http.Response) {
+	if len(transforms) == 0 || req.Method == "HEAD" || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+	var body io.Reader = resp.Body
+	changed := false
+	for _, t := range transforms {
+		if transformed := t.transform(req, resp, body); transformed != nil {
+			body = transformed
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.TransferEncoding = []string{"chunked"}
+}
+
+func mediaType(resp *http.Response) string {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return t
+}
+
+// bannerTransform inserts a banner at the top of the HTML pages of a route.
+type bannerTransform struct {
+	route
+	html []byte
+}
+
+// parseBanner parses banners like "intranet.example.net=banner.html", the
+// route being optional, and reads their HTML file.
+func parseBanner(v string) (*bannerTransform, error) {
+	b := &bannerTransform{}
+	path := v
+	if eq := strings.IndexByte(v, '='); eq >= 0 {
+		b.route = parseRoute(v[:eq])
+		path = v[eq+1:]
+	}
+	html, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid banner %q: %v", v, err)
+	}
+	b.html = html
+	return b, nil
+}
+
+func (b *bannerTransform) transform(req *http.Request, resp *http.Response, body io.Reader) io.Reader {
+	if !b.matches(req.URL.Host, req.URL.RequestURI()) {
+		return nil
+	}
+	if t := mediaType(resp); t != "text/html" && t != "application/xhtml+xml" {
+		return nil
+	}
+	return &bannerReader{reader: bufio.NewReader(body), banner: b.html}
+}
+
+// bannerReader copies a page, inserting banner after its opening body tag.
+type bannerReader struct {
+	reader *bufio.Reader
+	banner []byte
+	// bytes of "<body" matched so far, and whether the rest of the tag is
+	// being read
+	matched int
+	inTag   bool
+	pending []byte
+	done    bool
+}
+
+func (b *bannerReader) Read(p []byte) (int, error) {
+	if len(b.pending) > 0 {
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		return n, nil
+	}
+	if b.done {
+		return b.reader.Read(p)
+	}
+	n := 0
+	for n < len(p) {
+		c, err := b.reader.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		p[n] = c
+		n++
+		switch {
+		case b.inTag:
+			if c == '>' {
+				b.done = true
+				b.pending = b.banner
+				return n, nil
+			}
+		case c|0x20 == "<body"[b.matched]|0x20:
+			b.matched++
+			b.inTag = b.matched == len("<body")
+		case c == '<':
+			b.matched = 1
+		default:
+			b.matched = 0
+		}
+	}
+	return n, nil
+}
+
+// redactTransform replaces the matches of patterns in textual bodies.
+type redactTransform struct {
+	patterns []*regexp.Regexp
+}
+
+var redacted = []byte("[REDACTED]")
+
+func (r *redactTransform) transform(req *http.Request, resp *http.Response, body io.Reader) io.Reader {
+	t := mediaType(resp)
+	if !strings.HasPrefix(t, "text/") && !strings.Contains(t, "json") &&
+		!strings.Contains(t, "xml") && !strings.Contains(t, "javascript") {
+		return nil
+	}
+	return &redactReader{reader: bufio.NewReaderSize(body, 64<<10), patterns: r.patterns}
+}
+
+// redactReader redacts a body line by line, the lines longer than its
+// buffer being split.
+type redactReader struct {
+	reader   *bufio.Reader
+	patterns []*regexp.Regexp
+	pending  []byte
+	err      error
+}
+
+func (r *redactReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		// the line stays valid until the next ReadSlice, once pending is
+		// drained
+		line, err := r.reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			r.err = err
+		}
+		for _, pattern := range r.patterns {
+			line = pattern.ReplaceAll(line, redacted)
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var typeFilterStats = expvar.NewMap("type_filter")
+
+// typeFilter blocks or strips the plain HTTP responses by media type. The
+// patterns are media types, like application/x-shockwave-flash, or whole
+// top-level types, like video/*.
+type typeFilter struct {
+	block []string
+	strip []string
+	allow []string
+	// when set, the types not allowed are blocked, instead of the types not
+	// blocked being allowed
+	denyByDefault bool
+	pages         *errorPages
+}
+
+// typeFilterConfig reads the media types to block, strip and allow, and
+// returns nil when none is filtered.
+func typeFilterConfig(config *viper.Viper, pages *errorPages) *typeFilter {
+	f := &typeFilter{
+		block:         config.GetStringSlice("block-type"),
+		strip:         config.GetStringSlice("strip-type"),
+		allow:         config.GetStringSlice("allow-type"),
+		denyByDefault: config.GetString("type-policy") == "deny",
+		pages:         pages,
+	}
+	if len(f.block) == 0 && len(f.strip) == 0 && len(f.allow) == 0 && !f.denyByDefault {
+		return nil
+	}
+	return f
+}
+
+func matchMediaType(patterns []string, t string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == t || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(t, pattern[:len(pattern)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns resp, answering req, the request of ctx, or what to answer in its place when
+// its type is blocked or stripped.
+func (f *typeFilter) filter(ctx context.Context, req *http.Request, resp *http.Response) *http.Response {
+	if f == nil {
+		return resp
+	}
+	t := mediaType(resp)
+	if t == "" {
+		t = "application/octet-stream"
+	}
+	var blocked *http.Response
+	switch {
+	case matchMediaType(f.strip, t):
+		typeFilterStats.Add("stripped", 1)
+		blocked = &http.Response{
+			Status:     fmt.Sprintf("%d %s", http.StatusNoContent, http.StatusText(http.StatusNoContent)),
+			StatusCode: http.StatusNoContent,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Cache-Control": {"no-store"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}
+	case matchMediaType(f.block, t), f.denyByDefault && !matchMediaType(f.allow, t):
+		typeFilterStats.Add("blocked", 1)
+		warnf("%s is of type %s, blocked", req.URL, t)
+		blocked = f.pages.blockPage(ctx, req, true, "Content blocked", fmt.Sprintf("%s is of type %s, which is not allowed.", req.URL, t))
+	default:
+		return resp
+	}
+	// the body is left unread, and the upstream connection closed with the
+	// client one
+	blocked.Close = true
+	return blocked
+}
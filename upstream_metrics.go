@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"syscall"
+)
+
+var (
+	upstreamErrors    = expvar.NewMap("upstream_errors")
+	upstreamErrorsMtx sync.Mutex
+)
+
+// countUpstreamError increments the counter of the given kind of error for
+// an upstream proxy.
+func countUpstreamError(upstream, kind string) {
+	upstreamErrorsMtx.Lock()
+	counters, ok := upstreamErrors.Get(upstream).(*expvar.Map)
+	if !ok {
+		counters = new(expvar.Map).Init()
+		for _, kind := range []string{"dial", "auth", "reset"} {
+			counters.Add(kind, 0)
+		}
+		upstreamErrors.Set(upstream, counters)
+	}
+	upstreamErrorsMtx.Unlock()
+	counters.Add(kind, 1)
+}
+
+// monitoredConn counts the authentication failures and connection resets of
+// a connection to an upstream proxy.
+type monitoredConn struct {
+	net.Conn
+	upstream string
+	checked  bool
+}
+
+func (m *monitoredConn) Read(buf []byte) (int, error) {
+	n, err := m.Conn.Read(buf)
+	if !m.checked && n > 0 {
+		m.checked = true
+		line := buf[:n]
+		if bytes.HasPrefix(line, []byte("HTTP/1.")) && len(line) >= 12 && string(line[9:12]) == "407" {
+			countUpstreamError(m.upstream, "auth")
+		}
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		countUpstreamError(m.upstream, "reset")
+	}
+	return n, err
+}
+
+func (m *monitoredConn) Write(buf []byte) (int, error) {
+	n, err := m.Conn.Write(buf)
+	if errors.Is(err, syscall.ECONNRESET) {
+		countUpstreamError(m.upstream, "reset")
+	}
+	return n, err
+}
+
+func (m *monitoredConn) CloseWrite() error {
+	return closeWrite(m.Conn)
+}
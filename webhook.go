@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookWarningInterval is the minimum delay between two warnings about
+// the events dropped because the webhooks can't keep up.
+const webhookWarningInterval = time.Minute
+
+var droppedNotifications = expvar.NewMap("dropped_webhook_events")
+
+// webhooks posts batches of events, as JSON arrays, to a set of URLs.
+type webhooks struct {
+	urls      []string
+	client    *http.Client
+	events    chan notification
+	batchSize int
+	interval  time.Duration
+	retries   int
+
+	mtx sync.Mutex
+	// events dropped since the last warning about them
+	dropped  int
+	warnedAt time.Time
+}
+
+func runWebhooks(urls []string, batchSize int, interval time.Duration, retries int) *webhooks {
+	w := &webhooks{
+		urls:      urls,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		events:    make(chan notification, 1024),
+		batchSize: batchSize,
+		interval:  interval,
+		retries:   retries,
+	}
+	go w.run()
+	return w
+}
+
+// notify queues an event, dropping it if the webhooks can't keep up.
+func (w *webhooks) notify(e notification) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		droppedNotifications.Add(e.Type, 1)
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+		w.dropped++
+		if time.Since(w.warnedAt) >= webhookWarningInterval {
+			warnf("webhook queue is full, dropped %d events", w.dropped)
+			w.dropped = 0
+			w.warnedAt = time.Now()
+		}
+	}
+}
+
+func (w *webhooks) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	batch := []notification{}
+	for {
+		select {
+		case e := <-w.events:
+			batch = append(batch, e)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		body, err := json.Marshal(batch)
+		batch = batch[:0]
+		if err != nil {
+			warnf("webhook: %v", err)
+			continue
+		}
+		for _, url := range w.urls {
+			err := w.post(url, body)
+			if err != nil {
+				warnf("webhook %s: %v", url, err)
+			}
+		}
+	}
+}
+
+func (w *webhooks) post(url string, body []byte) error {
+	var err error
+	delay := 500 * time.Millisecond
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var resp *http.Response
+		resp, err = w.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return err
+}